@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultConfigFileName is the name of the config file which is loaded from the root of the
+// workspace, if present and --config-file isn't set.
+const DefaultConfigFileName = ".target-determinator.json"
+
+// configFile is the format of a config file, which sets defaults for flags.
+// Values of flags may be strings, booleans, numbers, or (for flags which may be repeated) lists of
+// strings.
+type configFile struct {
+	// Defaults are the values of flags which apply regardless of profile.
+	Defaults map[string]interface{} `json:"defaults"`
+	// Profiles are named sets of flag values, selected by --profile, which take precedence over Defaults.
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+}
+
+// Flags which control how config is loaded, so can't be set by a config file.
+var configFlagNames = map[string]struct{}{
+	"config-file":            {},
+	"profile":                {},
+	"print-effective-config": {},
+	"working-directory":      {},
+}
+
+// applyConfig sets every flag which wasn't passed on the command line from, in decreasing order of
+// precedence, its TD_* environment variable, the selected profile of the config file, and the
+// defaults of the config file.
+// It returns where the value of each flag which was set came from.
+func applyConfig(commonFlags *CommonFlags) (map[string]string, error) {
+	sources := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "command line"
+	})
+
+	var envErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, set := sources[f.Name]; set || envErr != nil {
+			return
+		}
+		envName := EnvVarForFlag(f.Name)
+		if value, ok := os.LookupEnv(envName); ok {
+			if err := flag.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("invalid value of %s: %w", envName, err)
+				return
+			}
+			sources[f.Name] = "environment variable " + envName
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	configPath := *commonFlags.ConfigFile
+	if configPath == "" {
+		configPath = filepath.Join(*commonFlags.WorkingDirectory, DefaultConfigFileName)
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			if *commonFlags.Profile != "" {
+				return nil, fmt.Errorf("profile %q was selected but there is no config file at %s", *commonFlags.Profile, configPath)
+			}
+			return sources, nil
+		}
+	}
+	config, err := loadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if *commonFlags.Profile != "" {
+		profile, ok := config.Profiles[*commonFlags.Profile]
+		if !ok {
+			return nil, fmt.Errorf("profile %q not found in config file %s", *commonFlags.Profile, configPath)
+		}
+		if err := applyConfigValues(profile, fmt.Sprintf("profile %q of %s", *commonFlags.Profile, configPath), sources); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyConfigValues(config.Defaults, "defaults of "+configPath, sources); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// EnvVarForFlag returns the name of the environment variable which sets the flag with the given name,
+// e.g. TD_BAZEL_OPTS for --bazel-opts.
+func EnvVarForFlag(name string) string {
+	return "TD_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	var config configFile
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// applyConfigValues sets each flag in values which hasn't been set yet, recording source as where it
+// came from.
+func applyConfigValues(values map[string]interface{}, source string, sources map[string]string) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := configFlagNames[name]; ok {
+			return fmt.Errorf("%s can't be set in %s", name, source)
+		}
+		if _, set := sources[name]; set {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			// Config files may be shared between commands which accept different flags.
+			log.Printf("Ignoring %s from %s, which isn't a flag of this command", name, source)
+			continue
+		}
+		flagValues, err := configValueStrings(values[name])
+		if err != nil {
+			return fmt.Errorf("invalid value of %s in %s: %w", name, source, err)
+		}
+		for _, value := range flagValues {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value of %s in %s: %w", name, source, err)
+			}
+		}
+		sources[name] = source
+	}
+	return nil
+}
+
+func configValueStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case []interface{}:
+		var values []string
+		for _, element := range v {
+			s, ok := element.(string)
+			if !ok {
+				return nil, fmt.Errorf("lists may only contain strings, but got %v", element)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("expected a string, boolean, number or list of strings, but got %v", value)
+	}
+}
+
+// printEffectiveConfig prints the value of every flag, and where it came from, to stdout.
+func printEffectiveConfig(sources map[string]string) {
+	flag.VisitAll(func(f *flag.Flag) {
+		source, ok := sources[f.Name]
+		if !ok {
+			source = "default"
+		}
+		fmt.Printf("--%s=%s (%s)\n", f.Name, f.Value.String(), source)
+	})
+}
@@ -0,0 +1,209 @@
+package cli
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `{
+  "defaults": {
+    "targets": "//defaults/...",
+    "bazel": "defaults-bazel",
+    "hashing-parallelism": 4,
+    "bazel-opts": ["--config=defaults"]
+  },
+  "profiles": {
+    "ci": {
+      "targets": "//ci/...",
+      "cache-key-include-bazelrc": true,
+      "bazel-opts": ["--config=ci", "--jobs=8"]
+    }
+  }
+}`
+
+// registerTestFlags registers the common flags on a fresh command line, parses args, and writes
+// config to the default config file in the working directory, if it isn't empty.
+func registerTestFlags(t *testing.T, config string, args ...string) *CommonFlags {
+	t.Helper()
+	originalCommandLine := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = originalCommandLine })
+	flag.CommandLine = flag.NewFlagSet("target-determinator", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+
+	workingDirectory := t.TempDir()
+	if config != "" {
+		if err := os.WriteFile(filepath.Join(workingDirectory, DefaultConfigFileName), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commonFlags := RegisterCommonFlags()
+	if err := flag.CommandLine.Parse(append([]string{"--working-directory", workingDirectory}, args...)); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+	return commonFlags
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	t.Setenv("TD_TARGETS", "//env/...")
+	commonFlags := registerTestFlags(t, testConfig, "--profile", "ci")
+
+	sources, err := applyConfig(commonFlags)
+	if err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	if *commonFlags.TargetsFlag != "//env/..." {
+		t.Errorf("expected the environment variable to take precedence over the config file, got %s", *commonFlags.TargetsFlag)
+	}
+	if !commonFlags.CacheKeyIncludeBazelrc {
+		t.Errorf("expected the profile to set --cache-key-include-bazelrc")
+	}
+	if *commonFlags.BazelPath != "defaults-bazel" || commonFlags.HashingParallelism != 4 {
+		t.Errorf("expected the defaults of the config file to apply to flags the profile doesn't set, got %s and %d", *commonFlags.BazelPath, commonFlags.HashingParallelism)
+	}
+	if *commonFlags.Progress != "auto" {
+		t.Errorf("expected flags set nowhere to keep their default, got %s", *commonFlags.Progress)
+	}
+
+	configPath := filepath.Join(*commonFlags.WorkingDirectory, DefaultConfigFileName)
+	want := map[string]string{
+		"working-directory":         "command line",
+		"profile":                   "command line",
+		"targets":                   "environment variable TD_TARGETS",
+		"cache-key-include-bazelrc": `profile "ci" of ` + configPath,
+		"bazel-opts":                `profile "ci" of ` + configPath,
+		"bazel":                     "defaults of " + configPath,
+		"hashing-parallelism":       "defaults of " + configPath,
+	}
+	if !reflect.DeepEqual(sources, want) {
+		t.Errorf("want sources %v, got %v", want, sources)
+	}
+}
+
+func TestApplyConfigExplicitFlagsWin(t *testing.T) {
+	t.Setenv("TD_TARGETS", "//env/...")
+	commonFlags := registerTestFlags(t, testConfig, "--profile", "ci", "--targets", "//flag/...", "--bazel-opts", "--config=flag")
+
+	if _, err := applyConfig(commonFlags); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	if *commonFlags.TargetsFlag != "//flag/..." {
+		t.Errorf("expected the flag to take precedence over the environment variable, got %s", *commonFlags.TargetsFlag)
+	}
+	// Lists from config files aren't appended to lists passed on the command line.
+	if want := (MultipleStrings{"--config=flag"}); !reflect.DeepEqual(*commonFlags.BazelOpts, want) {
+		t.Errorf("want %v, got %v", want, *commonFlags.BazelOpts)
+	}
+}
+
+func TestApplyConfigListValues(t *testing.T) {
+	commonFlags := registerTestFlags(t, testConfig, "--profile", "ci")
+	if _, err := applyConfig(commonFlags); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	// The profile's list replaces that of the defaults, rather than being appended to it.
+	if want := (MultipleStrings{"--config=ci", "--jobs=8"}); !reflect.DeepEqual(*commonFlags.BazelOpts, want) {
+		t.Errorf("want %v, got %v", want, *commonFlags.BazelOpts)
+	}
+
+	commonFlags = registerTestFlags(t, `{"defaults": {"bazel-opts": ["--jobs", 8]}}`)
+	if _, err := applyConfig(commonFlags); err == nil || !strings.Contains(err.Error(), "lists may only contain strings") {
+		t.Errorf("expected an error for a list containing a number, got %v", err)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config string
+		args   []string
+	}{
+		"forbidden key in defaults":     {config: `{"defaults": {"profile": "ci"}}`},
+		"forbidden key in profile":      {config: `{"profiles": {"ci": {"config-file": "other.json"}}}`, args: []string{"--profile", "ci"}},
+		"unknown profile":               {config: testConfig, args: []string{"--profile", "release"}},
+		"profile without a config file": {args: []string{"--profile", "ci"}},
+		"unknown top-level key":         {config: `{"default": {}}`},
+		"invalid value":                 {config: `{"defaults": {"hashing-parallelism": "many"}}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			commonFlags := registerTestFlags(t, tc.config, tc.args...)
+			if _, err := applyConfig(commonFlags); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+
+	t.Run("invalid environment variable", func(t *testing.T) {
+		t.Setenv("TD_HASHING_PARALLELISM", "many")
+		commonFlags := registerTestFlags(t, "")
+		if _, err := applyConfig(commonFlags); err == nil || !strings.Contains(err.Error(), "TD_HASHING_PARALLELISM") {
+			t.Errorf("expected an error naming the environment variable, got %v", err)
+		}
+	})
+}
+
+func TestApplyConfigIgnoresUnknownFlags(t *testing.T) {
+	// Config files may be shared between commands which accept different flags.
+	commonFlags := registerTestFlags(t, `{"defaults": {"verbose": true, "targets": "//defaults/..."}}`)
+	sources, err := applyConfig(commonFlags)
+	if err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	if _, ok := sources["verbose"]; ok {
+		t.Errorf("expected verbose not to be set")
+	}
+	if *commonFlags.TargetsFlag != "//defaults/..." {
+		t.Errorf("expected other flags to be set, got %s", *commonFlags.TargetsFlag)
+	}
+}
+
+func TestPrintEffectiveConfig(t *testing.T) {
+	t.Setenv("TD_BAZEL", "env-bazel")
+	commonFlags := registerTestFlags(t, testConfig, "--profile", "ci", "--bazel-startup-opts", "--host_jvm_args=-Xmx1g")
+	sources, err := applyConfig(commonFlags)
+	if err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalStdout := os.Stdout
+	os.Stdout = writer
+	printEffectiveConfig(sources)
+	os.Stdout = originalStdout
+	writer.Close()
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(*commonFlags.WorkingDirectory, DefaultConfigFileName)
+	for _, want := range []string{
+		"--bazel=env-bazel (environment variable TD_BAZEL)\n",
+		"--bazel-startup-opts=[--host_jvm_args=-Xmx1g] (command line)\n",
+		`--bazel-opts=[--config=ci --jobs=8] (profile "ci" of ` + configPath + ")\n",
+		"--hashing-parallelism=4 (defaults of " + configPath + ")\n",
+		"--progress=auto (default)\n",
+	} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+}
+
+func TestMultipleStringsString(t *testing.T) {
+	values := MultipleStrings{}
+	if got := values.String(); got != "[]" {
+		t.Errorf("want %q, got %q", "[]", got)
+	}
+	values.Set("--jobs=8")
+	values.Set("--config=ci")
+	if got := values.String(); got != "[--jobs=8 --config=ci]" {
+		t.Errorf("want %q, got %q", "[--jobs=8 --config=ci]", got)
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bazel-contrib/target-determinator/common"
 	"github.com/bazel-contrib/target-determinator/pkg"
@@ -67,8 +71,38 @@ func (e *EnforceCleanFlag) Set(value string) error {
 	return nil
 }
 
+// ByteSizeFlag is a number of bytes, which may be given with a binary unit suffix, e.g. 512M or 10GiB.
+type ByteSizeFlag int64
+
+var byteSizeUnits = []string{"K", "M", "G", "T"}
+
+func (b ByteSizeFlag) String() string {
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *ByteSizeFlag) Set(value string) error {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	multiplier := int64(1)
+	for i, unit := range byteSizeUnits {
+		if trimmed, ok := strings.CutSuffix(number, unit); ok {
+			number = trimmed
+			multiplier = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q: expected a non-negative number of bytes, optionally followed by one of K, M, G or T", value)
+	}
+	*b = ByteSizeFlag(n * multiplier)
+	return nil
+}
+
 type CommonFlags struct {
 	Version                                bool
+	ConfigFile                             *string
+	Profile                                *string
+	PrintEffectiveConfig                   bool
 	WorkingDirectory                       *string
 	BazelPath                              *string
 	BazelStartupOpts                       *MultipleStrings
@@ -81,8 +115,26 @@ type CommonFlags struct {
 	AnalysisCacheClearStrategy             *string
 	CompareQueriesAroundAnalysisCacheClear bool
 	FilterIncompatibleTargets              bool
+	HashExclusionPolicyFile                *string
+	ExternalRepoHashStrategy               *string
+	DetectToolchainChanges                 bool
+	BreakDependencyCycles                  bool
+	ParallelRevisions                      bool
+	IncrementalSourceRehash                bool
+	HashingParallelism                     int
+	Progress                               *string
 	CacheDirectory                         *string
+	RemoteCacheURL                         *string
+	RemoteCacheTimeout                     time.Duration
+	CacheMaxSize                           ByteSizeFlag
+	CacheMaxAge                            time.Duration
+	CacheKeyIncludeBazelrc                 bool
+	CacheKeyEnv                            *CommaSeparatedStrings
+	CacheKeyHostFingerprint                bool
+	CacheExplanations                      bool
+	BazelEnvAllowlist                      *CommaSeparatedStrings
 	NoCacheResults                         bool
+	NoCacheFileDigests                     bool
 }
 
 func StrPtr() *string {
@@ -93,6 +145,9 @@ func StrPtr() *string {
 func RegisterCommonFlags() *CommonFlags {
 	commonFlags := CommonFlags{
 		Version:                                false,
+		ConfigFile:                             StrPtr(),
+		Profile:                                StrPtr(),
+		PrintEffectiveConfig:                   false,
 		WorkingDirectory:                       StrPtr(),
 		BazelPath:                              StrPtr(),
 		BazelStartupOpts:                       &MultipleStrings{},
@@ -105,15 +160,37 @@ func RegisterCommonFlags() *CommonFlags {
 		AnalysisCacheClearStrategy:             StrPtr(),
 		CompareQueriesAroundAnalysisCacheClear: false,
 		FilterIncompatibleTargets:              true,
+		HashExclusionPolicyFile:                StrPtr(),
+		ExternalRepoHashStrategy:               StrPtr(),
+		DetectToolchainChanges:                 false,
+		BreakDependencyCycles:                  false,
+		ParallelRevisions:                      false,
+		IncrementalSourceRehash:                false,
+		HashingParallelism:                     0,
+		Progress:                               StrPtr(),
 		CacheDirectory:                         StrPtr(),
+		RemoteCacheURL:                         StrPtr(),
+		RemoteCacheTimeout:                     0,
+		CacheMaxSize:                           0,
+		CacheMaxAge:                            0,
+		CacheKeyIncludeBazelrc:                 false,
+		CacheKeyEnv:                            &CommaSeparatedStrings{},
+		CacheKeyHostFingerprint:                false,
+		CacheExplanations:                      false,
+		BazelEnvAllowlist:                      &CommaSeparatedStrings{},
 		NoCacheResults:                         false,
+		NoCacheFileDigests:                     false,
 	}
 	flag.BoolVar(&commonFlags.Version, "version", false, "Print the version of the tool and exit.")
+	flag.StringVar(commonFlags.ConfigFile, "config-file", "", fmt.Sprintf("Path to a JSON file setting defaults for flags. Defaults to %s in the working directory, if it exists. See README.md for the format.", DefaultConfigFileName))
+	flag.StringVar(commonFlags.Profile, "profile", "", "Name of the profile of the config file whose flags to use, in addition to the config file's defaults.")
+	flag.BoolVar(&commonFlags.PrintEffectiveConfig, "print-effective-config", false, "Print the value of every flag, and where it was set, and exit.")
 	flag.StringVar(commonFlags.WorkingDirectory, "working-directory", ".", "Working directory to query.")
 	flag.StringVar(commonFlags.BazelPath, "bazel", "bazel",
 		"Bazel binary (basename on $PATH, or absolute or relative path) to run.")
 	flag.Var(commonFlags.BazelStartupOpts, "bazel-startup-opts", "Startup options to pass to Bazel. Options such as '--bazelrc' should use relative paths for files under the repository to avoid issues (TD may check out the repository in a temporary directory).")
 	flag.Var(commonFlags.BazelOpts, "bazel-opts", "Options to pass to Bazel. Assumed to apply to build and cquery. Options should use relative paths for repository files (see --bazel-startup-opts).")
+	flag.Var(commonFlags.BazelEnvAllowlist, "bazel-env-allowlist", "Comma-separated `names` of the only environment variables to run Bazel with, e.g. PATH,HOME. If empty, Bazel inherits the whole environment. Stops environment variables which differ between invocations (e.g. for stamping) from affecting results.")
 	flag.Var(&commonFlags.EnforceCleanRepo, "enforce-clean",
 		fmt.Sprintf("Pass --enforce-clean=%v to fail if the repository is unclean, or --enforce-clean=%v to allow ignored untracked files (the default).",
 			EnforceClean.String(), AllowIgnored.String()))
@@ -127,12 +204,35 @@ func RegisterCommonFlags() *CommonFlags {
 	flag.StringVar(commonFlags.AnalysisCacheClearStrategy, "analysis-cache-clear-strategy", "skip", "Strategy for clearing the analysis cache. Accepted values: skip,shutdown,discard.")
 	flag.BoolVar(&commonFlags.CompareQueriesAroundAnalysisCacheClear, "compare-queries-around-analysis-cache-clear", false, "Whether to check for query result differences before and after analysis cache clears. This is a temporary flag for performing real-world analysis.")
 	flag.BoolVar(&commonFlags.FilterIncompatibleTargets, "filter-incompatible-targets", true, "Whether to filter out incompatible targets from the candidate set of affected targets.")
-	flag.StringVar(commonFlags.CacheDirectory, "cache-dir", defaultCacheDir(), "Cache directory to avoid existing re-computations. Note: home- and system- bazelrc files, environment variables, and host hardware/OS are not included in the results cache key. Use --nocache_results if necessary.")
+	flag.StringVar(commonFlags.HashExclusionPolicyFile, "hash-exclusion-policy", "", "Path to a JSON file listing attributes, rule implementations and source files which should be ignored when hashing targets. See README.md for the format.")
+	flag.StringVar(commonFlags.ExternalRepoHashStrategy, "external-repo-hash-strategy", pkg.ExternalRepoHashStrategyContents, "How to hash source files in external repositories. Accepted values: contents,definition. 'definition' hashes each repository by its definition (e.g. URLs and integrity) rather than by the files extracted into the output base, and reports changes as ExternalDependencyChanged differences.")
+	flag.BoolVar(&commonFlags.DetectToolchainChanges, "detect-toolchain-changes", false, "Whether to identify the toolchains resolved for each target (using an additional cquery), so that changes to them are reported as ToolchainChanged differences.")
+	flag.BoolVar(&commonFlags.BreakDependencyCycles, "break-dependency-cycles", false, "Whether to hash targets which depend on a dependency cycle by ignoring one dependency of each cycle, rather than failing. Each ignored dependency is logged.")
+	flag.BoolVar(&commonFlags.ParallelRevisions, "parallel-revisions", false, "Whether to process the before revision in a dedicated git worktree, with its own Bazel output base, concurrently with the after revision. This is typically faster on machines with spare cores, at the cost of running a second Bazel server and keeping a second output base on disk.")
+	flag.BoolVar(&commonFlags.IncrementalSourceRehash, "incremental-source-rehash", false, "Whether to reuse the target graph of the before revision for the after revision when they only differ in the contents of source files in it, rather than querying the after revision. Only the changed source files and the targets which depend on them are rehashed. Requires --external-repo-hash-strategy=definition, so that changes to files referenced by repository definitions cause the after revision to be queried.")
+	flag.IntVar(&commonFlags.HashingParallelism, "hashing-parallelism", 0, "Number of targets to hash concurrently. Defaults to the number of CPUs.")
+	flag.StringVar(commonFlags.Progress, "progress", pkg.ProgressModeAuto, "How to report the progress of long-running phases (e.g. cquery and hashing) on stderr. Accepted values: auto,tty,log,none. 'auto' uses a progress line if stderr is a terminal, and periodic log lines otherwise.")
+	RegisterCacheLimitFlags(&commonFlags.CacheMaxSize, &commonFlags.CacheMaxAge)
+	flag.StringVar(commonFlags.CacheDirectory, "cache-dir", DefaultCacheDir(), "Cache directory to avoid existing re-computations. Note: home- and system- bazelrc files (unless --cache-key-include-bazelrc is set), and environment variables (other than --cache-key-env) are not included in the results cache key. Use --nocache_results if necessary.")
+	flag.BoolVar(&commonFlags.CacheExplanations, "cache-explanations", false, "Whether to also cache the metadata needed to explain why targets are affected, so that -verbose can use cached results. This makes cache entries considerably larger.")
+	flag.BoolVar(&commonFlags.CacheKeyHostFingerprint, "cache-key-host-fingerprint", false, "Whether to include the OS, CPU architecture, kernel version, libc and Bazel host platform of the current machine in the results cache key, so that cached results may be shared between different machines. If the host platform can't be determined, results aren't cached.")
+	flag.BoolVar(&commonFlags.CacheKeyIncludeBazelrc, "cache-key-include-bazelrc", false, "Whether to include the options Bazel reads from bazelrc files, including user and system bazelrc files, in the results cache key, so that changing them invalidates cached results. This costs an additional Bazel invocation per revision.")
+	flag.Var(commonFlags.CacheKeyEnv, "cache-key-env", "Comma-separated `names` of environment variables whose values are included in the results cache key, e.g. because they affect Bazel's analysis.")
+	flag.StringVar(commonFlags.RemoteCacheURL, "remote-cache-url", "", "URL of an HTTP cache server (e.g. bazel-remote) to share cached results through, using the protocol of Bazel's HTTP remote cache. Results are still cached in --cache-dir, which is used if the server can't be reached.")
+	flag.DurationVar(&commonFlags.RemoteCacheTimeout, "remote-cache-timeout", 10*time.Second, "Timeout of each request to --remote-cache-url.")
 	flag.BoolVar(&commonFlags.NoCacheResults, "nocache_results", false, "Disable loading and saving of results to the cache.")
+	flag.BoolVar(&commonFlags.NoCacheFileDigests, "nocache_file_digests", false, "Disable persisting source file digests in the cache directory. Persisted digests are keyed by path, size, mtime, inode and exec bit.")
 	return &commonFlags
 }
 
-func defaultCacheDir() string {
+// RegisterCacheLimitFlags registers the flags limiting the size and age of cached results.
+func RegisterCacheLimitFlags(maxSize *ByteSizeFlag, maxAge *time.Duration) {
+	flag.Var(maxSize, "cache-max-size", "Maximum total `size` of cached results in --cache-dir, e.g. 10G. When exceeded, the least recently used results are removed. 0 means unlimited.")
+	flag.DurationVar(maxAge, "cache-max-age", 0, "Maximum time since cached results in --cache-dir were last used, e.g. 720h, after which they are removed. 0 means unlimited.")
+}
+
+// DefaultCacheDir returns the default value of --cache-dir.
+func DefaultCacheDir() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		log.Printf("failed to determine home dir: %v. Caching will be disabled.", err)
@@ -148,19 +248,56 @@ type CommonConfig struct {
 
 // ValidateCommonFlags ensures that the argument follow the right format
 func ValidateCommonFlags(commandName string, flags *CommonFlags) (targetPattern string, err error) {
-	if flags.Version {
-		fmt.Printf("%s %s\n", commandName, version.Version)
-		os.Exit(0)
+	return ValidateCommonFlagsWithRevision(commandName, flags, "before-revision")
+}
+
+// ValidateCommonFlagsWithRevision ensures that the argument follow the right format, where the
+// single positional argument is a revision described by revisionName.
+func ValidateCommonFlagsWithRevision(commandName string, flags *CommonFlags, revisionName string) (revision string, err error) {
+	if err := validateCommonFlags(commandName, flags); err != nil {
+		return "", err
 	}
 
 	positional := flag.Args()
 	if len(positional) != 1 {
-		return "", fmt.Errorf("expected one positional argument, <before-revision>, but got %d", len(positional))
+		return "", fmt.Errorf("expected one positional argument, <%s>, but got %d", revisionName, len(positional))
 	}
 	return positional[0], nil
 
 }
 
+// ValidateCommonFlagsWithRevisions ensures that the argument follow the right format, where the
+// positional arguments are one or more revisions described by revisionName.
+func ValidateCommonFlagsWithRevisions(commandName string, flags *CommonFlags, revisionName string) (revisions []string, err error) {
+	if err := validateCommonFlags(commandName, flags); err != nil {
+		return nil, err
+	}
+
+	positional := flag.Args()
+	if len(positional) == 0 {
+		return nil, fmt.Errorf("expected at least one positional argument, <%s>", revisionName)
+	}
+	return positional, nil
+}
+
+// validateCommonFlags handles the flags which print something and exit, and applies the config file.
+func validateCommonFlags(commandName string, flags *CommonFlags) error {
+	if flags.Version {
+		fmt.Printf("%s %s\n", commandName, version.Version)
+		os.Exit(0)
+	}
+
+	sources, err := applyConfig(flags)
+	if err != nil {
+		return err
+	}
+	if flags.PrintEffectiveConfig {
+		printEffectiveConfig(sources)
+		os.Exit(0)
+	}
+	return nil
+}
+
 func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*CommonConfig, error) {
 
 	// Context attributes
@@ -184,6 +321,27 @@ func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*Common
 		BazelPath:        *commonFlags.BazelPath,
 		BazelStartupOpts: *commonFlags.BazelStartupOpts,
 		BazelOpts:        *commonFlags.BazelOpts,
+		EnvAllowlist:     commonFlags.BazelEnvAllowlist.Sorted(),
+	}
+
+	var hashExclusionPolicy *pkg.HashExclusionPolicy
+	if *commonFlags.HashExclusionPolicyFile != "" {
+		hashExclusionPolicy, err = pkg.LoadHashExclusionPolicy(*commonFlags.HashExclusionPolicyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := pkg.ValidateExternalRepoHashStrategy(*commonFlags.ExternalRepoHashStrategy); err != nil {
+		return nil, err
+	}
+	if commonFlags.IncrementalSourceRehash && *commonFlags.ExternalRepoHashStrategy != pkg.ExternalRepoHashStrategyDefinition {
+		return nil, fmt.Errorf("--incremental-source-rehash requires --external-repo-hash-strategy=%s, so that changes to files read by repository definitions are detected", pkg.ExternalRepoHashStrategyDefinition)
+	}
+
+	progress, err := pkg.NewProgressReporter(*commonFlags.Progress)
+	if err != nil {
+		return nil, err
 	}
 
 	outputBase, err := pkg.BazelOutputBase(workingDirectory, bazelCmd)
@@ -202,9 +360,26 @@ func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*Common
 		AnalysisCacheClearStrategy:             *commonFlags.AnalysisCacheClearStrategy,
 		CompareQueriesAroundAnalysisCacheClear: commonFlags.CompareQueriesAroundAnalysisCacheClear,
 		FilterIncompatibleTargets:              commonFlags.FilterIncompatibleTargets,
+		HashExclusionPolicy:                    hashExclusionPolicy,
+		ExternalRepoHashStrategy:               *commonFlags.ExternalRepoHashStrategy,
+		DetectToolchainChanges:                 commonFlags.DetectToolchainChanges,
+		BreakDependencyCycles:                  commonFlags.BreakDependencyCycles,
+		ParallelRevisions:                      commonFlags.ParallelRevisions,
+		IncrementalSourceRehash:                commonFlags.IncrementalSourceRehash,
+		HashingParallelism:                     commonFlags.HashingParallelism,
+		Progress:                               progress,
 		EnforceCleanRepo:                       commonFlags.EnforceCleanRepo == EnforceClean,
 		CacheDirectory:                         *commonFlags.CacheDirectory,
+		RemoteCacheURL:                         *commonFlags.RemoteCacheURL,
+		RemoteCacheTimeout:                     commonFlags.RemoteCacheTimeout,
+		CacheMaxSize:                           int64(commonFlags.CacheMaxSize),
+		CacheMaxAge:                            commonFlags.CacheMaxAge,
+		CacheKeyIncludeBazelrc:                 commonFlags.CacheKeyIncludeBazelrc,
+		CacheKeyEnv:                            commonFlags.CacheKeyEnv.Sorted(),
+		CacheKeyHostFingerprint:                commonFlags.CacheKeyHostFingerprint,
+		CacheExplanations:                      commonFlags.CacheExplanations,
 		NoCacheResults:                         commonFlags.NoCacheResults,
+		NoCacheFileDigests:                     commonFlags.NoCacheFileDigests,
 	}
 
 	// Non-context attributes
@@ -229,10 +404,37 @@ func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*Common
 type MultipleStrings []string
 
 func (s *MultipleStrings) String() string {
-	return fmt.Sprintf("%v", MultipleStrings{})
+	return fmt.Sprintf("%v", []string(*s))
 }
 
 func (s *MultipleStrings) Set(value string) error {
 	*s = append(*s, value)
 	return nil
 }
+
+// CommaSeparatedStrings is a list of strings, given as a comma-separated list. The flag may also be
+// repeated, appending to the list.
+type CommaSeparatedStrings []string
+
+func (s *CommaSeparatedStrings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *CommaSeparatedStrings) Set(value string) error {
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			*s = append(*s, element)
+		}
+	}
+	return nil
+}
+
+// Sorted returns the distinct strings of the list, sorted, or nil if it is empty.
+func (s *CommaSeparatedStrings) Sorted() []string {
+	if len(*s) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), *s...)
+	sort.Strings(sorted)
+	return slices.Compact(sorted)
+}
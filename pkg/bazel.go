@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sort"
 
 	"github.com/bazel-contrib/target-determinator/common/versions"
 	"github.com/hashicorp/go-version"
@@ -43,6 +44,9 @@ type DefaultBazelCmd struct {
 	BazelPath        string
 	BazelStartupOpts []string
 	BazelOpts        []string
+	// EnvAllowlist, if non-empty, lists the only environment variables which Bazel is run with.
+	// Otherwise, Bazel inherits the whole environment.
+	EnvAllowlist []string
 }
 
 // Commands which we should apply BazelOpts to.
@@ -54,8 +58,8 @@ var _buildLikeCommands = map[string]struct{}{
 	"test":   {},
 }
 
-// HashKey returns a SHA-256 digest of the cache-affecting fields: BazelStartupOpts and BazelOpts.
-// Both slices are included in order, as their ordering affects Bazel behaviour.
+// HashKey returns a SHA-256 digest of the cache-affecting fields: BazelStartupOpts, BazelOpts and
+// EnvAllowlist. The options are included in order, as their ordering affects Bazel behaviour.
 //
 // The Bazel version from BazelPath is already available in the context so, to avoid running another bazel subprocess,
 // it is not taken as input to the resulting hash.
@@ -63,10 +67,18 @@ func (c DefaultBazelCmd) HashKey() string {
 	type fields struct {
 		BazelStartupOpts []string
 		BazelOpts        []string
+		// Omitted when empty so that keys are unchanged for callers which don't use it.
+		EnvAllowlist []string `json:",omitempty"`
+	}
+	var envAllowlist []string
+	if len(c.EnvAllowlist) > 0 {
+		envAllowlist = append([]string(nil), c.EnvAllowlist...)
+		sort.Strings(envAllowlist)
 	}
 	data, _ := json.Marshal(fields{
 		BazelStartupOpts: c.BazelStartupOpts,
 		BazelOpts:        c.BazelOpts,
+		EnvAllowlist:     envAllowlist,
 	})
 	h := sha256.Sum256(data)
 	return hex.EncodeToString(h[:])
@@ -85,6 +97,9 @@ func (c DefaultBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, co
 	bazelArgv = append(bazelArgv, args...)
 	cmd := exec.Command(c.BazelPath, bazelArgv...)
 	cmd.Dir = config.Dir
+	if len(c.EnvAllowlist) > 0 {
+		cmd.Env = allowlistedEnv(c.EnvAllowlist)
+	}
 	cmd.Stdout = config.Stdout
 	cmd.Stderr = config.Stderr
 
@@ -98,7 +113,21 @@ func (c DefaultBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, co
 	return 0, nil
 }
 
+// allowlistedEnv returns the variables of the current environment which are named in allowlist.
+func allowlistedEnv(allowlist []string) []string {
+	// Non-nil, as a nil exec.Cmd.Env inherits the whole environment.
+	env := []string{}
+	for _, name := range allowlist {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
 // Cquery calls bazel cquery with the provided arguments, using an output file if supported.
+// When an output file is used, its contents are copied to config.Stdout once cquery finishes, so
+// config.Stdout may be a pipe which is consumed concurrently.
 // It returns the exit status code or -1 if it errored before the process could start.
 func (c DefaultBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, startupArgs []string, args ...string) (int, error) {
 	hasOutputFile, _ := versions.ReleaseIsInRange(bazelRelease, version.Must(version.NewVersion("8.2.0")), nil)
@@ -118,7 +147,7 @@ func (c DefaultBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, star
 		return 1, fmt.Errorf("failed to close temporary file for cquery output: %w", err)
 	}
 
-	exitCode, err := c.Execute(config, startupArgs, "cquery", append(args, "--output_file="+cqueryOutput)...)
+	exitCode, cqueryErr := c.Execute(config, startupArgs, "cquery", append(args, "--output_file="+cqueryOutput)...)
 
 	cqueryOutputFile, err = os.Open(cqueryOutput)
 	if err != nil {
@@ -129,5 +158,5 @@ func (c DefaultBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, star
 		return exitCode, fmt.Errorf("failed to read cquery output: %w", err)
 	}
 
-	return exitCode, err
+	return exitCode, cqueryErr
 }
@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	rcOptionsForCommandRegex = regexp.MustCompile(`^INFO: Reading rc options for '[^']+' from (.*):$`)
+	rcCommandOptionsRegex    = regexp.MustCompile(`^\s+(?:Inherited )?'([^']+)' options: (.*)$`)
+	rcStartupOptionsRegex    = regexp.MustCompile(`^INFO: Reading 'startup' options from (.*?): (.*)$`)
+	rcConfigDefinitionRegex  = regexp.MustCompile(`^INFO: Found applicable config definition (\S+) in file (.*?): (.*)$`)
+)
+
+// announcedRcOptions are the options --announce_rc reports reading from a single line of a bazelrc
+// file.
+type announcedRcOptions struct {
+	// file is the path of the bazelrc file, as reported by Bazel.
+	file string
+	// appliesTo is the command or config the options apply to, e.g. "build" or "build:ci".
+	appliesTo string
+	options   string
+}
+
+// effectiveBazelrcOptionsCache memoizes EffectiveBazelrcOptions by workspace path and BazelCmd, as
+// computing a cache key for a revision would otherwise run Bazel each time.
+var effectiveBazelrcOptionsCache = struct {
+	lock    sync.Mutex
+	options map[string][]string
+}{options: make(map[string][]string)}
+
+// EffectiveBazelrcOptions returns the options which Bazel applies to cquery invocations in
+// workspacePath from bazelrc files (including user and system bazelrc files, files they import, and
+// configs they define which are selected by --config), in the order Bazel applies them.
+// Each option is prefixed by the command or config it applies to, e.g. "build: --jobs=8", and
+// occurrences of workspacePath are replaced by %workspace%, so that the same options are returned
+// for different checkouts of the same repository.
+//
+// Options from bazelrc files tracked by git in workspacePath are left out: they are part of the
+// revision being processed (and so of its cache key), whereas the files read here are those of
+// whatever revision is checked out.
+//
+// They are resolved by running an empty cquery with --announce_rc, and parsing which options Bazel
+// reports reading.
+func EffectiveBazelrcOptions(workspacePath string, bazelCmd BazelCmd) ([]string, error) {
+	effectiveBazelrcOptionsCache.lock.Lock()
+	defer effectiveBazelrcOptionsCache.lock.Unlock()
+	memoKey := workspacePath + "\x00" + bazelCmd.HashKey()
+	if options, ok := effectiveBazelrcOptionsCache.options[memoKey]; ok {
+		return options, nil
+	}
+
+	var stderrBuf bytes.Buffer
+	result, err := bazelCmd.Execute(
+		BazelCmdConfig{Dir: workspacePath, Stderr: &stderrBuf},
+		nil, "cquery", "--announce_rc", "set()")
+	announcedOptions, announced := parseAnnouncedRcOptions(stderrBuf.String())
+	// Options are announced before the query runs, so only whether they were announced matters.
+	if result == -1 || (result != 0 && !announced) {
+		return nil, fmt.Errorf("failed to resolve the effective bazelrc options: %w. Stderr:\n%v", err, stderrBuf.String())
+	}
+	trackedFiles, err := trackedWorkspaceFiles(workspacePath, announcedOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check which bazelrc files are tracked: %w", err)
+	}
+	var options []string
+	for _, announcedOption := range announcedOptions {
+		if _, isTracked := trackedFiles[announcedOption.file]; isTracked {
+			continue
+		}
+		options = append(options, announcedOption.appliesTo+": "+strings.ReplaceAll(announcedOption.options, workspacePath, "%workspace%"))
+	}
+
+	effectiveBazelrcOptionsCache.options[memoKey] = options
+	return options, nil
+}
+
+// parseAnnouncedRcOptions parses the options from bazelrc files which --announce_rc reports in
+// stderr. Options provided by the client (e.g. --terminal_columns) are ignored, as they depend on
+// how Bazel was invoked rather than on bazelrc files.
+// It also returns whether Bazel reported reading bazelrc files at all.
+func parseAnnouncedRcOptions(stderr string) ([]announcedRcOptions, bool) {
+	var options []announcedRcOptions
+	announced := false
+	// rcFile is the file whose options for the command are being announced, if any.
+	rcFile := ""
+	scanner := bufio.NewScanner(strings.NewReader(stderr))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rcFile != "" {
+			if matches := rcCommandOptionsRegex.FindStringSubmatch(line); matches != nil {
+				options = append(options, announcedRcOptions{file: rcFile, appliesTo: matches[1], options: matches[2]})
+				continue
+			}
+			rcFile = ""
+		}
+
+		if matches := rcOptionsForCommandRegex.FindStringSubmatch(line); matches != nil {
+			announced = true
+			rcFile = matches[1]
+		} else if matches := rcStartupOptionsRegex.FindStringSubmatch(line); matches != nil {
+			options = append(options, announcedRcOptions{file: matches[1], appliesTo: "startup", options: matches[2]})
+		} else if matches := rcConfigDefinitionRegex.FindStringSubmatch(line); matches != nil {
+			options = append(options, announcedRcOptions{file: matches[2], appliesTo: matches[1], options: matches[3]})
+		} else if strings.HasPrefix(line, "INFO: Options provided by the client:") {
+			announced = true
+		}
+	}
+	return options, announced
+}
+
+// trackedWorkspaceFiles returns which of the files options were read from are in workspacePath and
+// tracked by git.
+func trackedWorkspaceFiles(workspacePath string, options []announcedRcOptions) (map[string]struct{}, error) {
+	relPaths := make(map[string]string)
+	for _, option := range options {
+		relPath, err := filepath.Rel(workspacePath, option.file)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		relPaths[filepath.ToSlash(relPath)] = option.file
+	}
+	tracked := make(map[string]struct{})
+	if len(relPaths) == 0 {
+		return tracked, nil
+	}
+
+	args := []string{"-c", "core.quotePath=false", "ls-files", "--"}
+	for relPath := range relPaths {
+		args = append(args, relPath)
+	}
+	trackedRelPaths, err := runToLines(workspacePath, "git", args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, relPath := range trackedRelPaths {
+		if file, ok := relPaths[relPath]; ok {
+			tracked[file] = struct{}{}
+		}
+	}
+	return tracked, nil
+}
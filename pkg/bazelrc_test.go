@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const announcedRcStderr = `INFO: Reading 'startup' options from /home/user/.bazelrc: --output_user_root=/tmp/bazel
+INFO: Options provided by the client:
+  Inherited 'common' options: --isatty=1 --terminal_columns=213
+INFO: Reading rc options for 'cquery' from /work/repo/.bazelrc:
+  Inherited 'common' options: --enable_bzlmod
+INFO: Reading rc options for 'cquery' from /work/repo/.bazelrc:
+  Inherited 'build' options: --disk_cache=/work/repo/.cache --config=ci
+INFO: Reading rc options for 'cquery' from /home/user/.bazelrc:
+  Inherited 'build' options: --jobs=8
+INFO: Found applicable config definition build:ci in file /work/repo/.bazelrc: --noshow_progress
+INFO: Empty query results
+`
+
+func TestParseAnnouncedRcOptions(t *testing.T) {
+	got, announced := parseAnnouncedRcOptions(announcedRcStderr)
+	want := []announcedRcOptions{
+		{file: "/home/user/.bazelrc", appliesTo: "startup", options: "--output_user_root=/tmp/bazel"},
+		{file: "/work/repo/.bazelrc", appliesTo: "common", options: "--enable_bzlmod"},
+		{file: "/work/repo/.bazelrc", appliesTo: "build", options: "--disk_cache=/work/repo/.cache --config=ci"},
+		{file: "/home/user/.bazelrc", appliesTo: "build", options: "--jobs=8"},
+		{file: "/work/repo/.bazelrc", appliesTo: "build:ci", options: "--noshow_progress"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if !announced {
+		t.Errorf("expected options to have been announced")
+	}
+
+	if _, announced := parseAnnouncedRcOptions("ERROR: Unrecognized option: --foo\n"); announced {
+		t.Errorf("expected options not to have been announced")
+	}
+}
+
+func TestEffectiveBazelrcOptionsLeavesOutTrackedFiles(t *testing.T) {
+	workspace := t.TempDir()
+	for _, file := range []string{".bazelrc", "user.bazelrc"} {
+		if err := os.WriteFile(filepath.Join(workspace, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", ".bazelrc"}} {
+		if _, err := runToLines(workspace, "git", args...); err != nil {
+			t.Fatalf("git %v failed: %v", args, err)
+		}
+	}
+	stderr := fmt.Sprintf(`INFO: Reading rc options for 'cquery' from %[1]s/.bazelrc:
+  Inherited 'build' options: --config=ci --disk_cache=%[1]s/.cache
+INFO: Reading rc options for 'cquery' from %[1]s/user.bazelrc:
+  Inherited 'build' options: --disk_cache=%[1]s/.user_cache
+INFO: Reading rc options for 'cquery' from /home/user/.bazelrc:
+  Inherited 'build' options: --jobs=8
+INFO: Found applicable config definition build:ci in file %[1]s/.bazelrc: --noshow_progress
+`, workspace)
+
+	got, err := EffectiveBazelrcOptions(workspace, announceRcBazelCmd{fakeBazelCmd: fakeBazelCmd{release: "release 7.0.0"}, stderr: stderr})
+	if err != nil {
+		t.Fatalf("EffectiveBazelrcOptions failed: %v", err)
+	}
+	// The tracked .bazelrc is part of each revision, so only the untracked files are included.
+	want := []string{"build: --disk_cache=%workspace%/.user_cache", "build: --jobs=8"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+// announceRcBazelCmd is a fakeBazelCmd which prints announced rc options when running cquery.
+type announceRcBazelCmd struct {
+	fakeBazelCmd
+	stderr string
+}
+
+func (f announceRcBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	if command == "cquery" {
+		fmt.Fprint(config.Stderr, f.stderr)
+		return 0, nil
+	}
+	return f.fakeBazelCmd.Execute(config, startupArgs, command, args...)
+}
+
+func TestComputeCacheKeyIncludesBazelrc(t *testing.T) {
+	key := func(includeBazelrc bool, stderr string) string {
+		ctx := &Context{
+			WorkspacePath:          t.TempDir(),
+			BazelCmd:               announceRcBazelCmd{fakeBazelCmd: fakeBazelCmd{release: "release 7.0.0"}, stderr: stderr},
+			CacheKeyIncludeBazelrc: includeBazelrc,
+		}
+		cacheKey, err := ComputeCacheKey(ctx, "deadcafe", "//...")
+		if err != nil {
+			t.Fatalf("ComputeCacheKey failed: %v", err)
+		}
+		return cacheKey
+	}
+
+	changedRcStderr := "INFO: Reading rc options for 'cquery' from /home/user/.bazelrc:\n  Inherited 'build' options: --jobs=16\n"
+	if key(false, announcedRcStderr) != key(false, changedRcStderr) {
+		t.Errorf("expected bazelrc options not to affect the cache key by default")
+	}
+	if key(true, announcedRcStderr) == key(true, changedRcStderr) {
+		t.Errorf("expected bazelrc options to affect the cache key when included")
+	}
+}
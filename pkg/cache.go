@@ -4,15 +4,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"sort"
-
-	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
-	"github.com/bazelbuild/bazel-gazelle/label"
 )
 
 var configuredTargetCacheDirname = "results"
@@ -23,18 +20,20 @@ var configuredTargetCacheDirname = "results"
 //
 //   - User and system .bazelrc files (~/.bazelrc, /etc/bazel.bazelrc, files
 //     imported from those) can affect the build configuration without changing
-//     the git tree. Target-determinator does not read these files; if they
-//     change between invocations, use --nocache_results.
+//     the git tree. They are only included if Context.CacheKeyIncludeBazelrc is
+//     set; otherwise, if they change between invocations, use --nocache_results.
 //
-//   - The current machine's hardware and OS are not included. Cache entries
-//     produced on one machine are not guaranteed to be valid on another (e.g.
-//     different CPU architecture may change platform-constrained target sets).
-//     Do not share the cache directory across machines.
+//   - The current machine's hardware and OS are only included if
+//     Context.CacheKeyHostFingerprint is set (see HostFingerprint). Otherwise,
+//     cache entries produced on one machine are not guaranteed to be valid on
+//     another (e.g. different CPU architecture may change platform-constrained
+//     target sets), so the cache directory shouldn't be shared across machines.
 //
 //   - Environment variables forwarded to Bazel (CC, CXX, JAVA_HOME, BAZELRC,
-//     etc.) are not included. Changing these between invocations can affect
-//     cquery results without invalidating the cache. This is usually the
-//     expected behavior but has implications. See README.md.
+//     etc.) are not included, other than those listed in Context.CacheKeyEnv.
+//     Changing these between invocations can affect cquery results without
+//     invalidating the cache. This is usually the expected behavior but has
+//     implications. See README.md.
 type CacheKey struct {
 	TDBinaryHash  string
 	BazelVersion  string
@@ -44,38 +43,47 @@ type CacheKey struct {
 	// results_cache_key_ignore:"true"), plus the opaque hash returned by BazelCmd.HashKey().
 	// encoding/json marshals map keys alphabetically, ensuring a deterministic serialization.
 	Context map[string]interface{}
-}
-
-// SerializedQueryResults is the structure that gets saved to disk
-type SerializedQueryResults struct {
-	// Serialized protobuf of ConfiguredTargets
-	MatchingTargetsData []byte
-	BazelRelease        string
-	NormalizerMapping   map[string]string
-	// Key: "<label>\x00<config>", value: raw SHA256 bytes.
-	PrecomputedHashes map[string][]byte
+	// HostFingerprint is set if Context.CacheKeyHostFingerprint is set.
+	HostFingerprint *HostFingerprint `json:",omitempty"`
 }
 
 // ComputeCacheKey generates a unique cache key based on the binary hash, git SHA, and CLI options
 func ComputeCacheKey(context *Context, gitSHA string, targetPattern string) (string, error) {
+	cacheKey, _, err := computeCacheKey(context, gitSHA, targetPattern)
+	return cacheKey, err
+}
+
+// computeCacheKey returns the key ComputeCacheKey returns, along with the JSON serialization of the
+// CacheKey it is derived from.
+func computeCacheKey(context *Context, gitSHA string, targetPattern string) (string, []byte, error) {
 	// Get the binary's hash
 	execPath, err := os.Executable()
 	if err != nil {
-		return "", fmt.Errorf("failed to get executable path: %w", err)
+		return "", nil, fmt.Errorf("failed to get executable path: %w", err)
 	}
 
 	binaryHash, err := hashFile(execPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash binary: %w", err)
+		return "", nil, fmt.Errorf("failed to hash binary: %w", err)
 	}
 
 	bazelRelease, err := BazelRelease(context.WorkspacePath, context.BazelCmd)
 	if err != nil {
-		return "", fmt.Errorf("failed to get bazel release for cache key: %w", err)
+		return "", nil, fmt.Errorf("failed to get bazel release for cache key: %w", err)
 	}
 
 	// Collect all cache-affecting context fields.
 	contextKey := collectCacheContextFields(context)
+	if context.CacheKeyIncludeBazelrc {
+		effectiveBazelrcOptions, err := EffectiveBazelrcOptions(context.WorkspacePath, context.BazelCmd)
+		if err != nil {
+			return "", nil, err
+		}
+		contextKey["EffectiveBazelrcOptions"] = effectiveBazelrcOptions
+	}
+	if len(context.CacheKeyEnv) > 0 {
+		contextKey["CacheKeyEnvValues"] = cacheKeyEnvValues(context.CacheKeyEnv)
+	}
 
 	key := CacheKey{
 		TDBinaryHash:  binaryHash,
@@ -84,17 +92,24 @@ func ComputeCacheKey(context *Context, gitSHA string, targetPattern string) (str
 		TargetPattern: targetPattern,
 		Context:       contextKey,
 	}
+	if context.CacheKeyHostFingerprint {
+		hostFingerprint, err := ComputeHostFingerprint(context.WorkspacePath, context.BazelCmd)
+		if err != nil {
+			return "", nil, err
+		}
+		key.HostFingerprint = &hostFingerprint
+	}
 
 	// Serialize to JSON for consistent hashing
 	keyJSON, err := json.Marshal(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal cache key: %w", err)
+		return "", nil, fmt.Errorf("failed to marshal cache key: %w", err)
 	}
 
 	// Hash the key
 	hasher := sha256.New()
 	hasher.Write(keyJSON)
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+	return hex.EncodeToString(hasher.Sum(nil)), keyJSON, nil
 }
 
 // collectCacheContextFields returns a map of the Context fields that affect the cache key
@@ -111,7 +126,31 @@ func collectCacheContextFields(ctx *Context) map[string]interface{} {
 		"BazelCmd":                  ctx.BazelCmd.HashKey(),
 		"IgnoredFiles":              ignoredFiles,
 		"FilterIncompatibleTargets": ctx.FilterIncompatibleTargets,
+		"HashExclusionPolicy":       ctx.HashExclusionPolicy.HashKey(),
+		"ExternalRepoHashStrategy":  ctx.ExternalRepoHashStrategy,
+		"DetectToolchainChanges":    ctx.DetectToolchainChanges,
+		"BreakDependencyCycles":     ctx.BreakDependencyCycles,
+		"CacheKeyIncludeBazelrc":    ctx.CacheKeyIncludeBazelrc,
+		"CacheKeyEnv":               ctx.CacheKeyEnv,
+		"CacheKeyHostFingerprint":   ctx.CacheKeyHostFingerprint,
+	}
+}
+
+// cacheKeyEnvValues returns the SHA-256 of the value of each of the named environment variables, or
+// nil for those which aren't set, so that unset and empty variables are distinguished. Values are
+// hashed as the CacheKey is recorded in cache entries, and they may be secrets.
+func cacheKeyEnvValues(names []string) map[string]*string {
+	values := make(map[string]*string, len(names))
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			sum := sha256.Sum256([]byte(value))
+			digest := hex.EncodeToString(sum[:])
+			values[name] = &digest
+		} else {
+			values[name] = nil
+		}
 	}
+	return values
 }
 
 // hashFile computes SHA256 hash of a file
@@ -132,187 +171,106 @@ func hashFile(path string) (string, error) {
 
 // LoadFromCache attempts to load QueryResults from cache.
 // The treeSHA argument should represent the hash of a Git Tree object (which doesn't change if only the commit
-// metadata, such as the git commit message, changes).
+// metadata, such as the git commit message, changes), combined with a WorkingCopyDigest for unclean working
+// copies (see dirtyStateCacheKey).
 // Returns (results, error). If error is non-nil, the cache was not hit.
 func LoadFromCache(context *Context, treeSHA string, targetPattern string) (*QueryResults, error) {
-	if context.CacheDirectory == "" {
-		return nil, fmt.Errorf("cache directory not configured")
+	return loadFromCache(context, treeSHA, targetPattern, context.IncludeDifferences)
+}
+
+// loadFromCache loads QueryResults from cache, including the full target graph needed to explain
+// differences if withExplanations is set.
+func loadFromCache(context *Context, treeSHA string, targetPattern string, withExplanations bool) (*QueryResults, error) {
+	cache := newResultsCache(context)
+	if cache == nil {
+		return nil, fmt.Errorf("cache not configured")
 	}
 
 	cacheKey, err := ComputeCacheKey(context, treeSHA, targetPattern)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compute cache key: %w", err)
 	}
+	if withExplanations {
+		cacheKey = explanationsCacheKey(cacheKey)
+	}
 
-	cacheItemPath := filepath.Join(context.CacheDirectory, configuredTargetCacheDirname, cacheKey)
-
-	log.Printf("Attempting to load from cache: %s", cacheItemPath)
+	log.Printf("Attempting to load %s from cache: %s", cacheKey, cache)
 
-	data, err := os.ReadFile(cacheItemPath)
+	data, err := cache.Get(cacheKey)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("cache miss")
-		}
-		return nil, fmt.Errorf("failed to read cache file: %w", err)
+		return nil, err
 	}
 
-	var serialized SerializedQueryResults
-	if err := json.Unmarshal(data, &serialized); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal cache data: %w", err)
+	queryResults, err := decodeCacheEntry(data)
+	if err == nil && withExplanations && queryResults.TransitiveConfiguredTargets == nil {
+		err = fmt.Errorf("entry doesn't include explanations")
 	}
-
-	// Deserialize matching targets
-	matchingTargets, err := deserializeMatchingTargets(serialized.MatchingTargetsData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize matching targets: %w", err)
+	if errors.Is(err, errIncompatibleCacheEntry) {
+		// The entry may be valid for the version which wrote it, which may share the cache.
+		return nil, fmt.Errorf("cache entry %s can't be read by this version: %w", cacheKey, err)
 	}
-
-	normalizer := Normalizer{Mapping: serialized.NormalizerMapping}
-
-	// TransitiveConfiguredTargets is not stored in cache to save space. Pre-computed hashes mean context
-	// is never accessed on a cache hit; nil is safe here.
-	queryResults := &QueryResults{
-		MatchingTargets:             matchingTargets,
-		TransitiveConfiguredTargets: nil,
-		TargetHashCache:             NewTargetHashCache(nil, &normalizer, serialized.BazelRelease),
-		BazelRelease:                serialized.BazelRelease,
+	if err != nil {
+		// Set the entry aside, rather than failing to decode it on every run until it's replaced.
+		if quarantineErr := cache.Quarantine(cacheKey); quarantineErr != nil {
+			log.Printf("WARNING: Failed to quarantine corrupt cache entry %s: %v", cacheKey, quarantineErr)
+		} else {
+			log.Printf("WARNING: Quarantined corrupt cache entry %s", cacheKey)
+		}
+		return nil, fmt.Errorf("corrupt cache entry %s: %w", cacheKey, err)
 	}
-
-	if err := queryResults.TargetHashCache.RestoreHashes(serialized.PrecomputedHashes); err != nil {
-		return nil, fmt.Errorf("failed to restore hashes from cache: %w", err)
+	if withExplanations {
+		// The policy is part of the cache key, so is the one the cached hashes were computed with.
+		queryResults.TargetHashCache.UseHashExclusionPolicy(context.HashExclusionPolicy)
 	}
 
 	log.Printf("Cache hit! Loaded results from cache")
 	return queryResults, nil
 }
 
-// SaveToCache saves QueryResults to cache
+// SaveToCache saves QueryResults to cache.
+// If context.CacheExplanations is set and queryResults has TransitiveConfiguredTargets, a second entry
+// including explanations is also saved, which LoadFromCache uses if context.IncludeDifferences is set.
 func SaveToCache(context *Context, gitSHA string, targetPattern string, queryResults *QueryResults) error {
-	if context.CacheDirectory == "" {
+	cache := newResultsCache(context)
+	if cache == nil {
 		return nil // Caching disabled
 	}
 
-	cacheKey, err := ComputeCacheKey(context, gitSHA, targetPattern)
+	cacheKey, cacheKeyJSON, err := computeCacheKey(context, gitSHA, targetPattern)
 	if err != nil {
 		return fmt.Errorf("failed to compute cache key: %w", err)
 	}
 
-	// Create cache directory if it doesn't exist
-	if err := os.MkdirAll(context.CacheDirectory, 0755); err != nil {
-		return fmt.Errorf("failed to create cache directory: %w", err)
-	}
-
-	// Serialize matching targets
-	matchingTargetsData, err := serializeMatchingTargets(queryResults.MatchingTargets)
-	if err != nil {
-		return fmt.Errorf("failed to serialize matching targets: %w", err)
-	}
-
-	serialized := SerializedQueryResults{
-		MatchingTargetsData: matchingTargetsData,
-		BazelRelease:        queryResults.BazelRelease,
-		NormalizerMapping:   queryResults.TargetHashCache.normalizer.Mapping,
-		PrecomputedHashes:   queryResults.TargetHashCache.ExtractHashes(),
-	}
-
-	data, err := json.Marshal(serialized)
+	data, err := encodeCacheEntry(queryResults, cacheKeyJSON, false)
 	if err != nil {
-		return fmt.Errorf("failed to marshal cache data: %w", err)
+		return err
 	}
 
-	cacheItemDir := filepath.Join(context.CacheDirectory, configuredTargetCacheDirname)
-	cacheItemPath := filepath.Join(cacheItemDir, cacheKey)
-	if err := os.MkdirAll(cacheItemDir, 0755); err != nil {
-		return fmt.Errorf("failed to create cache dir (%s): %w", cacheItemDir, err)
+	if err := cache.Put(cacheKey, data); err != nil {
+		return err
 	}
+	log.Printf("Saved results to cache: %s in %s", cacheKey, cache)
 
-	tmpFile, err := os.CreateTemp(cacheItemDir, cacheKey+".tmp.*")
-	if err != nil {
-		return fmt.Errorf("failed to create temp cache file: %w", err)
-	}
-	tmpPath := tmpFile.Name()
-	defer func() {
-		if tmpPath != "" {
-			os.Remove(tmpPath)
-		}
-	}()
-	if _, err := tmpFile.Write(data); err != nil {
-		tmpFile.Close()
-		return fmt.Errorf("failed to write temp cache file: %w", err)
-	}
-	if err := tmpFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temp cache file: %w", err)
-	}
-	if err := os.Rename(tmpPath, cacheItemPath); err != nil {
-		return fmt.Errorf("failed to move temp cache file to final location: %w", err)
-	}
-	tmpPath = ""
-
-	log.Printf("Saved results to cache: %s", cacheItemPath)
-	return nil
-}
-
-// Helper types for serialization
-type serializedMatchingTargets struct {
-	Labels                 []string
-	LabelsToConfigurations map[string][]string
-}
-
-func serializeMatchingTargets(mt *MatchingTargets) ([]byte, error) {
-	labels := make([]string, 0)
-	for _, l := range mt.Labels() {
-		labels = append(labels, l.String())
-	}
-
-	labelsToConfigurations := make(map[string][]string)
-	for _, l := range mt.Labels() {
-		configs := make([]string, 0)
-		for _, c := range mt.ConfigurationsFor(l) {
-			configs = append(configs, c.String())
-		}
-		labelsToConfigurations[l.String()] = configs
-	}
-
-	serialized := serializedMatchingTargets{
-		Labels:                 labels,
-		LabelsToConfigurations: labelsToConfigurations,
-	}
-
-	return json.Marshal(serialized)
-}
-
-func deserializeMatchingTargets(data []byte) (*MatchingTargets, error) {
-	var serialized serializedMatchingTargets
-	if err := json.Unmarshal(data, &serialized); err != nil {
-		return nil, err
-	}
-
-	labels := make([]label.Label, 0)
-	labelsToConfigurations := make(map[label.Label][]Configuration)
-
-	for _, labelStr := range serialized.Labels {
-		l, err := label.Parse(labelStr)
+	if context.CacheExplanations && queryResults.TransitiveConfiguredTargets != nil {
+		explanationsData, err := encodeCacheEntry(queryResults, cacheKeyJSON, true)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse label %s: %w", labelStr, err)
+			return err
 		}
-		labels = append(labels, l)
-
-		configs := make([]Configuration, 0)
-		for _, configStr := range serialized.LabelsToConfigurations[labelStr] {
-			configs = append(configs, NormalizeConfiguration(configStr))
+		explanationsKey := explanationsCacheKey(cacheKey)
+		if err := cache.Put(explanationsKey, explanationsData); err != nil {
+			return err
 		}
-		labelsToConfigurations[l] = configs
+		log.Printf("Saved results including explanations to cache: %s in %s", explanationsKey, cache)
 	}
 
-	// Convert to SortedSet format using the actual sorted_set package
-	labelsSet := ss.NewSortedSetFn(labels, CompareLabels)
-	labelsToConfigurationsMap := make(map[label.Label]*ss.SortedSet[Configuration])
-	for l, configs := range labelsToConfigurations {
-		labelsToConfigurationsMap[l] = ss.NewSortedSetFn(configs, ConfigurationLess)
-	}
+	collectCacheGarbage(context)
+	return nil
+}
 
-	return &MatchingTargets{
-		labels:                 labelsSet,
-		labelsToConfigurations: labelsToConfigurationsMap,
-	}, nil
+// explanationsCacheKey returns the key of the cache entry including explanations for the results
+// cached under cacheKey. It is derived by hashing, so that it is valid wherever cacheKey is (e.g. as
+// a remote cache's action cache key).
+func explanationsCacheKey(cacheKey string) string {
+	sum := sha256.Sum256([]byte(cacheKey + "\x00explanations"))
+	return hex.EncodeToString(sum[:])
 }
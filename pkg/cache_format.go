@@ -0,0 +1,442 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
+	"github.com/bazel-contrib/target-determinator/pkg/cachepb"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// Cache entries are written as cacheEntryMagic, followed by a single byte format version, followed
+// by the SHA-256 checksum of the rest of the entry, followed by the varint length of a
+// cachepb.CacheEntryHeader, the header itself, and a zstd-compressed cachepb.CacheEntry.
+// The magic starts with a NUL byte, so can't be confused with entries written as JSON by older
+// versions.
+const (
+	cacheEntryMagic         = "\x00TDCACHE"
+	cacheEntryFormatVersion = 1
+)
+
+// errIncompatibleCacheEntry is returned for entries written by other versions of
+// target-determinator in a format this version can't read. Unlike corrupt entries, they may be
+// valid for the version which wrote them.
+var errIncompatibleCacheEntry = errors.New("incompatible cache entry")
+
+// maxCacheEntryHeaderSize bounds the size of the header readCacheEntryHeader reads, so that a
+// corrupt length doesn't make it allocate arbitrary amounts of memory.
+const maxCacheEntryHeaderSize = 16 << 20
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// encodeCacheEntry serializes the parts of queryResults needed to find affected targets: the
+// matching targets and their hashes. The hashes of other targets aren't stored.
+// cacheKeyJSON is the serialized CacheKey which the entry's key is derived from, which is recorded
+// for inspection (see DirectoryResultsCache.List).
+// If includeExplanations is set, everything needed to explain why targets are affected (see
+// WalkDiffs) is also stored, which requires queryResults to have TransitiveConfiguredTargets.
+func encodeCacheEntry(queryResults *QueryResults, cacheKeyJSON []byte, includeExplanations bool) ([]byte, error) {
+	entry := &cachepb.CacheEntry{
+		BazelRelease:      queryResults.BazelRelease,
+		NormalizerMapping: queryResults.TargetHashCache.normalizer.Mapping,
+	}
+	configurationIndices := make(map[Configuration]uint32)
+	configurationIndex := func(configuration Configuration) uint32 {
+		index, ok := configurationIndices[configuration]
+		if !ok {
+			index = uint32(len(entry.Configurations))
+			configurationIndices[configuration] = index
+			entry.Configurations = append(entry.Configurations, configuration.String())
+		}
+		return index
+	}
+	for _, l := range queryResults.MatchingTargets.Labels() {
+		matchingTarget := &cachepb.MatchingTarget{Label: l.String()}
+		for _, configuration := range queryResults.MatchingTargets.ConfigurationsFor(l) {
+			matchingTarget.ConfiguredHashes = append(matchingTarget.ConfiguredHashes, &cachepb.ConfiguredHash{
+				ConfigurationIndex: configurationIndex(configuration),
+				Hash:               queryResults.TargetHashCache.cachedHash(LabelAndConfiguration{Label: l, Configuration: configuration}),
+			})
+		}
+		entry.MatchingTargets = append(entry.MatchingTargets, matchingTarget)
+	}
+	if includeExplanations {
+		explanations, err := encodeExplanations(queryResults, configurationIndex)
+		if err != nil {
+			return nil, err
+		}
+		entry.Explanations = explanations
+	}
+
+	header := &cachepb.CacheEntryHeader{
+		CacheKey:           cacheKeyJSON,
+		CreatedUnixSeconds: time.Now().Unix(),
+		BazelRelease:       entry.BazelRelease,
+		MatchingTargets:    int32(len(entry.MatchingTargets)),
+	}
+	for _, matchingTarget := range entry.MatchingTargets {
+		header.ConfiguredMatchingTargets += int32(len(matchingTarget.ConfiguredHashes))
+	}
+	if entry.Explanations != nil {
+		header.HasExplanations = true
+		header.ConfiguredTargets = int32(len(entry.Explanations.ConfiguredTargets))
+	}
+
+	serializedHeader, err := proto.MarshalOptions{Deterministic: true}.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cache entry header: %w", err)
+	}
+	serialized, err := proto.MarshalOptions{Deterministic: true}.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cache entry: %w", err)
+	}
+	body := binary.AppendUvarint(nil, uint64(len(serializedHeader)))
+	body = append(body, serializedHeader...)
+	body = zstdEncoder.EncodeAll(serialized, body)
+	checksum := sha256.Sum256(body)
+	data := make([]byte, 0, len(cacheEntryMagic)+1+len(checksum)+len(body))
+	data = append(data, cacheEntryMagic...)
+	data = append(data, cacheEntryFormatVersion)
+	data = append(data, checksum[:]...)
+	return append(data, body...), nil
+}
+
+// decodeCacheEntry deserializes QueryResults written by encodeCacheEntry.
+// TransitiveConfiguredTargets is only stored in entries which include explanations. Otherwise,
+// pre-computed hashes mean it is never accessed on a cache hit, so it is nil.
+func decodeCacheEntry(data []byte) (*QueryResults, error) {
+	entry, _, err := unmarshalCacheEntry(data)
+	if err != nil {
+		return nil, err
+	}
+	return queryResultsOf(entry)
+}
+
+// queryResultsOf returns the QueryResults stored in entry.
+func queryResultsOf(entry *cachepb.CacheEntry) (*QueryResults, error) {
+	normalizer := Normalizer{Mapping: entry.NormalizerMapping}
+	targetHashCache := NewTargetHashCache(nil, &normalizer, entry.BazelRelease)
+
+	labels := make([]label.Label, 0, len(entry.MatchingTargets))
+	labelsToConfigurations := make(map[label.Label]*ss.SortedSet[Configuration], len(entry.MatchingTargets))
+	hashes := make(map[string][]byte)
+	for _, matchingTarget := range entry.MatchingTargets {
+		l, err := label.Parse(matchingTarget.Label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", matchingTarget.Label, err)
+		}
+		labels = append(labels, l)
+		configurations := make([]Configuration, 0, len(matchingTarget.ConfiguredHashes))
+		for _, configuredHash := range matchingTarget.ConfiguredHashes {
+			if int(configuredHash.ConfigurationIndex) >= len(entry.Configurations) {
+				return nil, fmt.Errorf("invalid configuration index %d for %s", configuredHash.ConfigurationIndex, matchingTarget.Label)
+			}
+			configuration := entry.Configurations[configuredHash.ConfigurationIndex]
+			configurations = append(configurations, NormalizeConfiguration(configuration))
+			if len(configuredHash.Hash) > 0 {
+				hashes[matchingTarget.Label+"\x00"+configuration] = configuredHash.Hash
+			}
+		}
+		labelsToConfigurations[l] = ss.NewSortedSetFn(configurations, ConfigurationLess)
+	}
+
+	queryResults := &QueryResults{
+		MatchingTargets: &MatchingTargets{
+			labels:                 ss.NewSortedSetFn(labels, CompareLabels),
+			labelsToConfigurations: labelsToConfigurations,
+		},
+		TargetHashCache: targetHashCache,
+		BazelRelease:    entry.BazelRelease,
+	}
+	if entry.Explanations != nil {
+		if err := decodeExplanations(entry, queryResults, hashes); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := queryResults.TargetHashCache.RestoreHashes(hashes); err != nil {
+		return nil, fmt.Errorf("failed to restore hashes from cache: %w", err)
+	}
+	return queryResults, nil
+}
+
+// checkCacheEntryFormat returns an error if prefix, the start of an entry, isn't that of an entry in
+// the format encodeCacheEntry writes.
+func checkCacheEntryFormat(prefix []byte) error {
+	if !bytes.HasPrefix(prefix, []byte(cacheEntryMagic)) {
+		if bytes.HasPrefix(prefix, []byte("{")) {
+			return fmt.Errorf("%w: it was written as JSON by an older version", errIncompatibleCacheEntry)
+		}
+		return fmt.Errorf("not a cache entry")
+	}
+	if len(prefix) == len(cacheEntryMagic) {
+		return fmt.Errorf("cache entry is truncated")
+	}
+	if version := prefix[len(cacheEntryMagic)]; version != cacheEntryFormatVersion {
+		return fmt.Errorf("%w: it was written in format version %d, rather than %d", errIncompatibleCacheEntry, version, cacheEntryFormatVersion)
+	}
+	return nil
+}
+
+// unmarshalCacheEntry verifies, decompresses and unmarshals the cachepb.CacheEntry and
+// cachepb.CacheEntryHeader written by encodeCacheEntry.
+func unmarshalCacheEntry(data []byte) (*cachepb.CacheEntry, *cachepb.CacheEntryHeader, error) {
+	if err := checkCacheEntryFormat(data[:min(len(data), len(cacheEntryMagic)+1)]); err != nil {
+		return nil, nil, err
+	}
+	checksummed := data[len(cacheEntryMagic)+1:]
+	if len(checksummed) < sha256.Size {
+		return nil, nil, fmt.Errorf("cache entry is truncated")
+	}
+	checksum, body := checksummed[:sha256.Size], checksummed[sha256.Size:]
+	if actual := sha256.Sum256(body); !bytes.Equal(checksum, actual[:]) {
+		return nil, nil, fmt.Errorf("cache entry checksum mismatch: want %x, got %x", checksum, actual)
+	}
+	headerSize, n := binary.Uvarint(body)
+	if n <= 0 || headerSize > uint64(len(body)-n) {
+		return nil, nil, fmt.Errorf("cache entry header is truncated")
+	}
+	var header cachepb.CacheEntryHeader
+	if err := proto.Unmarshal(body[n:n+int(headerSize)], &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal cache entry header: %w", err)
+	}
+	serialized, err := zstdDecoder.DecodeAll(body[n+int(headerSize):], nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decompress cache entry: %w", err)
+	}
+	var entry cachepb.CacheEntry
+	if err := proto.Unmarshal(serialized, &entry); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal cache entry: %w", err)
+	}
+	return &entry, &header, nil
+}
+
+// readCacheEntryHeader reads the header of a cache entry from r, without reading the rest of the
+// entry (so without verifying its checksum).
+func readCacheEntryHeader(r *bufio.Reader) (*cachepb.CacheEntryHeader, error) {
+	prefix, err := r.Peek(len(cacheEntryMagic) + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := checkCacheEntryFormat(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := r.Discard(len(prefix) + sha256.Size); err != nil {
+		return nil, fmt.Errorf("cache entry is truncated")
+	}
+	headerSize, err := binary.ReadUvarint(r)
+	if err != nil || headerSize > maxCacheEntryHeaderSize {
+		return nil, fmt.Errorf("cache entry header is truncated or corrupt")
+	}
+	serializedHeader := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, serializedHeader); err != nil {
+		return nil, fmt.Errorf("cache entry header is truncated")
+	}
+	var header cachepb.CacheEntryHeader
+	if err := proto.Unmarshal(serializedHeader, &header); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cache entry header: %w", err)
+	}
+	return &header, nil
+}
+
+// encodeExplanations serializes the configured targets, configurations, and TargetHashCache state
+// of queryResults which WalkDiffs and DiffSingleLabel use, using configurationIndex to refer to
+// configurations.
+func encodeExplanations(queryResults *QueryResults, configurationIndex func(Configuration) uint32) (*cachepb.Explanations, error) {
+	if queryResults.TransitiveConfiguredTargets == nil {
+		return nil, fmt.Errorf("explanations can't be cached without the configured targets")
+	}
+	thc := queryResults.TargetHashCache
+	explanations := &cachepb.Explanations{
+		ConfigurationDetails:            make(map[string][]byte, len(queryResults.configurations)),
+		ExternalReposHashedByDefinition: thc.externalRepoIdentities != nil,
+		ExternalRepoIdentities:          thc.externalRepoIdentities,
+		ToolchainsResolved:              thc.toolchainTypes != nil,
+	}
+	if thc.externalRepoFiles != nil {
+		paths := make([]string, 0, len(thc.externalRepoFiles))
+		for file := range thc.externalRepoFiles {
+			paths = append(paths, file)
+		}
+		sort.Strings(paths)
+		explanations.ExternalRepoFiles = &cachepb.ExternalRepoFiles{Paths: paths}
+	}
+
+	for _, labelString := range sortedStringKeys(queryResults.TransitiveConfiguredTargets) {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		configuredTargets := queryResults.TransitiveConfiguredTargets[l]
+		configurations := make([]Configuration, 0, len(configuredTargets))
+		for configuration := range configuredTargets {
+			configurations = append(configurations, configuration)
+		}
+		sort.Slice(configurations, func(i, j int) bool { return ConfigurationLess(configurations[i], configurations[j]) })
+		for _, configuration := range configurations {
+			serialized, err := proto.MarshalOptions{Deterministic: true}.Marshal(configuredTargets[configuration])
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal configured target %s: %w", labelString, err)
+			}
+			explanations.ConfiguredTargets = append(explanations.ConfiguredTargets, &cachepb.ConfiguredTarget{
+				Label:              labelString,
+				ConfigurationIndex: configurationIndex(configuration),
+				ConfiguredTarget:   serialized,
+				Hash:               thc.cachedHash(LabelAndConfiguration{Label: l, Configuration: configuration}),
+			})
+		}
+	}
+
+	for configuration, details := range queryResults.configurations {
+		serialized, err := json.Marshal(details)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal details of configuration %s: %w", configuration, err)
+		}
+		explanations.ConfigurationDetails[configuration.String()] = serialized
+	}
+
+	for _, toolchainLabel := range sortedStringKeys(thc.toolchainTypes) {
+		l, err := label.Parse(toolchainLabel)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", toolchainLabel, err)
+		}
+		explanations.ToolchainImplementations = append(explanations.ToolchainImplementations, &cachepb.ToolchainImplementation{
+			Label:          toolchainLabel,
+			ToolchainTypes: thc.toolchainTypes[l],
+		})
+	}
+
+	for edge := range thc.brokenDependencies {
+		explanations.BrokenDependencies = append(explanations.BrokenDependencies, &cachepb.DependencyEdge{
+			FromLabel:              edge.from.Label.String(),
+			FromConfigurationIndex: configurationIndex(edge.from.Configuration),
+			ToLabel:                edge.to.Label.String(),
+			ToConfigurationIndex:   configurationIndex(edge.to.Configuration),
+		})
+	}
+	sort.Slice(explanations.BrokenDependencies, func(i, j int) bool {
+		left, right := explanations.BrokenDependencies[i], explanations.BrokenDependencies[j]
+		if left.FromLabel != right.FromLabel {
+			return left.FromLabel < right.FromLabel
+		}
+		if left.FromConfigurationIndex != right.FromConfigurationIndex {
+			return left.FromConfigurationIndex < right.FromConfigurationIndex
+		}
+		if left.ToLabel != right.ToLabel {
+			return left.ToLabel < right.ToLabel
+		}
+		return left.ToConfigurationIndex < right.ToConfigurationIndex
+	})
+	return explanations, nil
+}
+
+// decodeExplanations restores the explanations of entry, written by encodeExplanations, into
+// queryResults, adding the hashes of the configured targets to hashes.
+func decodeExplanations(entry *cachepb.CacheEntry, queryResults *QueryResults, hashes map[string][]byte) error {
+	explanations := entry.Explanations
+	configurationAt := func(index uint32) (Configuration, error) {
+		if int(index) >= len(entry.Configurations) {
+			return Configuration{}, fmt.Errorf("invalid configuration index %d", index)
+		}
+		return NormalizeConfiguration(entry.Configurations[index]), nil
+	}
+	parseLabelAndConfiguration := func(labelString string, configurationIndex uint32) (LabelAndConfiguration, error) {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return LabelAndConfiguration{}, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		configuration, err := configurationAt(configurationIndex)
+		if err != nil {
+			return LabelAndConfiguration{}, fmt.Errorf("%w for %s", err, labelString)
+		}
+		return LabelAndConfiguration{Label: l, Configuration: configuration}, nil
+	}
+
+	transitiveConfiguredTargets := make(map[label.Label]map[Configuration]*analysis.ConfiguredTarget)
+	for _, configuredTarget := range explanations.ConfiguredTargets {
+		labelAndConfiguration, err := parseLabelAndConfiguration(configuredTarget.Label, configuredTarget.ConfigurationIndex)
+		if err != nil {
+			return err
+		}
+		var target analysis.ConfiguredTarget
+		if err := proto.Unmarshal(configuredTarget.ConfiguredTarget, &target); err != nil {
+			return fmt.Errorf("failed to unmarshal configured target %s: %w", configuredTarget.Label, err)
+		}
+		if transitiveConfiguredTargets[labelAndConfiguration.Label] == nil {
+			transitiveConfiguredTargets[labelAndConfiguration.Label] = make(map[Configuration]*analysis.ConfiguredTarget)
+		}
+		transitiveConfiguredTargets[labelAndConfiguration.Label][labelAndConfiguration.Configuration] = &target
+		if len(configuredTarget.Hash) > 0 {
+			hashes[configuredTarget.Label+"\x00"+labelAndConfiguration.Configuration.String()] = configuredTarget.Hash
+		}
+	}
+
+	configurations := make(map[Configuration]singleConfigurationOutput, len(explanations.ConfigurationDetails))
+	for configuration, serialized := range explanations.ConfigurationDetails {
+		var details singleConfigurationOutput
+		if err := json.Unmarshal(serialized, &details); err != nil {
+			return fmt.Errorf("failed to unmarshal details of configuration %s: %w", configuration, err)
+		}
+		configurations[NormalizeConfiguration(configuration)] = details
+	}
+
+	thc := NewTargetHashCache(transitiveConfiguredTargets, queryResults.TargetHashCache.normalizer, entry.BazelRelease)
+	if explanations.ExternalReposHashedByDefinition {
+		identities := explanations.ExternalRepoIdentities
+		if identities == nil {
+			identities = make(map[string][]byte)
+		}
+		thc.UseExternalRepoIdentities(identities)
+	}
+	if explanations.ExternalRepoFiles != nil {
+		thc.externalRepoFiles = make(map[string]struct{}, len(explanations.ExternalRepoFiles.Paths))
+		for _, file := range explanations.ExternalRepoFiles.Paths {
+			thc.externalRepoFiles[file] = struct{}{}
+		}
+	}
+	if explanations.ToolchainsResolved {
+		toolchainTypes := make(map[label.Label][]string, len(explanations.ToolchainImplementations))
+		for _, toolchain := range explanations.ToolchainImplementations {
+			l, err := label.Parse(toolchain.Label)
+			if err != nil {
+				return fmt.Errorf("failed to parse label %s: %w", toolchain.Label, err)
+			}
+			toolchainTypes[l] = toolchain.ToolchainTypes
+		}
+		thc.UseResolvedToolchains(toolchainTypes)
+	}
+	if len(explanations.BrokenDependencies) > 0 {
+		thc.brokenDependencies = make(map[dependencyEdge]struct{}, len(explanations.BrokenDependencies))
+		for _, edge := range explanations.BrokenDependencies {
+			from, err := parseLabelAndConfiguration(edge.FromLabel, edge.FromConfigurationIndex)
+			if err != nil {
+				return err
+			}
+			to, err := parseLabelAndConfiguration(edge.ToLabel, edge.ToConfigurationIndex)
+			if err != nil {
+				return err
+			}
+			thc.brokenDependencies[dependencyEdge{from: from, to: to}] = struct{}{}
+		}
+	}
+
+	queryResults.TransitiveConfiguredTargets = transitiveConfiguredTargets
+	queryResults.TargetHashCache = thc
+	queryResults.configurations = configurations
+	return nil
+}
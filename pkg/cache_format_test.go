@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func TestEncodeDecodeCacheEntry(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	queryResults := hashedHelloWorld(t, cqueryResult)
+	helloWorld := LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:HelloWorld"), Configuration: NormalizeConfiguration(configurationChecksum)}
+	wantHash, err := queryResults.TargetHashCache.Hash(helloWorld)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+
+	data, err := encodeCacheEntry(queryResults, nil, false)
+	if err != nil {
+		t.Fatalf("encodeCacheEntry failed: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte(cacheEntryMagic)) {
+		t.Errorf("expected cache entry to start with the magic header")
+	}
+
+	decoded, err := decodeCacheEntry(data)
+	if err != nil {
+		t.Fatalf("decodeCacheEntry failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.MatchingTargets.Labels(), queryResults.MatchingTargets.Labels()) {
+		t.Errorf("want labels %v, got %v", queryResults.MatchingTargets.Labels(), decoded.MatchingTargets.Labels())
+	}
+	if !decoded.MatchingTargets.ContainsLabelAndConfiguration(helloWorld.Label, helloWorld.Configuration) {
+		t.Errorf("expected decoded matching targets to contain %v", helloWorld)
+	}
+	gotHash, err := decoded.TargetHashCache.Hash(helloWorld)
+	if err != nil {
+		t.Fatalf("Failed to get decoded hash: %v", err)
+	}
+	if !bytes.Equal(gotHash, wantHash) {
+		t.Errorf("want hash %x, got %x", wantHash, gotHash)
+	}
+
+	// Only the hashes of matching targets are stored.
+	if got := len(decoded.TargetHashCache.ExtractHashes()); got != 1 {
+		t.Errorf("expected only the matching target's hash to be stored, got %d hashes", got)
+	}
+}
+
+func TestEncodeDecodeCacheEntryWithExplanations(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	queryResults := hashedHelloWorld(t, cqueryResult)
+	configuration := NormalizeConfiguration(configurationChecksum)
+	queryResults.configurations = map[Configuration]singleConfigurationOutput{
+		configuration: {ConfigHash: configurationChecksum, Fragments: json.RawMessage(`[]`), FragmentOptions: json.RawMessage(`[]`)},
+	}
+	toolchain := mustParseLabel("//toolchains:cc")
+	queryResults.TargetHashCache.UseResolvedToolchains(map[label.Label][]string{toolchain: {"@bazel_tools//tools/cpp:toolchain_type"}})
+
+	data, err := encodeCacheEntry(queryResults, nil, true)
+	if err != nil {
+		t.Fatalf("encodeCacheEntry failed: %v", err)
+	}
+	decoded, err := decodeCacheEntry(data)
+	if err != nil {
+		t.Fatalf("decodeCacheEntry failed: %v", err)
+	}
+
+	if len(decoded.TransitiveConfiguredTargets) != len(queryResults.TransitiveConfiguredTargets) {
+		t.Fatalf("want %d configured targets, got %d", len(queryResults.TransitiveConfiguredTargets), len(decoded.TransitiveConfiguredTargets))
+	}
+	for l, configuredTargets := range queryResults.TransitiveConfiguredTargets {
+		for c, configuredTarget := range configuredTargets {
+			if !proto.Equal(decoded.TransitiveConfiguredTargets[l][c], configuredTarget) {
+				t.Errorf("configured target %v in configuration %v differs after decoding", l, c)
+			}
+		}
+	}
+	// The hashes of all configured targets are stored, so that rule inputs can be compared.
+	if want, got := queryResults.TargetHashCache.ExtractHashes(), decoded.TargetHashCache.ExtractHashes(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %d hashes, got %d", len(want), len(got))
+	}
+	if !reflect.DeepEqual(decoded.configurations, queryResults.configurations) {
+		t.Errorf("want configurations %v, got %v", queryResults.configurations, decoded.configurations)
+	}
+	if got := decoded.TargetHashCache.toolchainTypes[toolchain]; !reflect.DeepEqual(got, []string{"@bazel_tools//tools/cpp:toolchain_type"}) {
+		t.Errorf("expected resolved toolchains to be restored, got %v", got)
+	}
+	if decoded.TargetHashCache.externalRepoIdentities != nil {
+		t.Errorf("expected external repositories to be hashed by contents")
+	}
+
+	helloWorld := LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:HelloWorld"), Configuration: configuration}
+	differences, err := WalkDiffs(decoded.TargetHashCache, queryResults.TargetHashCache, helloWorld)
+	if err != nil || len(differences) != 0 {
+		t.Errorf("expected no differences from the decoded results, got %v (error %v)", differences, err)
+	}
+}
+
+func TestEncodeDecodeExternalRepoFiles(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	queryResults := hashedHelloWorld(t, cqueryResult)
+	queryResults.TargetHashCache.UseExternalRepoIdentities(map[string][]byte{"rules_foo+": {0x01}})
+	queryResults.TargetHashCache.externalRepoFiles = map[string]struct{}{"patches/rules_foo.patch": {}}
+
+	data, err := encodeCacheEntry(queryResults, nil, true)
+	if err != nil {
+		t.Fatalf("encodeCacheEntry failed: %v", err)
+	}
+	decoded, err := decodeCacheEntry(data)
+	if err != nil {
+		t.Fatalf("decodeCacheEntry failed: %v", err)
+	}
+	if want, got := queryResults.TargetHashCache.externalRepoFiles, decoded.TargetHashCache.externalRepoFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("want files referenced by external repository definitions %v, got %v", want, got)
+	}
+}
+
+func TestLoadFromCacheWithExplanations(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	queryResults := hashedHelloWorld(t, cqueryResult)
+	ctx := &Context{
+		CacheDirectory: t.TempDir(),
+		WorkspacePath:  t.TempDir(),
+		BazelCmd:       fakeBazelCmd{release: "release 7.0.0"},
+	}
+
+	if err := SaveToCache(ctx, "deadcafe", "//...", queryResults); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	verboseCtx := *ctx
+	verboseCtx.IncludeDifferences = true
+	if _, err := LoadFromCache(&verboseCtx, "deadcafe", "//..."); err == nil {
+		t.Error("expected a cache miss for explanations which weren't cached")
+	}
+
+	ctx.CacheExplanations = true
+	if err := SaveToCache(ctx, "deadcafe", "//...", queryResults); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	loaded, err := LoadFromCache(&verboseCtx, "deadcafe", "//...")
+	if err != nil {
+		t.Fatalf("LoadFromCache failed: %v", err)
+	}
+	if len(loaded.TransitiveConfiguredTargets) == 0 {
+		t.Error("expected configured targets to be loaded with explanations")
+	}
+
+	// Without -verbose, the smaller entry is loaded.
+	loaded, err = LoadFromCache(ctx, "deadcafe", "//...")
+	if err != nil {
+		t.Fatalf("LoadFromCache failed: %v", err)
+	}
+	if loaded.TransitiveConfiguredTargets != nil {
+		t.Error("expected configured targets not to be loaded without -verbose")
+	}
+}
+
+func TestDecodeIncompatibleCacheEntry(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"newer version": append([]byte(cacheEntryMagic), cacheEntryFormatVersion+1),
+		"JSON":          []byte(`{"BazelRelease": "release 7.0.0"}`),
+	} {
+		if _, err := decodeCacheEntry(data); !errors.Is(err, errIncompatibleCacheEntry) {
+			t.Errorf("%s: expected an incompatible entry, got %v", name, err)
+		}
+	}
+	if _, err := decodeCacheEntry([]byte("garbage")); err == nil || errors.Is(err, errIncompatibleCacheEntry) {
+		t.Errorf("expected an entry which isn't a cache entry to be corrupt, got %v", err)
+	}
+}
+
+func TestDecodeCacheEntryDetectsCorruption(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	data, err := encodeCacheEntry(hashedHelloWorld(t, cqueryResult), nil, false)
+	if err != nil {
+		t.Fatalf("encodeCacheEntry failed: %v", err)
+	}
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)-1] ^= 0xff
+	if _, err := decodeCacheEntry(flipped); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch decoding a corrupted entry, got %v", err)
+	}
+	for _, length := range []int{len(cacheEntryMagic), len(cacheEntryMagic) + 10, len(data) - 1} {
+		if _, err := decodeCacheEntry(data[:length]); err == nil {
+			t.Errorf("expected an error decoding an entry truncated to %d bytes", length)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// staleTempFileAge is how old a temporary file written by DirectoryResultsCache.Put must be before
+// it is assumed to have been left behind by an interrupted process, rather than still being written.
+const staleTempFileAge = time.Hour
+
+// CacheGCStats describes what a garbage collection of a DirectoryResultsCache did.
+type CacheGCStats struct {
+	RemovedEntries            int
+	RemovedTempFiles          int
+	RemovedQuarantinedEntries int
+	RemovedBytes              int64
+	RemainingEntries          int
+	RemainingBytes            int64
+}
+
+func (s CacheGCStats) String() string {
+	return fmt.Sprintf("removed %d entries, %d stale temporary files and %d quarantined entries (%s), %d entries (%s) remain",
+		s.RemovedEntries, s.RemovedTempFiles, s.RemovedQuarantinedEntries, FormatBytes(s.RemovedBytes), s.RemainingEntries, FormatBytes(s.RemainingBytes))
+}
+
+type cacheEntryInfo struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// GarbageCollect removes entries which haven't been accessed within maxAge, and then the least
+// recently accessed entries until the remaining entries total at most maxSize bytes, as well as
+// temporary files left behind by interrupted writes, and entries which were quarantined more than
+// quarantineRetention ago. A maxSize or maxAge which isn't positive is unlimited.
+//
+// Entries record when they were last accessed in their modification time. It is safe to garbage
+// collect while other processes use the cache: entries are written by atomically renaming complete
+// temporary files into place, entries accessed while garbage collection runs are kept, and
+// removing an entry while it's being read only causes a cache miss.
+func (c *DirectoryResultsCache) GarbageCollect(maxSize int64, maxAge time.Duration) (CacheGCStats, error) {
+	var stats CacheGCStats
+	dirEntries, err := os.ReadDir(c.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return stats, fmt.Errorf("failed to list cache dir (%s): %w", c.directory, err)
+	}
+
+	now := time.Now()
+	removedQuarantined, removedQuarantinedBytes := c.removeExpiredQuarantinedEntries(now)
+	stats.RemovedQuarantinedEntries += removedQuarantined
+	stats.RemovedBytes += removedQuarantinedBytes
+
+	var entries []cacheEntryInfo
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by another process.
+				continue
+			}
+			return stats, fmt.Errorf("failed to stat cache file: %w", err)
+		}
+		entry := cacheEntryInfo{path: filepath.Join(c.directory, dirEntry.Name()), size: info.Size(), modTime: info.ModTime()}
+
+		if isTempCacheFile(dirEntry.Name()) {
+			if now.Sub(entry.modTime) > staleTempFileAge && removeIfUnchanged(entry) {
+				stats.RemovedTempFiles++
+				stats.RemovedBytes += entry.size
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	// Least recently accessed first.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.size
+	}
+	for _, entry := range entries {
+		expired := maxAge > 0 && now.Sub(entry.modTime) > maxAge
+		oversized := maxSize > 0 && totalSize > maxSize
+		if (expired || oversized) && removeIfUnchanged(entry) {
+			stats.RemovedEntries++
+			stats.RemovedBytes += entry.size
+			totalSize -= entry.size
+			continue
+		}
+		stats.RemainingEntries++
+		stats.RemainingBytes += entry.size
+	}
+	return stats, nil
+}
+
+// touch records that the entry at path was accessed, so that it is evicted last.
+func touch(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to update access time of cache file %s: %v", path, err)
+	}
+}
+
+func isTempCacheFile(name string) bool {
+	return strings.Contains(name, ".tmp.")
+}
+
+// removeIfUnchanged removes the file described by entry, unless it has been modified (e.g. accessed)
+// since entry was recorded, or was already removed. It returns whether the file was removed.
+func removeIfUnchanged(entry cacheEntryInfo) bool {
+	info, err := os.Stat(entry.path)
+	if err != nil || !info.ModTime().Equal(entry.modTime) {
+		return false
+	}
+	if err := os.Remove(entry.path); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to remove cache file %s: %v", entry.path, err)
+		}
+		return false
+	}
+	return true
+}
+
+// collectCacheGarbage garbage collects the local results cache if context limits its size or age.
+// Failures are logged, as they shouldn't fail the invocation which triggered them.
+func collectCacheGarbage(context *Context) {
+	if context.CacheDirectory == "" || (context.CacheMaxSize <= 0 && context.CacheMaxAge <= 0) {
+		return
+	}
+	stats, err := NewDirectoryResultsCache(context.CacheDirectory).GarbageCollect(context.CacheMaxSize, context.CacheMaxAge)
+	if err != nil {
+		log.Printf("Failed to garbage collect cache: %v", err)
+		return
+	}
+	if stats.RemovedEntries > 0 || stats.RemovedTempFiles > 0 || stats.RemovedQuarantinedEntries > 0 {
+		log.Printf("Garbage collected cache: %s", stats)
+	}
+}
@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCacheEntry writes an entry of size bytes, last accessed age ago.
+func writeCacheEntry(t *testing.T, cache *DirectoryResultsCache, key string, size int, age time.Duration) {
+	if err := cache.Put(key, make([]byte, size)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	setAge(t, filepath.Join(cache.directory, key), age)
+}
+
+func setAge(t *testing.T, path string, age time.Duration) {
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set mtime of %s: %v", path, err)
+	}
+}
+
+func cacheKeys(t *testing.T, cache *DirectoryResultsCache) map[string]bool {
+	dirEntries, err := os.ReadDir(cache.directory)
+	if err != nil {
+		t.Fatalf("Failed to list cache dir: %v", err)
+	}
+	keys := make(map[string]bool)
+	for _, dirEntry := range dirEntries {
+		keys[dirEntry.Name()] = true
+	}
+	return keys
+}
+
+func TestGarbageCollectMaxSize(t *testing.T) {
+	cache := NewDirectoryResultsCache(t.TempDir())
+	writeCacheEntry(t, cache, "oldest", 100, 3*time.Hour)
+	writeCacheEntry(t, cache, "older", 100, 2*time.Hour)
+	writeCacheEntry(t, cache, "newest", 100, time.Hour)
+
+	// Accessing an entry makes it the most recently used.
+	if _, err := cache.Get("oldest"); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+
+	stats, err := cache.GarbageCollect(250, 0)
+	if err != nil {
+		t.Fatalf("GarbageCollect failed: %v", err)
+	}
+	if stats.RemovedEntries != 1 || stats.RemainingEntries != 2 || stats.RemainingBytes != 200 {
+		t.Errorf("unexpected stats: %s", stats)
+	}
+	if got := cacheKeys(t, cache); len(got) != 2 || !got["oldest"] || !got["newest"] {
+		t.Errorf("expected the least recently used entry to be removed, got %v", got)
+	}
+}
+
+func TestGarbageCollectMaxAgeAndTempFiles(t *testing.T) {
+	cache := NewDirectoryResultsCache(t.TempDir())
+	writeCacheEntry(t, cache, "expired", 100, 48*time.Hour)
+	writeCacheEntry(t, cache, "fresh", 100, time.Hour)
+
+	staleTemp := filepath.Join(cache.directory, "interrupted.tmp.123")
+	inProgressTemp := filepath.Join(cache.directory, "writing.tmp.456")
+	for _, path := range []string{staleTemp, inProgressTemp} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setAge(t, staleTemp, 2*staleTempFileAge)
+
+	stats, err := cache.GarbageCollect(0, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("GarbageCollect failed: %v", err)
+	}
+	if stats.RemovedEntries != 1 || stats.RemovedTempFiles != 1 {
+		t.Errorf("unexpected stats: %s", stats)
+	}
+	if got := cacheKeys(t, cache); len(got) != 2 || !got["fresh"] || !got["writing.tmp.456"] {
+		t.Errorf("expected the expired entry and stale temporary file to be removed, got %v", got)
+	}
+}
+
+func TestGarbageCollectMissingDirectory(t *testing.T) {
+	cache := NewDirectoryResultsCache(filepath.Join(t.TempDir(), "missing"))
+	if _, err := cache.GarbageCollect(1, time.Hour); err != nil {
+		t.Errorf("expected garbage collecting a missing cache to succeed, got %v", err)
+	}
+}
+
+func TestGarbageCollectExpiredQuarantinedEntries(t *testing.T) {
+	cache := NewDirectoryResultsCache(t.TempDir())
+	writeCacheEntry(t, cache, "expired", 100, time.Hour)
+	writeCacheEntry(t, cache, "recent", 100, time.Hour)
+	for _, key := range []string{"expired", "recent"} {
+		if err := cache.Quarantine(key); err != nil {
+			t.Fatalf("Quarantine failed: %v", err)
+		}
+	}
+	setAge(t, filepath.Join(cache.quarantineDirectory(), "expired"), 2*quarantineRetention)
+
+	stats, err := cache.GarbageCollect(0, 0)
+	if err != nil {
+		t.Fatalf("GarbageCollect failed: %v", err)
+	}
+	if stats.RemovedQuarantinedEntries != 1 || stats.RemovedBytes != 100 {
+		t.Errorf("unexpected stats: %s", stats)
+	}
+	if _, err := os.Stat(filepath.Join(cache.quarantineDirectory(), "recent")); err != nil {
+		t.Errorf("expected the recently quarantined entry to be kept: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/pkg/cachepb"
+)
+
+// CacheEntrySummary describes an entry of a DirectoryResultsCache.
+type CacheEntrySummary struct {
+	Key  string
+	Size int64
+	// LastUsed is when the entry was last saved or loaded.
+	LastUsed time.Time
+	// Created is when the entry was saved. It is zero if it wasn't recorded.
+	Created time.Time
+	// CacheKey holds the components which Key was derived from. It is nil for entries written by
+	// versions which didn't record them.
+	CacheKey     *CacheKey
+	BazelRelease string
+	// MatchingTargets is the number of targets matching the target pattern, and
+	// ConfiguredMatchingTargets the number of configurations they were matched in.
+	MatchingTargets           int
+	ConfiguredMatchingTargets int
+	// HasExplanations is whether the entry can explain why targets are affected (see
+	// Context.CacheExplanations), in which case ConfiguredTargets is the number of configured targets
+	// whose metadata it stores.
+	HasExplanations   bool
+	ConfiguredTargets int
+	// Err is why the entry couldn't be read, in which case only Key, Size and LastUsed are set.
+	Err error
+}
+
+// List summarizes the entries of the cache, most recently used first.
+// Listing entries doesn't count as using them.
+func (c *DirectoryResultsCache) List() ([]CacheEntrySummary, error) {
+	dirEntries, err := os.ReadDir(c.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list cache dir (%s): %w", c.directory, err)
+	}
+
+	var summaries []CacheEntrySummary
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() || isTempCacheFile(dirEntry.Name()) {
+			continue
+		}
+		summary, err := c.summarize(dirEntry.Name())
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by another process.
+				continue
+			}
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].LastUsed.After(summaries[j].LastUsed)
+	})
+	return summaries, nil
+}
+
+// Describe summarizes the entry with key, which may be abbreviated to a prefix matching a single
+// entry. Describing an entry doesn't count as using it.
+func (c *DirectoryResultsCache) Describe(key string) (CacheEntrySummary, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || isTempCacheFile(key) {
+		return CacheEntrySummary{}, fmt.Errorf("invalid cache key %q", key)
+	}
+	if _, err := os.Stat(filepath.Join(c.directory, key)); os.IsNotExist(err) {
+		dirEntries, err := os.ReadDir(c.directory)
+		if err != nil && !os.IsNotExist(err) {
+			return CacheEntrySummary{}, fmt.Errorf("failed to list cache dir (%s): %w", c.directory, err)
+		}
+		var matches []string
+		for _, dirEntry := range dirEntries {
+			if strings.HasPrefix(dirEntry.Name(), key) && !isTempCacheFile(dirEntry.Name()) {
+				matches = append(matches, dirEntry.Name())
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return CacheEntrySummary{}, fmt.Errorf("no cache entry %s in %s", key, c.directory)
+		case 1:
+			key = matches[0]
+		default:
+			return CacheEntrySummary{}, fmt.Errorf("cache key %s is ambiguous: it matches %s", key, strings.Join(matches, ", "))
+		}
+	}
+	return c.summarize(key)
+}
+
+// summarize reads and summarizes the entry with key. Only errors reading the file are returned;
+// entries whose header can't be read are summarized with Err set.
+// Only the header of the entry is read.
+func (c *DirectoryResultsCache) summarize(key string) (CacheEntrySummary, error) {
+	file, err := os.Open(filepath.Join(c.directory, key))
+	if err != nil {
+		return CacheEntrySummary{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return CacheEntrySummary{}, err
+	}
+	summary := CacheEntrySummary{Key: key, Size: info.Size(), LastUsed: info.ModTime()}
+
+	header, err := readCacheEntryHeader(bufio.NewReader(file))
+	if err != nil {
+		summary.Err = err
+		return summary, nil
+	}
+	summary.Err = summarizeCacheEntryHeader(header, &summary)
+	return summary, nil
+}
+
+// summarizeCacheEntryHeader fills in the fields of summary which are recorded in header.
+func summarizeCacheEntryHeader(header *cachepb.CacheEntryHeader, summary *CacheEntrySummary) error {
+	summary.BazelRelease = header.BazelRelease
+	summary.MatchingTargets = int(header.MatchingTargets)
+	summary.ConfiguredMatchingTargets = int(header.ConfiguredMatchingTargets)
+	summary.HasExplanations = header.HasExplanations
+	summary.ConfiguredTargets = int(header.ConfiguredTargets)
+	if header.CreatedUnixSeconds != 0 {
+		summary.Created = time.Unix(header.CreatedUnixSeconds, 0)
+	}
+	if len(header.CacheKey) > 0 {
+		var cacheKey CacheKey
+		if err := json.Unmarshal(header.CacheKey, &cacheKey); err != nil {
+			return fmt.Errorf("failed to unmarshal recorded cache key: %w", err)
+		}
+		summary.CacheKey = &cacheKey
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestListCacheEntries(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	queryResults := hashedHelloWorld(t, cqueryResult)
+	ctx := &Context{
+		CacheDirectory:    t.TempDir(),
+		WorkspacePath:     t.TempDir(),
+		BazelCmd:          fakeBazelCmd{release: "release 7.0.0"},
+		CacheExplanations: true,
+	}
+	if err := SaveToCache(ctx, "deadcafe", "//...", queryResults); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	cacheKey, err := ComputeCacheKey(ctx, "deadcafe", "//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewDirectoryResultsCache(ctx.CacheDirectory)
+	summaries, err := cache.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("expected an entry with and without explanations, got %d entries", len(summaries))
+	}
+	for _, summary := range summaries {
+		if summary.Err != nil {
+			t.Fatalf("failed to summarize %s: %v", summary.Key, summary.Err)
+		}
+		if summary.HasExplanations != (summary.Key != cacheKey) {
+			t.Errorf("expected only the entry %s to not have explanations, got %+v", cacheKey, summary)
+		}
+		if summary.CacheKey == nil || summary.CacheKey.GitTreeSHA != "deadcafe" || summary.CacheKey.TargetPattern != "//..." || summary.CacheKey.BazelVersion != "release 7.0.0" {
+			t.Errorf("expected the cache key components to be recorded, got %+v", summary.CacheKey)
+		}
+		if summary.MatchingTargets != 1 || summary.ConfiguredMatchingTargets != 1 {
+			t.Errorf("expected a single matching target, got %+v", summary)
+		}
+		if summary.Size == 0 || time.Since(summary.Created) > time.Minute {
+			t.Errorf("expected the size and creation time to be recorded, got %+v", summary)
+		}
+	}
+
+	summary, err := cache.Describe(cacheKey[:8])
+	if err != nil {
+		t.Fatalf("Describe failed: %v", err)
+	}
+	if summary.Key != cacheKey || summary.HasExplanations {
+		t.Errorf("expected the abbreviated key to describe %s, got %+v", cacheKey, summary)
+	}
+	// The recorded components must be the ones the key was derived from.
+	if _, ok := summary.CacheKey.Context["CacheKeyHostFingerprint"]; !ok {
+		t.Errorf("expected context fields to be recorded, got %v", summary.CacheKey.Context)
+	}
+	if _, err := cache.Describe("missing"); err == nil {
+		t.Error("expected an error describing a missing entry")
+	}
+}
+
+func TestListIncompatibleAndCorruptCacheEntries(t *testing.T) {
+	cache := NewDirectoryResultsCache(t.TempDir())
+	if err := cache.Put("legacy", []byte(`{"BazelRelease": "release 5.1.1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put("corrupt", []byte(cacheEntryMagic+"\x01garbage")); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := cache.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	byKey := make(map[string]CacheEntrySummary)
+	for _, summary := range summaries {
+		byKey[summary.Key] = summary
+	}
+	if got := byKey["legacy"]; !errors.Is(got.Err, errIncompatibleCacheEntry) || got.BazelRelease != "" {
+		t.Errorf("expected the entry written by an older version to be listed as incompatible, got %+v", got)
+	}
+	if got := byKey["corrupt"]; got.Err == nil || errors.Is(got.Err, errIncompatibleCacheEntry) {
+		t.Errorf("expected the corrupt entry to be listed with an error, got %+v", got)
+	}
+}
+
+func TestListCacheEntriesOnlyReadsHeaders(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	data, err := encodeCacheEntry(hashedHelloWorld(t, cqueryResult), []byte(`{"GitTreeSHA":"deadcafe"}`), false)
+	if err != nil {
+		t.Fatalf("encodeCacheEntry failed: %v", err)
+	}
+	// Corrupting the compressed payload doesn't affect the summary, as it isn't read.
+	data[len(data)-1] ^= 0xff
+	cache := NewDirectoryResultsCache(t.TempDir())
+	if err := cache.Put("entry", data); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := cache.Describe("entry")
+	if err != nil {
+		t.Fatalf("Describe failed: %v", err)
+	}
+	if summary.Err != nil || summary.CacheKey == nil || summary.CacheKey.GitTreeSHA != "deadcafe" || summary.MatchingTargets != 1 || summary.Created.IsZero() {
+		t.Errorf("expected the entry to be summarized from its header, got %+v", summary)
+	}
+	if _, err := decodeCacheEntry(data); err == nil {
+		t.Error("expected the corrupted payload to be detected when the entry is decoded")
+	}
+}
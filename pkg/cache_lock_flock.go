@@ -0,0 +1,42 @@
+//go:build darwin || linux
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive lock on the file at path, creating it if needed, without waiting
+// for other processes to release it. It returns false if another process holds the lock.
+// The lock is released by calling unlock, or when the process exits.
+func tryLockFile(path string) (unlock func(), ok bool, err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return func() { file.Close() }, true, nil
+}
+
+// lockFile takes an exclusive lock on the file at path, creating it if needed, waiting for other
+// processes to release it. The lock is released by calling unlock, or when the process exits.
+func lockFile(path string) (unlock func(), err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !linux
+
+package pkg
+
+// tryLockFile always succeeds without locking, as file locks aren't supported on this platform.
+func tryLockFile(path string) (unlock func(), ok bool, err error) {
+	return func() {}, true, nil
+}
+
+// lockFile always succeeds without locking, as file locks aren't supported on this platform.
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
 	"sort"
@@ -10,44 +11,6 @@ import (
 	"github.com/bazelbuild/bazel-gazelle/label"
 )
 
-func TestSerializeDeserializeMatchingTargets(t *testing.T) {
-	labels := []label.Label{mustParseLabel("//foo:bar"), mustParseLabel("//baz:qux")}
-	config := NormalizeConfiguration("abc123")
-	mt := &MatchingTargets{
-		labels: ss.NewSortedSetFn(labels, CompareLabels),
-		labelsToConfigurations: map[label.Label]*ss.SortedSet[Configuration]{
-			labels[0]: ss.NewSortedSetFn([]Configuration{config}, ConfigurationLess),
-			labels[1]: ss.NewSortedSetFn([]Configuration{}, ConfigurationLess),
-		},
-	}
-
-	data, err := serializeMatchingTargets(mt)
-	if err != nil {
-		t.Fatalf("serializeMatchingTargets failed: %v", err)
-	}
-
-	got, err := deserializeMatchingTargets(data)
-	if err != nil {
-		t.Fatalf("deserializeMatchingTargets failed: %v", err)
-	}
-
-	if !reflect.DeepEqual(mt.Labels(), got.Labels()) {
-		t.Errorf("labels mismatch: want %v, got %v", mt.Labels(), got.Labels())
-	}
-
-	if !got.ContainsLabelAndConfiguration(labels[0], config) {
-		t.Errorf("expected %v to contain configuration %v", labels[0], config)
-	}
-
-	if got.ContainsLabelAndConfiguration(labels[1], config) {
-		t.Errorf("expected %v to not contain any configuration", labels[1])
-	}
-
-	if len(got.ConfigurationsFor(labels[1])) != 0 {
-		t.Errorf("expected empty configurations for %v, got %v", labels[1], got.ConfigurationsFor(labels[1]))
-	}
-}
-
 // fakeBazelCmd implements BazelCmd and returns a fixed release string for "bazel info release".
 type fakeBazelCmd struct {
 	release string
@@ -120,6 +83,13 @@ func TestSaveToCacheLoadFromCache(t *testing.T) {
 		t.Error("expected cache miss when FilterIncompatibleTargets changes, but got a hit")
 	}
 
+	// Changing the HashExclusionPolicy must produce a different cache key (cache miss).
+	ctxPolicy := *ctx
+	ctxPolicy.HashExclusionPolicy = &HashExclusionPolicy{Attributes: []AttributeExclusion{{Name: "visibility"}}}
+	if _, err := LoadFromCache(&ctxPolicy, "deadcafe", "//..."); err == nil {
+		t.Error("expected cache miss when HashExclusionPolicy changes, but got a hit")
+	}
+
 	// Changing BazelCmd.HashKey() must produce a different cache key (cache miss).
 	ctxDiffCmd := *ctx
 	ctxDiffCmd.BazelCmd = fakeBazelCmd{release: bazelRelease, hashKey: "different-hash"}
@@ -154,7 +124,7 @@ func collectAffectsCacheFields(v interface{}) map[string]interface{} {
 
 // reflectionCacheableValue converts a reflect.Value to a JSON-serializable interface{}.
 // Slices whose element type implements fmt.Stringer are converted to a sorted []string.
-// Interface values implementing HashableKey are converted via HashKey().
+// Interface and pointer values implementing HashableKey are converted via HashKey().
 func reflectionCacheableValue(v reflect.Value) interface{} {
 	switch v.Kind() {
 	case reflect.Slice:
@@ -167,7 +137,7 @@ func reflectionCacheableValue(v reflect.Value) interface{} {
 			sort.Strings(strs)
 			return strs
 		}
-	case reflect.Interface:
+	case reflect.Interface, reflect.Ptr:
 		if hk, ok := v.Interface().(HashableKey); ok {
 			return hk.HashKey()
 		}
@@ -234,4 +204,66 @@ func TestDefaultBazelCmdHashKey(t *testing.T) {
 			t.Error("BazelPath should not affect the hash key")
 		}
 	})
+	t.Run("EnvAllowlist is included if not empty", func(t *testing.T) {
+		if h := (DefaultBazelCmd{EnvAllowlist: []string{}}).HashKey(); h != baseline {
+			t.Error("an empty EnvAllowlist should not affect the hash key")
+		}
+		h1 := DefaultBazelCmd{EnvAllowlist: []string{"PATH", "HOME"}}.HashKey()
+		h2 := DefaultBazelCmd{EnvAllowlist: []string{"HOME", "PATH"}}.HashKey()
+		if h1 == baseline {
+			t.Error("expected different hash when EnvAllowlist changes")
+		}
+		if h1 != h2 {
+			t.Error("expected EnvAllowlist order not to affect the hash key")
+		}
+	})
+}
+
+func TestAllowlistedEnv(t *testing.T) {
+	t.Setenv("TD_TEST_ALLOWED", "yes")
+	t.Setenv("TD_TEST_DENIED", "no")
+	got := allowlistedEnv([]string{"TD_TEST_ALLOWED", "TD_TEST_UNSET"})
+	if !reflect.DeepEqual(got, []string{"TD_TEST_ALLOWED=yes"}) {
+		t.Errorf("want only TD_TEST_ALLOWED, got %v", got)
+	}
+	if got := allowlistedEnv([]string{"TD_TEST_UNSET"}); got == nil {
+		t.Error("expected an empty but non-nil environment, so that nothing is inherited")
+	}
+}
+
+func TestComputeCacheKeyIncludesEnv(t *testing.T) {
+	ctx := &Context{
+		WorkspacePath: t.TempDir(),
+		BazelCmd:      fakeBazelCmd{release: "release 7.0.0"},
+		CacheKeyEnv:   []string{"TD_TEST_STAMP"},
+	}
+	key := func() string {
+		cacheKey, err := ComputeCacheKey(ctx, "deadcafe", "//...")
+		if err != nil {
+			t.Fatalf("ComputeCacheKey failed: %v", err)
+		}
+		return cacheKey
+	}
+
+	unset := key()
+	t.Setenv("TD_TEST_STAMP", "")
+	empty := key()
+	t.Setenv("TD_TEST_STAMP", "1.2.3")
+	set := key()
+	t.Setenv("TD_TEST_OTHER", "ignored")
+	if unset == empty || empty == set || unset == set {
+		t.Errorf("expected each value of TD_TEST_STAMP to produce a different key")
+	}
+	if key() != set {
+		t.Errorf("expected variables not listed in CacheKeyEnv not to affect the key")
+	}
+
+	t.Setenv("TD_TEST_STAMP", "s3cr3t-value")
+	_, keyJSON, err := computeCacheKey(ctx, "deadcafe", "//...")
+	if err != nil {
+		t.Fatalf("computeCacheKey failed: %v", err)
+	}
+	if bytes.Contains(keyJSON, []byte("s3cr3t-value")) {
+		t.Errorf("expected the values of environment variables not to be recorded in the key, got %s", keyJSON)
+	}
 }
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// quarantineDirname is the directory, alongside the results directory, to which corrupt entries of a
+// DirectoryResultsCache are moved, so that they can be inspected.
+const quarantineDirname = "quarantine"
+
+// quarantineRetention is how long quarantined entries are kept before GarbageCollect removes them.
+const quarantineRetention = 7 * 24 * time.Hour
+
+// CacheVerifyStats describes what a verification of a DirectoryResultsCache found.
+type CacheVerifyStats struct {
+	VerifiedEntries int
+	// CorruptEntries maps the keys of corrupt entries to why they couldn't be used.
+	CorruptEntries map[string]error
+	// IncompatibleEntries maps the keys of entries written by versions of target-determinator with a
+	// different entry format to why they couldn't be read. They may be valid for those versions.
+	IncompatibleEntries map[string]error
+}
+
+func (s CacheVerifyStats) String() string {
+	return fmt.Sprintf("verified %d entries, %d were corrupt, %d were incompatible", s.VerifiedEntries, len(s.CorruptEntries), len(s.IncompatibleEntries))
+}
+
+// SortedKeys returns the keys of the corrupt entries, sorted.
+func (s CacheVerifyStats) SortedKeys() []string {
+	return sortedErrorKeys(s.CorruptEntries)
+}
+
+// SortedIncompatibleKeys returns the keys of the incompatible entries, sorted.
+func (s CacheVerifyStats) SortedIncompatibleKeys() []string {
+	return sortedErrorKeys(s.IncompatibleEntries)
+}
+
+func sortedErrorKeys(errs map[string]error) []string {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Quarantine moves the entry for key to the quarantine directory, replacing any entry previously
+// quarantined under the same key.
+func (c *DirectoryResultsCache) Quarantine(key string) error {
+	quarantineDirectory := c.quarantineDirectory()
+	if err := os.MkdirAll(quarantineDirectory, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine dir (%s): %w", quarantineDirectory, err)
+	}
+	quarantinePath := filepath.Join(quarantineDirectory, key)
+	if err := os.Rename(filepath.Join(c.directory, key), quarantinePath); err != nil {
+		if os.IsNotExist(err) {
+			// Already removed or quarantined by another process.
+			return nil
+		}
+		return fmt.Errorf("failed to quarantine cache entry %s: %w", key, err)
+	}
+	// Record when the entry was quarantined, for GarbageCollect.
+	touch(quarantinePath)
+	return nil
+}
+
+func (c *DirectoryResultsCache) quarantineDirectory() string {
+	return filepath.Join(filepath.Dir(c.directory), quarantineDirname)
+}
+
+// Verify checks that every entry of the cache can be decoded, and that entries which record the
+// components of their key are stored under the key derived from them. Corrupt entries are
+// quarantined, or removed if remove is set. Entries written by versions with a different entry format
+// are left in place, as the cache may be shared with them.
+// Verifying entries doesn't count as using them.
+func (c *DirectoryResultsCache) Verify(remove bool) (CacheVerifyStats, error) {
+	stats := CacheVerifyStats{CorruptEntries: make(map[string]error), IncompatibleEntries: make(map[string]error)}
+	dirEntries, err := os.ReadDir(c.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return stats, fmt.Errorf("failed to list cache dir (%s): %w", c.directory, err)
+	}
+
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() || isTempCacheFile(dirEntry.Name()) {
+			continue
+		}
+		key := dirEntry.Name()
+		data, err := os.ReadFile(filepath.Join(c.directory, key))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by another process.
+				continue
+			}
+			return stats, fmt.Errorf("failed to read cache entry %s: %w", key, err)
+		}
+		stats.VerifiedEntries++
+		verifyErr := verifyCacheEntry(key, data)
+		if verifyErr == nil {
+			continue
+		}
+		if errors.Is(verifyErr, errIncompatibleCacheEntry) {
+			stats.IncompatibleEntries[key] = verifyErr
+			continue
+		}
+		stats.CorruptEntries[key] = verifyErr
+		if remove {
+			err = os.Remove(filepath.Join(c.directory, key))
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = c.Quarantine(key)
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// verifyCacheEntry checks that data, stored under key, can be decoded, and was derived from the
+// cache key components it records (if any).
+func verifyCacheEntry(key string, data []byte) error {
+	entry, header, err := unmarshalCacheEntry(data)
+	if err != nil {
+		return err
+	}
+	if _, err := queryResultsOf(entry); err != nil {
+		return err
+	}
+	if len(header.CacheKey) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(header.CacheKey)
+	expectedKey := hex.EncodeToString(sum[:])
+	if entry.Explanations != nil {
+		expectedKey = explanationsCacheKey(expectedKey)
+	}
+	if key != expectedKey {
+		return fmt.Errorf("entry is stored under the wrong key: its recorded cache key components hash to %s", expectedKey)
+	}
+	return nil
+}
+
+// removeExpiredQuarantinedEntries removes entries which were quarantined more than
+// quarantineRetention ago, returning how many were removed and their total size.
+func (c *DirectoryResultsCache) removeExpiredQuarantinedEntries(now time.Time) (int, int64) {
+	dirEntries, err := os.ReadDir(c.quarantineDirectory())
+	if err != nil {
+		return 0, 0
+	}
+	removed, removedBytes := 0, int64(0)
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil || !info.Mode().IsRegular() || now.Sub(info.ModTime()) <= quarantineRetention {
+			continue
+		}
+		entry := cacheEntryInfo{path: filepath.Join(c.quarantineDirectory(), dirEntry.Name()), size: info.Size(), modTime: info.ModTime()}
+		if removeIfUnchanged(entry) {
+			removed++
+			removedBytes += entry.size
+		}
+	}
+	return removed, removedBytes
+}
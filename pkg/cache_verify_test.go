@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyCache(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	ctx := &Context{
+		CacheDirectory: t.TempDir(),
+		WorkspacePath:  t.TempDir(),
+		BazelCmd:       fakeBazelCmd{release: "release 7.0.0"},
+	}
+	if err := SaveToCache(ctx, "deadcafe", "//...", hashedHelloWorld(t, cqueryResult)); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	cacheKey, err := ComputeCacheKey(ctx, "deadcafe", "//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewDirectoryResultsCache(ctx.CacheDirectory)
+	data, err := os.ReadFile(filepath.Join(cache.directory, cacheKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A valid entry under a key it wasn't derived from, and a truncated one.
+	if err := cache.Put("misplaced", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put("truncated", data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	// An entry written by a version with a newer entry format.
+	newer := bytes.Clone(data)
+	newer[len(cacheEntryMagic)]++
+	if err := cache.Put("newer", newer); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := cache.Verify(false)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if stats.VerifiedEntries != 4 || len(stats.CorruptEntries) != 2 || stats.CorruptEntries["misplaced"] == nil || stats.CorruptEntries["truncated"] == nil {
+		t.Errorf("expected the misplaced and truncated entries to be corrupt, got %s: %v", stats, stats.CorruptEntries)
+	}
+	if len(stats.IncompatibleEntries) != 1 || stats.IncompatibleEntries["newer"] == nil {
+		t.Errorf("expected the entry in a newer format to be incompatible, got %v", stats.IncompatibleEntries)
+	}
+	if got := cacheKeys(t, cache); len(got) != 2 || !got[cacheKey] || !got["newer"] {
+		t.Errorf("expected only the valid and incompatible entries to remain, got %v", got)
+	}
+	for _, key := range []string{"misplaced", "truncated"} {
+		if _, err := os.Stat(filepath.Join(cache.quarantineDirectory(), key)); err != nil {
+			t.Errorf("expected %s to be quarantined: %v", key, err)
+		}
+	}
+
+	if err := cache.Put("truncated", data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Verify(true); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if got := cacheKeys(t, cache); len(got) != 2 || !got[cacheKey] || !got["newer"] {
+		t.Errorf("expected only the corrupt entry to be deleted, got %v", got)
+	}
+}
+
+func TestLoadFromCacheQuarantinesCorruptEntries(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	ctx := &Context{
+		CacheDirectory: t.TempDir(),
+		WorkspacePath:  t.TempDir(),
+		BazelCmd:       fakeBazelCmd{release: "release 7.0.0"},
+	}
+	if err := SaveToCache(ctx, "deadcafe", "//...", hashedHelloWorld(t, cqueryResult)); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	cacheKey, err := ComputeCacheKey(ctx, "deadcafe", "//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(NewDirectoryResultsCache(ctx.CacheDirectory).directory, cacheKey)
+	if err := os.Truncate(path, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadFromCache(ctx, "deadcafe", "//..."); err == nil || errors.Is(err, errCacheMiss) {
+		t.Fatalf("expected an error loading a corrupt entry, got %v", err)
+	}
+	// The corrupt entry was set aside, so subsequent loads are plain cache misses.
+	if _, err := LoadFromCache(ctx, "deadcafe", "//..."); !errors.Is(err, errCacheMiss) {
+		t.Errorf("expected a cache miss after quarantining the corrupt entry, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ctx.CacheDirectory, quarantineDirname, cacheKey)); err != nil {
+		t.Errorf("expected the corrupt entry to be quarantined: %v", err)
+	}
+}
+
+func TestLoadFromCacheLeavesIncompatibleEntries(t *testing.T) {
+	ctx := &Context{
+		CacheDirectory: t.TempDir(),
+		WorkspacePath:  t.TempDir(),
+		BazelCmd:       fakeBazelCmd{release: "release 7.0.0"},
+	}
+	cacheKey, err := ComputeCacheKey(ctx, "deadcafe", "//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewDirectoryResultsCache(ctx.CacheDirectory)
+	if err := cache.Put(cacheKey, append([]byte(cacheEntryMagic), cacheEntryFormatVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadFromCache(ctx, "deadcafe", "//..."); !errors.Is(err, errIncompatibleCacheEntry) {
+		t.Fatalf("expected an incompatible entry, got %v", err)
+	}
+	if got := cacheKeys(t, cache); !got[cacheKey] {
+		t.Errorf("expected the incompatible entry not to be quarantined, got %v", got)
+	}
+}
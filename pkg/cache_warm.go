@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// warmWorktree is the suffix of the git worktree in which WarmCache checks out revisions.
+const warmWorktree = "warm"
+
+// warmLockFilename is the file in the cache directory which WarmCache locks, so that overlapping
+// invocations (e.g. on a schedule) don't use the same worktree and output base concurrently.
+const warmLockFilename = "warm.lock"
+
+// ErrCacheWarmingInProgress is returned by WarmCache if another invocation is warming the same
+// cache directory.
+var ErrCacheWarmingInProgress = errors.New("the cache is already being warmed by another process")
+
+// CacheWarmStats describes what WarmCache did.
+type CacheWarmStats struct {
+	// WarmedRevisions is the number of revisions whose results were computed and saved.
+	WarmedRevisions int
+	// AlreadyCachedRevisions is the number of revisions which were skipped because their results
+	// were already cached.
+	AlreadyCachedRevisions int
+	// FailedRevisions maps the revisions whose results couldn't be computed or saved to why.
+	FailedRevisions map[string]error
+}
+
+func (s CacheWarmStats) String() string {
+	return fmt.Sprintf("warmed %d revisions, %d were already cached, %d failed", s.WarmedRevisions, s.AlreadyCachedRevisions, len(s.FailedRevisions))
+}
+
+// SortedFailedRevisions returns the revisions which failed, sorted.
+func (s CacheWarmStats) SortedFailedRevisions() []string {
+	revisions := make([]string, 0, len(s.FailedRevisions))
+	for revision := range s.FailedRevisions {
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+	return revisions
+}
+
+// WarmCache computes the results of targets at each of revs which aren't already cached, and saves
+// them to the results cache, so that later invocations comparing against those revisions hit it.
+//
+// Revisions are checked out in a dedicated git worktree and queried with a dedicated Bazel output
+// base, both of which are reused across invocations, so the workspace is never modified. A failure
+// to process one revision doesn't stop the others from being processed. If another invocation is
+// warming the same cache directory, ErrCacheWarmingInProgress is returned.
+func WarmCache(context *Context, revs []LabelledGitRev, targets TargetsList) (CacheWarmStats, error) {
+	stats := CacheWarmStats{FailedRevisions: make(map[string]error)}
+	if context.CacheDirectory == "" || context.NoCacheResults {
+		return stats, fmt.Errorf("warming the cache requires a cache directory, and results caching to be enabled")
+	}
+
+	if context.CacheKeyHostFingerprint {
+		if _, err := ComputeHostFingerprint(context.WorkspacePath, context.BazelCmd); err != nil {
+			return stats, fmt.Errorf("failed to fingerprint the host for the cache key: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(context.CacheDirectory, 0755); err != nil {
+		return stats, fmt.Errorf("failed to create cache dir (%s): %w", context.CacheDirectory, err)
+	}
+	unlock, ok, err := tryLockFile(filepath.Join(context.CacheDirectory, warmLockFilename))
+	if err != nil {
+		return stats, err
+	}
+	if !ok {
+		return stats, ErrCacheWarmingInProgress
+	}
+	defer unlock()
+
+	warmContext := *context
+	warmContext.dedicatedWorktree = warmWorktree
+	// Its path is stable so that its analysis cache and repositories are reused across invocations.
+	warmContext.BazelOutputBase = context.BazelOutputBase + "_td_warm"
+	// Loading and saving is done here, so that failing to save fails the revision.
+	warmContext.NoCacheResults = true
+	// The full target graph is needed to save explanations.
+	warmContext.IncludeDifferences = context.CacheExplanations
+
+	for _, rev := range revs {
+		treeSHA, err := GitTreeSHA(context, rev.GitRevision.Sha)
+		if err != nil {
+			stats.FailedRevisions[rev.String()] = err
+			continue
+		}
+		if isCached(context, treeSHA, targets.String()) {
+			log.Printf("Skipping %s: its results are already cached", rev)
+			stats.AlreadyCachedRevisions++
+			continue
+		}
+
+		log.Printf("Warming the cache for %s", rev)
+		queryInfo, err := fullyProcessRevision(&warmContext, rev, targets)
+		if err == nil {
+			err = SaveToCache(context, treeSHA, targets.String(), queryInfo)
+		}
+		if err != nil {
+			log.Printf("Failed to warm the cache for %s: %v", rev, err)
+			stats.FailedRevisions[rev.String()] = err
+			continue
+		}
+		stats.WarmedRevisions++
+	}
+	return stats, nil
+}
+
+// isCached returns whether results for treeSHA are cached, including explanations if
+// context.CacheExplanations is set. Entries aren't read, so corrupt entries count as cached (see
+// `cache verify`).
+func isCached(context *Context, treeSHA string, targetPattern string) bool {
+	cache := newResultsCache(context)
+	if cache == nil {
+		return false
+	}
+	cacheKey, err := ComputeCacheKey(context, treeSHA, targetPattern)
+	if err != nil {
+		log.Printf("Failed to compute cache key: %v", err)
+		return false
+	}
+	if context.CacheExplanations {
+		cacheKey = explanationsCacheKey(cacheKey)
+	}
+	has, err := cache.Has(cacheKey)
+	if err != nil {
+		log.Printf("Failed to check the cache for %s: %v", cacheKey, err)
+		return false
+	}
+	return has
+}
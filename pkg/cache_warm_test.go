@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestIsCached(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	ctx := &Context{
+		CacheDirectory: t.TempDir(),
+		WorkspacePath:  t.TempDir(),
+		BazelCmd:       fakeBazelCmd{release: "release 7.0.0"},
+	}
+	explanationsCtx := *ctx
+	explanationsCtx.CacheExplanations = true
+
+	if isCached(ctx, "deadcafe", "//...") {
+		t.Fatal("expected nothing to be cached yet")
+	}
+	if err := SaveToCache(ctx, "deadcafe", "//...", hashedHelloWorld(t, cqueryResult)); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	if !isCached(ctx, "deadcafe", "//...") {
+		t.Error("expected the saved results to be cached")
+	}
+	if isCached(ctx, "deadcafe", "//other/...") {
+		t.Error("expected results for another target pattern not to be cached")
+	}
+	if isCached(&explanationsCtx, "deadcafe", "//...") {
+		t.Error("expected results saved without explanations not to be cached when explanations are needed")
+	}
+
+	if err := SaveToCache(&explanationsCtx, "deadcafe", "//...", hashedHelloWorld(t, cqueryResult)); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	if !isCached(&explanationsCtx, "deadcafe", "//...") {
+		t.Error("expected the saved explanations to be cached")
+	}
+}
+
+func TestIsCachedDoesNotDownloadEntries(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	remote, server := newFakeRemoteCache(t)
+	ctx := &Context{
+		RemoteCacheURL:     server.URL,
+		RemoteCacheTimeout: time.Second,
+		WorkspacePath:      t.TempDir(),
+		BazelCmd:           fakeBazelCmd{release: "release 7.0.0"},
+	}
+	if err := SaveToCache(ctx, "deadcafe", "//...", hashedHelloWorld(t, cqueryResult)); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+	if !isCached(ctx, "deadcafe", "//...") {
+		t.Error("expected the saved results to be cached")
+	}
+	if remote.gets != 0 {
+		t.Errorf("expected checking the remote cache not to download entries, got %d GET requests", remote.gets)
+	}
+}
+
+func TestWarmCacheRequiresCaching(t *testing.T) {
+	for name, ctx := range map[string]*Context{
+		"no cache dir":     {RemoteCacheURL: "http://localhost:1"},
+		"caching disabled": {CacheDirectory: t.TempDir(), NoCacheResults: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := WarmCache(ctx, nil, TargetsList{}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestWarmCacheSkipsWhileAnotherInvocationIsWarming(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("file locks aren't supported on this platform")
+	}
+	ctx := &Context{CacheDirectory: t.TempDir()}
+	unlock, ok, err := tryLockFile(filepath.Join(ctx.CacheDirectory, warmLockFilename))
+	if err != nil || !ok {
+		t.Fatalf("failed to take the lock: %v", err)
+	}
+
+	if _, err := WarmCache(ctx, nil, TargetsList{}); !errors.Is(err, ErrCacheWarmingInProgress) {
+		t.Errorf("expected ErrCacheWarmingInProgress, got %v", err)
+	}
+	unlock()
+	if stats, err := WarmCache(ctx, nil, TargetsList{}); err != nil || stats.WarmedRevisions != 0 || len(stats.FailedRevisions) != 0 {
+		t.Errorf("expected nothing to be warmed once the lock was released, got %s: %v", stats, err)
+	}
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// DeterminismCheckOptions configures how CheckDeterminism computes hashes the second time.
+type DeterminismCheckOptions struct {
+	// RestartBazel shuts down the Bazel server before computing hashes the second time, to detect
+	// instability caused by state held in the server.
+	RestartBazel bool
+	// SecondWorkspacePath, if non-empty, is the path of another checkout of the repository (e.g. a
+	// git worktree) in which hashes are computed the second time, to detect dependencies on the path
+	// of the workspace or its output base.
+	SecondWorkspacePath string
+}
+
+// DeterminismReport describes the targets whose hashes differed between two computations at the
+// same revision.
+type DeterminismReport struct {
+	// UnstableTargets are the matching targets whose hashes differed.
+	UnstableTargets []UnstableTarget
+	// RootCauses are the targets (matching or not) whose hashes differed for some reason other than
+	// the hash of one of their dependencies differing.
+	RootCauses []UnstableTarget
+}
+
+// UnstableTarget is a configured target whose hash differed between two computations.
+type UnstableTarget struct {
+	Label         label.Label
+	Configuration Configuration
+	// Differences explains why the hashes differed.
+	Differences []Difference
+}
+
+// Categories of Difference which only indicate that a dependency's hash differed.
+var propagatedDifferenceCategories = map[string]struct{}{
+	"RuleInputChanged":          {},
+	"ExternalDependencyChanged": {},
+	"ToolchainChanged":          {},
+}
+
+// CheckDeterminism computes the hashes of targets at rev twice, and reports any targets whose
+// hashes differ between the two computations, which indicates that their hashes depend on
+// something other than the contents of the revision.
+//
+// Neither computation reads from or writes to the results cache or the file digest cache.
+func CheckDeterminism(context *Context, rev LabelledGitRev, targets TargetsList, options DeterminismCheckOptions) (*DeterminismReport, error) {
+	firstContext := *context
+	firstContext.IncludeDifferences = true
+	firstContext.NoCacheResults = true
+	firstContext.NoCacheFileDigests = true
+
+	log.Printf("Computing hashes of %s for the first time", rev)
+	first, err := fullyProcessRevision(&firstContext, rev, targets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute hashes the first time: %w", err)
+	}
+
+	secondContext := firstContext
+	if options.SecondWorkspacePath != "" {
+		secondContext.WorkspacePath = options.SecondWorkspacePath
+		currentBranch, err := GitRevParse(options.SecondWorkspacePath, "HEAD", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current git revision of %s: %w", options.SecondWorkspacePath, err)
+		}
+		secondContext.OriginalRevision, err = NewLabelledGitRev(options.SecondWorkspacePath, currentBranch, "original")
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the original git revision of %s: %w", options.SecondWorkspacePath, err)
+		}
+		secondContext.BazelOutputBase, err = BazelOutputBase(options.SecondWorkspacePath, context.BazelCmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the bazel output base of %s: %w", options.SecondWorkspacePath, err)
+		}
+	}
+
+	if options.RestartBazel {
+		log.Println("Shutting down the Bazel server")
+		var stderr bytes.Buffer
+		result, err := secondContext.BazelCmd.Execute(
+			BazelCmdConfig{Dir: secondContext.WorkspacePath, Stderr: &stderr},
+			[]string{"--output_base", secondContext.BazelOutputBase}, "shutdown")
+		if result != 0 || err != nil {
+			return nil, fmt.Errorf("failed to shut down the Bazel server in %v: %w. Stderr:\n%v", secondContext.WorkspacePath, err, stderr.String())
+		}
+	}
+
+	log.Printf("Computing hashes of %s for the second time", rev)
+	second, err := fullyProcessRevision(&secondContext, rev, targets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute hashes the second time: %w", err)
+	}
+
+	return compareForDeterminism(first, second)
+}
+
+func compareForDeterminism(first *QueryResults, second *QueryResults) (*DeterminismReport, error) {
+	report := &DeterminismReport{}
+
+	for _, l := range second.MatchingTargets.Labels() {
+		callback := func(l label.Label, differences []Difference, configuredTarget *analysis.ConfiguredTarget) {
+			report.UnstableTargets = append(report.UnstableTargets, UnstableTarget{
+				Label:         l,
+				Configuration: NormalizeConfiguration(configuredTarget.GetConfiguration().GetChecksum()),
+				Differences:   differences,
+			})
+		}
+		if err := DiffSingleLabel(first, second, true, l, callback); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range first.MatchingTargets.Labels() {
+		if len(second.MatchingTargets.ConfigurationsFor(l)) == 0 {
+			report.UnstableTargets = append(report.UnstableTargets, UnstableTarget{
+				Label:       l,
+				Differences: []Difference{{Category: "DeletedTarget"}},
+			})
+		}
+	}
+
+	// Every target in the transitive closure of the matching targets was hashed, so we can look for
+	// the targets where the instability originates.
+	firstHashes := first.TargetHashCache.ExtractHashes()
+	secondHashes := second.TargetHashCache.ExtractHashes()
+	keys := make([]string, 0, len(secondHashes))
+	for key := range secondHashes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		firstHash, ok := firstHashes[key]
+		if !ok || bytes.Equal(firstHash, secondHashes[key]) {
+			continue
+		}
+		idx := strings.IndexByte(key, '\x00')
+		l, err := second.TargetHashCache.ParseCanonicalLabel(key[:idx])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %q: %w", key[:idx], err)
+		}
+		labelAndConfiguration := LabelAndConfiguration{Label: l, Configuration: NormalizeConfiguration(key[idx+1:])}
+		differences, err := WalkDiffs(first.TargetHashCache, second.TargetHashCache, labelAndConfiguration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to explain differences of %s: %w", l, err)
+		}
+		if len(differences) == 0 && isSourceFile(second, labelAndConfiguration) {
+			differences = append(differences, Difference{Category: "SourceFileChanged"})
+		}
+		if isRootCause(differences) {
+			report.RootCauses = append(report.RootCauses, UnstableTarget{
+				Label:         labelAndConfiguration.Label,
+				Configuration: labelAndConfiguration.Configuration,
+				Differences:   differences,
+			})
+		}
+	}
+	return report, nil
+}
+
+func isSourceFile(queryResults *QueryResults, labelAndConfiguration LabelAndConfiguration) bool {
+	configuredTarget := queryResults.TransitiveConfiguredTargets[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+	return configuredTarget.GetTarget().GetType() == build.Target_SOURCE_FILE
+}
+
+func isRootCause(differences []Difference) bool {
+	for _, difference := range differences {
+		if _, propagated := propagatedDifferenceCategories[difference.Category]; !propagated {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"testing"
+
+	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCompareForDeterminism(t *testing.T) {
+	// Lays out the project, and gives GreetingLib an attribute which depends on where the project
+	// was laid out, like a host-dependent path would.
+	layoutUnstableProject := func() *analysis.CqueryResult {
+		dir, cqueryResult := layoutProject(t)
+		cqueryResult.Results[1].GetTarget().GetRule().Attribute = []*build.Attribute{
+			{
+				Name:        proto.String("javacopts"),
+				Type:        build.Attribute_STRING.Enum(),
+				StringValue: proto.String("-Xplugin:" + dir),
+			},
+		}
+		return cqueryResult
+	}
+
+	report, err := compareForDeterminism(hashedHelloWorld(t, layoutUnstableProject()), hashedHelloWorld(t, layoutUnstableProject()))
+	if err != nil {
+		t.Fatalf("compareForDeterminism failed: %v", err)
+	}
+
+	if len(report.UnstableTargets) != 1 || report.UnstableTargets[0].Label != mustParseLabel("//HelloWorld:HelloWorld") {
+		t.Fatalf("expected //HelloWorld:HelloWorld to be unstable, got %v", report.UnstableTargets)
+	}
+	if got := report.UnstableTargets[0].Differences; len(got) != 1 || got[0].Category != "RuleInputChanged" {
+		t.Errorf("expected //HelloWorld:HelloWorld to be unstable because of a rule input, got %v", got)
+	}
+
+	if len(report.RootCauses) != 1 {
+		t.Fatalf("expected exactly one root cause, got %v", report.RootCauses)
+	}
+	rootCause := report.RootCauses[0]
+	if rootCause.Label != mustParseLabel("//HelloWorld:GreetingLib") {
+		t.Errorf("expected //HelloWorld:GreetingLib to be the root cause, got %v", rootCause.Label)
+	}
+	if len(rootCause.Differences) != 1 || rootCause.Differences[0].Category != "AttributeChanged" || rootCause.Differences[0].Key != "javacopts" {
+		t.Errorf("expected javacopts to be reported as unstable, got %v", rootCause.Differences)
+	}
+}
+
+func TestCompareForDeterminismStable(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	report, err := compareForDeterminism(hashedHelloWorld(t, cqueryResult), hashedHelloWorld(t, cqueryResult))
+	if err != nil {
+		t.Fatalf("compareForDeterminism failed: %v", err)
+	}
+	if len(report.UnstableTargets) != 0 || len(report.RootCauses) != 0 {
+		t.Errorf("expected no unstable targets, got %v", report)
+	}
+}
+
+// hashedHelloWorld returns QueryResults for cqueryResult in which //HelloWorld:HelloWorld is the
+// only matching target, with its hashes computed.
+func hashedHelloWorld(t *testing.T, cqueryResult *analysis.CqueryResult) *QueryResults {
+	helloWorld := mustParseLabel("//HelloWorld:HelloWorld")
+	n := Normalizer{}
+	transitiveConfiguredTargets, err := ParseCqueryResult(cqueryResult.Results, &n)
+	if err != nil {
+		t.Fatalf("Failed to parse cquery result: %v", err)
+	}
+	results := &QueryResults{
+		MatchingTargets: &MatchingTargets{
+			labels: ss.NewSortedSetFn([]label.Label{helloWorld}, CompareLabels),
+			labelsToConfigurations: map[label.Label]*ss.SortedSet[Configuration]{
+				helloWorld: ss.NewSortedSetFn([]Configuration{NormalizeConfiguration(configurationChecksum)}, ConfigurationLess),
+			},
+		},
+		TransitiveConfiguredTargets: transitiveConfiguredTargets,
+		TargetHashCache:             NewTargetHashCache(transitiveConfiguredTargets, &n, "release 5.1.1"),
+		BazelRelease:                "release 5.1.1",
+	}
+	if err := results.PrefillCache(); err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	return results
+}
@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/common/versions"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/hashicorp/go-version"
+)
+
+const (
+	// ExternalRepoHashStrategyContents hashes source files in external repositories by reading them
+	// from the output base, like source files in the main repository.
+	ExternalRepoHashStrategyContents = "contents"
+	// ExternalRepoHashStrategyDefinition hashes source files in external repositories by the
+	// definition of the repository they come from (e.g. its URLs and integrity), without reading
+	// the extracted files.
+	ExternalRepoHashStrategyDefinition = "definition"
+)
+
+// Repository rules whose contents come from the local filesystem, so whose definition doesn't
+// identify their contents. Source files in these are always hashed by contents.
+var localRepositoryRuleClasses = map[string]struct{}{
+	"local_repository":     {},
+	"new_local_repository": {},
+}
+
+// ValidateExternalRepoHashStrategy returns an error if strategy isn't a known strategy.
+func ValidateExternalRepoHashStrategy(strategy string) error {
+	switch strategy {
+	case ExternalRepoHashStrategyContents, ExternalRepoHashStrategyDefinition:
+		return nil
+	default:
+		return fmt.Errorf("unrecognized external repository hash strategy: %v. Accepted values: %s,%s", strategy, ExternalRepoHashStrategyContents, ExternalRepoHashStrategyDefinition)
+	}
+}
+
+// externalRepoDefinition is the definition of a single external repository, as printed by Bazel.
+type externalRepoDefinition struct {
+	name      string
+	ruleClass string
+	// lines are the lines of the definition, with comments (which contain absolute paths) removed.
+	lines []string
+}
+
+// computeExternalRepoIdentities returns a stable digest identifying each external repository which
+// provides source files to transitiveConfiguredTargets, along with the paths (relative to the
+// workspace root) of the files in the main repository which those digests depend on.
+// Repositories whose contents can't be identified by their definition (e.g. local repositories, or
+// repositories Bazel didn't print a definition for) are omitted, and should be hashed by contents.
+func computeExternalRepoIdentities(context *Context, transitiveConfiguredTargets map[label.Label]map[Configuration]*analysis.ConfiguredTarget, hasBzlmod bool, bazelRelease string) (map[string][]byte, map[string]struct{}, error) {
+	repoNames := externalSourceRepos(transitiveConfiguredTargets)
+	identities := make(map[string][]byte, len(repoNames))
+	referencedFiles := make(map[string]struct{})
+	if len(repoNames) == 0 {
+		return identities, referencedFiles, nil
+	}
+
+	log.Printf("Computing identities of %d external repositories", len(repoNames))
+	definitions, err := externalRepoDefinitions(context, repoNames, hasBzlmod, bazelRelease)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, repoName := range repoNames {
+		definition, ok := definitions[repoName]
+		if !ok {
+			log.Printf("Couldn't find the definition of external repository @@%s - hashing its source files by contents", repoName)
+			continue
+		}
+		if _, isLocal := localRepositoryRuleClasses[definition.ruleClass]; isLocal {
+			continue
+		}
+		identity, files, err := definition.identity(context.WorkspacePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to compute identity of external repository @@%s: %w", repoName, err)
+		}
+		identities[repoName] = identity
+		for _, file := range files {
+			referencedFiles[file] = struct{}{}
+		}
+	}
+	return identities, referencedFiles, nil
+}
+
+// externalSourceRepos returns the sorted names of external repositories containing source files.
+func externalSourceRepos(transitiveConfiguredTargets map[label.Label]map[Configuration]*analysis.ConfiguredTarget) []string {
+	repoSet := make(map[string]struct{})
+	for l, configuredTargets := range transitiveConfiguredTargets {
+		if l.Repo == "" {
+			continue
+		}
+		for _, configuredTarget := range configuredTargets {
+			if configuredTarget.GetTarget().GetType() == build.Target_SOURCE_FILE {
+				repoSet[l.Repo] = struct{}{}
+			}
+		}
+	}
+	repoNames := make([]string, 0, len(repoSet))
+	for repoName := range repoSet {
+		repoNames = append(repoNames, repoName)
+	}
+	sort.Strings(repoNames)
+	return repoNames
+}
+
+func externalRepoDefinitions(context *Context, repoNames []string, hasBzlmod bool, bazelRelease string) (map[string]externalRepoDefinition, error) {
+	var stdout, stderr bytes.Buffer
+	var returnVal int
+	var err error
+
+	// `bazel mod show_repo` accepts canonical repository names from Bazel 7.1.0.
+	canShowRepo, _ := versions.ReleaseIsInRange(bazelRelease, version.Must(version.NewVersion("7.1.0")), nil)
+	if hasBzlmod && canShowRepo != nil && *canShowRepo {
+		args := make([]string, 0, len(repoNames))
+		for _, repoName := range repoNames {
+			args = append(args, "@@"+repoName)
+		}
+		returnVal, err = context.BazelCmd.Execute(
+			BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
+			[]string{"--output_base", context.BazelOutputBase}, "mod", append([]string{"show_repo"}, args...)...)
+	} else {
+		externalTargets := make([]string, 0, len(repoNames))
+		for _, repoName := range repoNames {
+			externalTargets = append(externalTargets, "//external:"+repoName)
+		}
+		returnVal, err = context.BazelCmd.Execute(
+			BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
+			[]string{"--output_base", context.BazelOutputBase}, "query", "--output=build", "--keep_going", strings.Join(externalTargets, " + "))
+	}
+	// Exit code 3 means some (but not all) repositories couldn't be found, e.g. because they were
+	// created by a module extension which isn't visible to //external. Other failures may also only
+	// affect some repositories, e.g. `mod show_repo` fails for repositories defined in WORKSPACE when
+	// it is used alongside bzlmod. Repositories without a definition are hashed by contents.
+	if err != nil && returnVal != 3 {
+		log.Printf("WARNING: Failed to get the definitions of external repositories, so those without one are hashed by contents: %v. Stderr:\n%v", err, stderr.String())
+	}
+	return parseExternalRepoDefinitions(&stdout)
+}
+
+var repoDefinitionStartRegex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.]*)\($`)
+var repoDefinitionNameRegex = regexp.MustCompile(`^\s*name\s*=\s*"([^"]*)",?$`)
+
+// parseExternalRepoDefinitions parses the output of `bazel mod show_repo` or
+// `bazel query --output=build //external:...` into definitions, keyed by canonical repository name.
+func parseExternalRepoDefinitions(output *bytes.Buffer) (map[string]externalRepoDefinition, error) {
+	definitions := make(map[string]externalRepoDefinition)
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var current *externalRepoDefinition
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			// Comments contain source locations, which are absolute paths.
+			continue
+		}
+		if current == nil {
+			if matches := repoDefinitionStartRegex.FindStringSubmatch(line); matches != nil {
+				current = &externalRepoDefinition{ruleClass: matches[1], lines: []string{line}}
+			}
+			continue
+		}
+		current.lines = append(current.lines, line)
+		if matches := repoDefinitionNameRegex.FindStringSubmatch(line); matches != nil && current.name == "" {
+			current.name = strings.TrimPrefix(matches[1], "@")
+		}
+		if line == ")" {
+			if current.name == "" {
+				return nil, fmt.Errorf("saw external repository definition without a name: %s", strings.Join(current.lines, "\n"))
+			}
+			definitions[current.name] = *current
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read external repository definitions: %w", err)
+	}
+	return definitions, nil
+}
+
+// Labels of files in the main repository, e.g. patches applied by an archive_override.
+var mainRepoFileLabelRegex = regexp.MustCompile(`"(?:@@|@)?//([^":]*):([^"]+)"`)
+
+// identity returns a digest of the repository definition, and the paths (relative to the workspace
+// root) of the files in the main repository it depends on.
+// Files in the main repository referenced from the definition (e.g. patches applied by an
+// override) are hashed by contents, as changes to them change the repository's contents.
+func (d externalRepoDefinition) identity(workspacePath string) ([]byte, []string, error) {
+	hasher := sha256.New()
+	for _, line := range d.lines {
+		hasher.Write([]byte(line))
+		hasher.Write([]byte{'\n'})
+	}
+	var files []string
+	for _, line := range d.lines {
+		for _, matches := range mainRepoFileLabelRegex.FindAllStringSubmatch(line, -1) {
+			relPath := path.Join(matches[1], matches[2])
+			path := filepath.Join(workspacePath, filepath.FromSlash(relPath))
+			info, err := os.Stat(path)
+			if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+				// Not a file, e.g. a label referring to a rule. Its label is already part of the definition.
+				continue
+			}
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read %s referenced by the definition of @@%s: %w", path, d.name, err)
+			}
+			hasher.Write([]byte(matches[0]))
+			hasher.Write(contents)
+			files = append(files, relPath)
+		}
+	}
+	return hasher.Sum(nil), files, nil
+}
@@ -0,0 +1,284 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"google.golang.org/protobuf/proto"
+)
+
+const showRepoOutput = `## @@rules_foo+:
+# <builtin>
+http_archive(
+  name = "rules_foo+",
+  urls = ["https://example.com/rules_foo-1.0.tar.gz"],
+  integrity = "sha256-abc=",
+  patches = ["@@//patches:rules_foo.patch"],
+)
+# Rule http_archive defined at (most recent call last):
+#   /home/user/.cache/bazel/_bazel_user/1234/external/bazel_tools/tools/build_defs/repo/http.bzl:387:31 in <toplevel>
+
+## @@local_thing+:
+local_repository(
+  name = "local_thing+",
+  path = "/opt/local_thing",
+)
+`
+
+const queryBuildOutput = `# /home/user/project/WORKSPACE:3:13
+http_archive(
+  name = "com_example_lib",
+  sha256 = "0123",
+  urls = ["https://example.com/lib.tar.gz"],
+)
+`
+
+func TestParseExternalRepoDefinitions(t *testing.T) {
+	definitions, err := parseExternalRepoDefinitions(bytes.NewBufferString(showRepoOutput))
+	if err != nil {
+		t.Fatalf("parseExternalRepoDefinitions failed: %v", err)
+	}
+	if len(definitions) != 2 {
+		t.Fatalf("expected 2 definitions, got %d: %v", len(definitions), definitions)
+	}
+	if got := definitions["rules_foo+"].ruleClass; got != "http_archive" {
+		t.Errorf("wrong rule class for rules_foo+: %q", got)
+	}
+	if got := definitions["local_thing+"].ruleClass; got != "local_repository" {
+		t.Errorf("wrong rule class for local_thing+: %q", got)
+	}
+	for _, line := range definitions["rules_foo+"].lines {
+		if bytes.Contains([]byte(line), []byte("/home/user")) {
+			t.Errorf("expected comments to be stripped from definition, but saw %q", line)
+		}
+	}
+
+	definitions, err = parseExternalRepoDefinitions(bytes.NewBufferString(queryBuildOutput))
+	if err != nil {
+		t.Fatalf("parseExternalRepoDefinitions failed: %v", err)
+	}
+	if _, ok := definitions["com_example_lib"]; !ok {
+		t.Errorf("expected definition of com_example_lib, got %v", definitions)
+	}
+}
+
+// failingShowRepoBazelCmd is a fakeBazelCmd whose `mod show_repo` prints the definitions in stdout,
+// but fails, as it does for repositories defined in WORKSPACE when bzlmod is also used.
+type failingShowRepoBazelCmd struct {
+	fakeBazelCmd
+	stdout string
+}
+
+func (f failingShowRepoBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	if command == "mod" {
+		fmt.Fprint(config.Stdout, f.stdout)
+		return 2, fmt.Errorf("exit status 2")
+	}
+	return f.fakeBazelCmd.Execute(config, startupArgs, command, args...)
+}
+
+func TestExternalRepoDefinitionsToleratesFailures(t *testing.T) {
+	ctx := &Context{WorkspacePath: t.TempDir(), BazelCmd: failingShowRepoBazelCmd{stdout: showRepoOutput}}
+	definitions, err := externalRepoDefinitions(ctx, []string{"rules_foo+", "com_example_workspace_repo"}, true, "release 7.4.0")
+	if err != nil {
+		t.Fatalf("expected repositories without definitions to be hashed by contents, got %v", err)
+	}
+	if _, ok := definitions["rules_foo+"]; !ok {
+		t.Errorf("expected the printed definition of rules_foo+, got %v", definitions)
+	}
+	if _, ok := definitions["com_example_workspace_repo"]; ok {
+		t.Errorf("expected no definition of com_example_workspace_repo, got %v", definitions)
+	}
+}
+
+func TestExternalRepoIdentity(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workspace, "patches"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	patch := filepath.Join(workspace, "patches", "rules_foo.patch")
+	if err := os.WriteFile(patch, []byte("--- a\n+++ b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := func(output string) []byte {
+		definitions, err := parseExternalRepoDefinitions(bytes.NewBufferString(output))
+		if err != nil {
+			t.Fatalf("parseExternalRepoDefinitions failed: %v", err)
+		}
+		id, files, err := definitions["rules_foo+"].identity(workspace)
+		if err != nil {
+			t.Fatalf("identity failed: %v", err)
+		}
+		if want := []string{"patches/rules_foo.patch"}; !reflect.DeepEqual(files, want) {
+			t.Errorf("want referenced files %v, got %v", want, files)
+		}
+		return id
+	}
+
+	original := identity(showRepoOutput)
+	movedOutputBase := identity(string(bytes.ReplaceAll([]byte(showRepoOutput), []byte("/home/user/.cache"), []byte("/tmp/other"))))
+	if !bytes.Equal(original, movedOutputBase) {
+		t.Errorf("expected identity not to depend on paths in comments")
+	}
+	upgraded := identity(string(bytes.ReplaceAll([]byte(showRepoOutput), []byte("sha256-abc="), []byte("sha256-def="))))
+	if bytes.Equal(original, upgraded) {
+		t.Errorf("expected identity to change when integrity changes")
+	}
+	if err := os.WriteFile(patch, []byte("--- a\n+++ c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if patched := identity(showRepoOutput); bytes.Equal(original, patched) {
+		t.Errorf("expected identity to change when a referenced patch changes")
+	}
+}
+
+func TestExternalRepoIdentitySkipsLabelsWhichArentFiles(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workspace, "third_party", "vendored"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	definitions, err := parseExternalRepoDefinitions(bytes.NewBufferString(`## @@rules_foo+:
+http_archive(
+  name = "rules_foo+",
+  patches = ["@@//third_party:vendored", "@@//third_party:generated_patch"],
+)
+`))
+	if err != nil {
+		t.Fatalf("parseExternalRepoDefinitions failed: %v", err)
+	}
+	_, files, err := definitions["rules_foo+"].identity(workspace)
+	if err != nil {
+		t.Fatalf("expected labels referring to a directory or a rule to be skipped, got %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no referenced files, got %v", files)
+	}
+}
+
+func TestExternalRepoIdentitiesAffectHashes(t *testing.T) {
+	configuration := &analysis.Configuration{Checksum: configurationChecksum}
+	cqueryResult := &analysis.CqueryResult{
+		Results: []*analysis.ConfiguredTarget{
+			{
+				Target: &build.Target{
+					Type: build.Target_RULE.Enum(),
+					Rule: &build.Rule{
+						Name:      proto.String("//:lib"),
+						RuleClass: proto.String("java_library"),
+						RuleInput: []string{"@@rules_foo+//:Foo.java"},
+					},
+				},
+				Configuration: configuration,
+			},
+			{
+				Target: &build.Target{
+					Type: build.Target_SOURCE_FILE.Enum(),
+					SourceFile: &build.SourceFile{
+						Name:     proto.String("@@rules_foo+//:Foo.java"),
+						Location: proto.String("/nonexistent/output_base/external/rules_foo+/BUILD.bazel:1:1"),
+					},
+				},
+			},
+		},
+	}
+	labelAndConfiguration := LabelAndConfiguration{
+		Label:         mustParseLabel("//:lib"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+	const bazelVersion = "release 5.1.1"
+
+	withIdentity := func(identity []byte) *TargetHashCache {
+		thc := parseResult(t, cqueryResult, bazelVersion)
+		thc.UseExternalRepoIdentities(map[string][]byte{"rules_foo+": identity})
+		return thc
+	}
+
+	before := withIdentity([]byte{0x01})
+	after := withIdentity([]byte{0x02})
+	beforeHash, err := before.Hash(labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	afterHash, err := after.Hash(labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	if areHashesEqual(beforeHash, afterHash) {
+		t.Fatalf("expected hashes to differ when the external repository identity changes")
+	}
+
+	differences, err := WalkDiffs(before, after, labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("WalkDiffs failed: %v", err)
+	}
+	want := Difference{Category: "ExternalDependencyChanged", Key: "@@rules_foo+", Before: "01", After: "02"}
+	if len(differences) != 1 || differences[0] != want {
+		t.Errorf("expected differences %v, got %v", []Difference{want}, differences)
+	}
+}
+
+func TestTransitiveExternalRepoChangeIsRuleInputChange(t *testing.T) {
+	configuration := &analysis.Configuration{Checksum: configurationChecksum}
+	cqueryResult := &analysis.CqueryResult{
+		Results: []*analysis.ConfiguredTarget{
+			{
+				Target: &build.Target{
+					Type: build.Target_RULE.Enum(),
+					Rule: &build.Rule{
+						Name:      proto.String("//:lib"),
+						RuleClass: proto.String("java_library"),
+						RuleInput: []string{"@@rules_foo+//:foo"},
+					},
+				},
+				Configuration: configuration,
+			},
+			{
+				Target: &build.Target{
+					Type: build.Target_RULE.Enum(),
+					Rule: &build.Rule{
+						Name:      proto.String("@@rules_foo+//:foo"),
+						RuleClass: proto.String("java_library"),
+						RuleInput: []string{"@@rules_bar+//:Bar.java"},
+					},
+				},
+				Configuration: configuration,
+			},
+			{
+				Target: &build.Target{
+					Type: build.Target_SOURCE_FILE.Enum(),
+					SourceFile: &build.SourceFile{
+						Name:     proto.String("@@rules_bar+//:Bar.java"),
+						Location: proto.String("/nonexistent/output_base/external/rules_bar+/BUILD.bazel:1:1"),
+					},
+				},
+			},
+		},
+	}
+	labelAndConfiguration := LabelAndConfiguration{
+		Label:         mustParseLabel("//:lib"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+
+	withIdentities := func(barIdentity []byte) *TargetHashCache {
+		thc := parseResult(t, cqueryResult, "release 5.1.1")
+		thc.UseExternalRepoIdentities(map[string][]byte{"rules_foo+": {0x01}, "rules_bar+": barIdentity})
+		return thc
+	}
+
+	// Only a dependency of @@rules_foo+//:foo changed, not @@rules_foo+ itself.
+	differences, err := WalkDiffs(withIdentities([]byte{0x01}), withIdentities([]byte{0x02}), labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("WalkDiffs failed: %v", err)
+	}
+	if len(differences) != 1 || differences[0].Category != "RuleInputChanged" || !strings.HasPrefix(differences[0].Key, "@@rules_foo+//:foo") {
+		t.Errorf("expected a single RuleInputChanged difference for @@rules_foo+//:foo, got %v", differences)
+	}
+}
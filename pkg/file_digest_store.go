@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var fileDigestCacheDirname = "file_digests"
+
+const fileDigestStoreFilename = "digests.json"
+
+// fileDigestRacyWindow is how recently a file may have been modified for us to refuse to persist its
+// digest. Filesystem timestamps have a limited granularity, so a file which is modified again within
+// the same tick after we hashed it would keep the same mtime (and possibly size), and we would serve a
+// stale digest for it forever. This is the same problem git solves with its "racily clean" checks.
+const fileDigestRacyWindow = 2 * time.Second
+
+// FileDigestStore persists file digests across invocations of target-determinator.
+//
+// Digests are keyed by the absolute path of the file, along with the parts of its stat information
+// which change when its contents or user execute bit change (size, mtime, inode, and the execute
+// bit itself). A file whose stat information no longer matches the recorded values is re-hashed.
+//
+// A FileDigestStore is safe for concurrent use. Changes are only written to disk by Save.
+type FileDigestStore struct {
+	path string
+
+	lock    sync.Mutex
+	entries map[string]fileDigestEntry
+	updates map[string]fileDigestEntry
+}
+
+type fileDigestEntry struct {
+	Size        int64
+	ModTimeNano int64
+	Inode       uint64
+	UserExecBit bool
+	Digest      []byte
+}
+
+func newFileDigestEntry(info os.FileInfo, digest []byte) fileDigestEntry {
+	return fileDigestEntry{
+		Size:        info.Size(),
+		ModTimeNano: info.ModTime().UnixNano(),
+		Inode:       fileInode(info),
+		UserExecBit: getUserExecuteBit(info.Mode()) != 0,
+		Digest:      digest,
+	}
+}
+
+func (e fileDigestEntry) matches(other fileDigestEntry) bool {
+	return e.Size == other.Size && e.ModTimeNano == other.ModTimeNano && e.Inode == other.Inode && e.UserExecBit == other.UserExecBit
+}
+
+// LoadFileDigestStore loads the persisted file digests from the given cache directory.
+// A missing or unreadable store is not an error; it results in an empty store.
+func LoadFileDigestStore(cacheDirectory string) (*FileDigestStore, error) {
+	if cacheDirectory == "" {
+		return nil, fmt.Errorf("cache directory not configured")
+	}
+	store := &FileDigestStore{
+		path:    filepath.Join(cacheDirectory, fileDigestCacheDirname, fileDigestStoreFilename),
+		updates: make(map[string]fileDigestEntry),
+	}
+	entries, err := readFileDigestEntries(store.path)
+	if err != nil {
+		log.Printf("Ignoring unreadable file digest cache %s: %v", store.path, err)
+		entries = make(map[string]fileDigestEntry)
+	}
+	store.entries = entries
+	return store, nil
+}
+
+func readFileDigestEntries(path string) (map[string]fileDigestEntry, error) {
+	entries := make(map[string]fileDigestEntry)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file digests: %w", err)
+	}
+	return entries, nil
+}
+
+// Lookup returns the persisted digest of the file at path, if the given stat information matches
+// what was recorded when the digest was computed.
+func (s *FileDigestStore) Lookup(path string, info os.FileInfo) ([]byte, bool) {
+	if s == nil {
+		return nil, false
+	}
+	want := newFileDigestEntry(info, nil)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.updates[path]
+	if !ok {
+		entry, ok = s.entries[path]
+	}
+	if !ok || !entry.matches(want) {
+		return nil, false
+	}
+	return entry.Digest, true
+}
+
+// Record remembers the digest of the file at path, as computed when it had the given stat information.
+// Files which were modified too recently to be safely keyed by their mtime are not recorded.
+func (s *FileDigestStore) Record(path string, info os.FileInfo, digest []byte) {
+	if s == nil {
+		return
+	}
+	if time.Since(info.ModTime()) < fileDigestRacyWindow {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.updates[path] = newFileDigestEntry(info, digest)
+}
+
+// Save writes any newly recorded digests to disk.
+// Entries written concurrently by other processes since this store was loaded are preserved, as the
+// store is merged with them while holding a lock. Entries for files which no longer exist are only
+// removed by PruneFileDigestStore.
+func (s *FileDigestStore) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.updates) == 0 {
+		return nil
+	}
+
+	entries, err := updateFileDigestEntries(s.path, func(entries map[string]fileDigestEntry) {
+		for path, entry := range s.updates {
+			entries[path] = entry
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.entries = entries
+	s.updates = make(map[string]fileDigestEntry)
+	return nil
+}
+
+// PruneFileDigestStore removes the persisted digests of files which no longer exist (e.g. because
+// they were deleted, or were in a removed worktree) from the store in the given cache directory,
+// returning how many were removed. It stats every file in the store, so is only run on demand (see
+// `cache gc`) rather than by every invocation.
+func PruneFileDigestStore(cacheDirectory string) (int, error) {
+	path := filepath.Join(cacheDirectory, fileDigestCacheDirname, fileDigestStoreFilename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return 0, nil
+	}
+	pruned := 0
+	_, err := updateFileDigestEntries(path, func(entries map[string]fileDigestEntry) {
+		for file := range entries {
+			if _, err := os.Lstat(file); os.IsNotExist(err) {
+				delete(entries, file)
+				pruned++
+			}
+		}
+	})
+	return pruned, err
+}
+
+// updateFileDigestEntries applies update to the entries stored at path, and writes them back, while
+// holding a lock so that concurrent updates by other processes aren't lost. It returns the updated
+// entries.
+func updateFileDigestEntries(path string, update func(entries map[string]fileDigestEntry)) (map[string]fileDigestEntry, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create file digest cache dir (%s): %w", dir, err)
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := readFileDigestEntries(path)
+	if err != nil {
+		log.Printf("Overwriting unreadable file digest cache %s: %v", path, err)
+		entries = make(map[string]fileDigestEntry)
+	}
+	update(entries)
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal file digests: %w", err)
+	}
+	tmpFile, err := os.CreateTemp(dir, fileDigestStoreFilename+".tmp.*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file digest cache file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return nil, fmt.Errorf("failed to write temp file digest cache file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close temp file digest cache file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, fmt.Errorf("failed to move temp file digest cache file to final location: %w", err)
+	}
+	tmpPath = ""
+	return entries, nil
+}
@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeOldFile writes a file whose mtime is far enough in the past to be safely recorded.
+func writeOldFile(t *testing.T, path string, content string, mtime time.Time) os.FileInfo {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set mtime of %s: %v", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	return info
+}
+
+func TestFileDigestStoreRoundTrip(t *testing.T) {
+	cacheDir := t.TempDir()
+	file := filepath.Join(t.TempDir(), "Source.java")
+	mtime := time.Now().Add(-time.Hour)
+	info := writeOldFile(t, file, "class Source {}", mtime)
+	digest := []byte{0xde, 0xad, 0xca, 0xfe}
+
+	store, err := LoadFileDigestStore(cacheDir)
+	if err != nil {
+		t.Fatalf("LoadFileDigestStore failed: %v", err)
+	}
+	store.Record(file, info, digest)
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	reloaded, err := LoadFileDigestStore(cacheDir)
+	if err != nil {
+		t.Fatalf("LoadFileDigestStore failed: %v", err)
+	}
+	got, ok := reloaded.Lookup(file, info)
+	if !ok {
+		t.Fatalf("expected persisted digest for %s", file)
+	}
+	if !bytes.Equal(got, digest) {
+		t.Errorf("digest mismatch: want %x, got %x", digest, got)
+	}
+
+	t.Run("miss when mtime changes", func(t *testing.T) {
+		changedInfo := writeOldFile(t, file, "class Source {}", mtime.Add(time.Second))
+		if _, ok := reloaded.Lookup(file, changedInfo); ok {
+			t.Error("expected miss after mtime changed")
+		}
+	})
+
+	t.Run("miss when exec bit changes", func(t *testing.T) {
+		info := writeOldFile(t, file, "class Source {}", mtime)
+		if err := os.Chmod(file, 0755); err != nil {
+			t.Fatal(err)
+		}
+		execInfo, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := reloaded.Lookup(file, info); !ok {
+			t.Error("expected hit for the original stat information")
+		}
+		if _, ok := reloaded.Lookup(file, execInfo); ok {
+			t.Error("expected miss after exec bit changed")
+		}
+	})
+}
+
+func TestPruneFileDigestStore(t *testing.T) {
+	cacheDir := t.TempDir()
+	sourceDir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour)
+	kept := filepath.Join(sourceDir, "Kept.java")
+	deleted := filepath.Join(sourceDir, "Deleted.java")
+	keptInfo := writeOldFile(t, kept, "class Kept {}", mtime)
+	deletedInfo := writeOldFile(t, deleted, "class Deleted {}", mtime)
+
+	store, err := LoadFileDigestStore(cacheDir)
+	if err != nil {
+		t.Fatalf("LoadFileDigestStore failed: %v", err)
+	}
+	store.Record(kept, keptInfo, []byte{0x01})
+	store.Record(deleted, deletedInfo, []byte{0x02})
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := PruneFileDigestStore(cacheDir)
+	if err != nil {
+		t.Fatalf("PruneFileDigestStore failed: %v", err)
+	}
+	if pruned != 1 {
+		t.Errorf("expected 1 digest to be pruned, got %d", pruned)
+	}
+	entries, err := readFileDigestEntries(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries[deleted]; ok {
+		t.Errorf("expected the digest of a deleted file to be pruned")
+	}
+	if _, ok := entries[kept]; !ok {
+		t.Errorf("expected the digest of an existing file to be kept")
+	}
+
+	if pruned, err := PruneFileDigestStore(t.TempDir()); err != nil || pruned != 0 {
+		t.Errorf("expected nothing to be pruned without a store, got %d (error %v)", pruned, err)
+	}
+}
+
+func TestFileDigestStoreConcurrentSaves(t *testing.T) {
+	cacheDir := t.TempDir()
+	sourceDir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour)
+
+	// Each store is loaded before any of the others are saved, as with concurrent invocations.
+	var files []string
+	var stores []*FileDigestStore
+	for i := 0; i < 8; i++ {
+		file := filepath.Join(sourceDir, fmt.Sprintf("Source%d.java", i))
+		info := writeOldFile(t, file, file, mtime)
+		store, err := LoadFileDigestStore(cacheDir)
+		if err != nil {
+			t.Fatalf("LoadFileDigestStore failed: %v", err)
+		}
+		store.Record(file, info, []byte{byte(i)})
+		files = append(files, file)
+		stores = append(stores, store)
+	}
+	var wg sync.WaitGroup
+	for _, store := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.Save(); err != nil {
+				t.Errorf("Save failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := readFileDigestEntries(stores[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if _, ok := entries[file]; !ok {
+			t.Errorf("expected the digest of %s to be saved", file)
+		}
+	}
+}
+
+func TestFileDigestStoreSkipsRacilyModifiedFiles(t *testing.T) {
+	store, err := LoadFileDigestStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadFileDigestStore failed: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "Source.java")
+	info := writeOldFile(t, file, "class Source {}", time.Now())
+
+	store.Record(file, info, []byte{0x01})
+	if _, ok := store.Lookup(file, info); ok {
+		t.Error("expected a just-modified file not to be recorded")
+	}
+}
+
+func TestFileHashCacheUsesFileDigestStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "Source.java")
+	info := writeOldFile(t, file, "class Source {}", time.Now().Add(-time.Hour))
+
+	store, err := LoadFileDigestStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadFileDigestStore failed: %v", err)
+	}
+	// A digest which can't be the real digest of the file, to prove it was served from the store.
+	persisted := []byte{0x01, 0x02}
+	store.Record(file, info, persisted)
+
+	hc := &fileHashCache{cache: make(map[string]*cacheEntry), store: store}
+	got, err := hc.Hash(file)
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+	if !bytes.Equal(got, persisted) {
+		t.Errorf("expected digest to be served from the store: want %x, got %x", persisted, got)
+	}
+}
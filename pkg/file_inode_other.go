@@ -0,0 +1,10 @@
+//go:build !unix
+
+package pkg
+
+import "os"
+
+// fileInode returns 0, as inode numbers aren't available on this platform.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
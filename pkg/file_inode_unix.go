@@ -0,0 +1,16 @@
+//go:build unix
+
+package pkg
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of the file described by info, or 0 if it isn't known.
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
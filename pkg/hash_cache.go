@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -70,6 +71,27 @@ type TargetHashCache struct {
 
 	normalizer *Normalizer
 
+	exclusionPolicy *HashExclusionPolicy
+
+	// externalRepoIdentities maps canonical external repository names to digests identifying their
+	// contents. If nil, source files in external repositories are hashed by contents.
+	externalRepoIdentities map[string][]byte
+	// externalRepoFiles are the paths (relative to the workspace root) of the files in the main
+	// repository which externalRepoIdentities depend on. If nil, they aren't known.
+	externalRepoFiles map[string]struct{}
+
+	// toolchainTypes maps resolved toolchain implementations to the toolchain types they were
+	// resolved for. If nil, toolchains aren't treated specially.
+	toolchainTypes map[gazelle_label.Label][]string
+
+	// breakDependencyCycles controls whether dependency cycles are broken, rather than causing an error.
+	breakDependencyCycles bool
+	// brokenDependencies are the dependencies which were ignored to break dependency cycles.
+	brokenDependencies map[dependencyEdge]struct{}
+
+	// progress reports the progress of hashing. It may be nil.
+	progress *ProgressReporter
+
 	frozen bool
 
 	cacheLock sync.Mutex
@@ -96,7 +118,50 @@ var notComputedBeforeFrozen = fmt.Errorf("TargetHashCache has already been froze
 //     surfaced by Bazel, so if a dependency exists in multiple configurations, all of them will be
 //     mixed into the hash, even if only one of the configurations is actually relevant.
 //     See https://github.com/bazelbuild/bazel/issues/14610
+//
+// Attributes, rule implementations and source files excluded by the TargetHashCache's
+// HashExclusionPolicy (if any) don't contribute to the hash.
+//
+// If external repository identities are in use, source files in external repositories are hashed by
+// the identity of their repository rather than by their contents.
+//
+// If resolved toolchains are in use, the toolchain types and implementations resolved for a rule
+// are also mixed into its hash.
+//
+// Dependencies are hashed before their dependents, and a dependency cycle causes an error (unless
+// dependency cycle breaking is in use).
 func (thc *TargetHashCache) Hash(labelAndConfiguration LabelAndConfiguration) ([]byte, error) {
+	if !thc.frozen && !thc.isHashed(labelAndConfiguration) {
+		if _, err := thc.hashInDependencyOrder([]LabelAndConfiguration{labelAndConfiguration}, 1, false); err != nil {
+			return nil, err
+		}
+	}
+	return thc.hashWithHashedDependencies(labelAndConfiguration)
+}
+
+// isHashed returns whether the hash of labelAndConfiguration has already been computed.
+func (thc *TargetHashCache) isHashed(labelAndConfiguration LabelAndConfiguration) bool {
+	return thc.cachedHash(labelAndConfiguration) != nil
+}
+
+// cachedHash returns the hash of labelAndConfiguration if it has already been computed, or nil.
+func (thc *TargetHashCache) cachedHash(labelAndConfiguration LabelAndConfiguration) []byte {
+	thc.cacheLock.Lock()
+	entry, ok := thc.cache[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+	thc.cacheLock.Unlock()
+	if !ok {
+		return nil
+	}
+	entry.hashLock.Lock()
+	defer entry.hashLock.Unlock()
+	return entry.hash
+}
+
+// hashWithHashedDependencies computes the hash of labelAndConfiguration (if it wasn't already), and
+// caches it.
+// The dependencies of labelAndConfiguration should already have been hashed, as hashing them
+// recursively blocks other hashing of the same configured targets, and deadlocks on dependency cycles.
+func (thc *TargetHashCache) hashWithHashedDependencies(labelAndConfiguration LabelAndConfiguration) ([]byte, error) {
 	thc.cacheLock.Lock()
 	_, ok := thc.cache[labelAndConfiguration.Label]
 	if !ok {
@@ -128,6 +193,48 @@ func (thc *TargetHashCache) Hash(labelAndConfiguration LabelAndConfiguration) ([
 	return entry.hash, nil
 }
 
+// UseFileDigestStore makes the TargetHashCache consult (and record into) store when hashing files,
+// so that unchanged files don't need to be re-read.
+// It must be called before any hashes are computed.
+func (thc *TargetHashCache) UseFileDigestStore(store *FileDigestStore) {
+	thc.fileHashCache.store = store
+}
+
+// UseHashExclusionPolicy makes the TargetHashCache ignore the inputs excluded by policy.
+// It must be called before any hashes are computed.
+func (thc *TargetHashCache) UseHashExclusionPolicy(policy *HashExclusionPolicy) {
+	thc.exclusionPolicy = policy
+}
+
+// UseExternalRepoIdentities makes the TargetHashCache hash source files in the external repositories
+// in identities by the identity of their repository, rather than by reading them.
+// Source files in external repositories without an identity are still hashed by contents.
+// It must be called before any hashes are computed.
+func (thc *TargetHashCache) UseExternalRepoIdentities(identities map[string][]byte) {
+	thc.externalRepoIdentities = identities
+}
+
+// UseResolvedToolchains makes the TargetHashCache treat the rule inputs in toolchainTypes as
+// toolchains resolved for the mapped toolchain types, both when hashing and when walking diffs.
+// It must be called before any hashes are computed.
+func (thc *TargetHashCache) UseResolvedToolchains(toolchainTypes map[gazelle_label.Label][]string) {
+	thc.toolchainTypes = toolchainTypes
+}
+
+// UseDependencyCycleBreaking makes the TargetHashCache break dependency cycles, by ignoring one
+// dependency of each cycle (chosen deterministically), rather than failing to hash targets which
+// depend on a cycle.
+// It must be called before any hashes are computed.
+func (thc *TargetHashCache) UseDependencyCycleBreaking() {
+	thc.breakDependencyCycles = true
+}
+
+// UseProgressReporter makes the TargetHashCache report the progress of hashing to progress.
+// It must be called before any hashes are computed.
+func (thc *TargetHashCache) UseProgressReporter(progress *ProgressReporter) {
+	thc.progress = progress
+}
+
 // KnownConfigurations returns the configurations in which a Label is known to be configured.
 func (thc *TargetHashCache) KnownConfigurations(label gazelle_label.Label) *ss.SortedSet[Configuration] {
 	configurations := ss.NewSortedSetFn([]Configuration{}, ConfigurationLess)
@@ -145,6 +252,30 @@ func (thc *TargetHashCache) Freeze() {
 	thc.frozen = true
 }
 
+// retainOnly freezes the TargetHashCache, and discards everything except the hashes of the given
+// LabelAndConfigurations, including the configured targets it was created from.
+// Afterwards, only hashes of the retained LabelAndConfigurations can be looked up, and WalkDiffs
+// can't be used.
+func (thc *TargetHashCache) retainOnly(labelAndConfigurations []LabelAndConfiguration) {
+	thc.cacheLock.Lock()
+	defer thc.cacheLock.Unlock()
+	retained := make(map[gazelle_label.Label]map[Configuration]*cacheEntry)
+	for _, labelAndConfiguration := range labelAndConfigurations {
+		entry, ok := thc.cache[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+		if !ok {
+			continue
+		}
+		if retained[labelAndConfiguration.Label] == nil {
+			retained[labelAndConfiguration.Label] = make(map[Configuration]*cacheEntry)
+		}
+		retained[labelAndConfiguration.Label][labelAndConfiguration.Configuration] = entry
+	}
+	thc.cache = retained
+	thc.context = nil
+	thc.fileHashCache = nil
+	thc.frozen = true
+}
+
 // ExtractHashes collects all pre-computed hashes from the cache.
 // Keys are formatted as "<label>\x00<configuration>".
 // Only entries with a computed hash are included.
@@ -192,6 +323,20 @@ func (thc *TargetHashCache) RestoreHashes(hashes map[string][]byte) error {
 	return nil
 }
 
+// seedHashes populates the cache with hashes computed by another TargetHashCache for the same
+// configured targets, without freezing it, so that only the configured targets which weren't seeded
+// are hashed when their hashes are needed.
+func (thc *TargetHashCache) seedHashes(hashes map[LabelAndConfiguration][]byte) {
+	thc.cacheLock.Lock()
+	defer thc.cacheLock.Unlock()
+	for labelAndConfiguration, hash := range hashes {
+		if thc.cache[labelAndConfiguration.Label] == nil {
+			thc.cache[labelAndConfiguration.Label] = make(map[Configuration]*cacheEntry)
+		}
+		thc.cache[labelAndConfiguration.Label][labelAndConfiguration.Configuration] = &cacheEntry{hash: hash}
+	}
+}
+
 func (thc *TargetHashCache) ParseCanonicalLabel(label string) (gazelle_label.Label, error) {
 	return thc.normalizer.ParseCanonicalLabel(label)
 }
@@ -300,7 +445,9 @@ func WalkDiffs(before *TargetHashCache, after *TargetHashCache, labelAndConfigur
 			After:    ruleAfter.GetRuleClass(),
 		})
 	}
-	if ruleBefore.GetSkylarkEnvironmentHashCode() != ruleAfter.GetSkylarkEnvironmentHashCode() {
+	ruleImplementationExcluded := before.exclusionPolicy.ExcludesRuleImplementation(ruleBefore.GetRuleClass()) &&
+		after.exclusionPolicy.ExcludesRuleImplementation(ruleAfter.GetRuleClass())
+	if !ruleImplementationExcluded && ruleBefore.GetSkylarkEnvironmentHashCode() != ruleAfter.GetSkylarkEnvironmentHashCode() {
 		differences = append(differences, Difference{
 			Category: "RuleImplementationChanged",
 			Before:   ruleBefore.GetSkylarkEnvironmentHashCode(),
@@ -308,8 +455,8 @@ func WalkDiffs(before *TargetHashCache, after *TargetHashCache, labelAndConfigur
 		})
 	}
 
-	attributesBefore := indexAttributes(ruleBefore.GetAttribute())
-	attributesAfter := indexAttributes(ruleAfter.GetAttribute())
+	attributesBefore := indexAttributes(before.hashedAttributes(ruleBefore))
+	attributesAfter := indexAttributes(after.hashedAttributes(ruleAfter))
 	sortedAttributeNamesBefore := sortKeys(attributesBefore)
 	for _, attributeName := range sortedAttributeNamesBefore {
 		attributeBefore := attributesBefore[attributeName]
@@ -366,10 +513,43 @@ func WalkDiffs(before *TargetHashCache, after *TargetHashCache, labelAndConfigur
 	}
 	ruleInputLabelsToConfigurationsAfter := indexByLabel(ruleInputLabelsAndConfigurationsAfter)
 
+	// Changes to dependencies in external repositories are reported once per repository, as they
+	// usually stem from a single change to the repository's definition.
+	reportedExternalRepos := make(map[string]struct{})
+
+	// Changes to resolved toolchains are reported once per toolchain type, rather than as changes
+	// to the individual toolchain implementations.
+	toolchainsBefore := before.resolvedToolchainsOf(ruleInputLabelsAndConfigurationsBefore)
+	toolchainsAfter := after.resolvedToolchainsOf(ruleInputLabelsAndConfigurationsAfter)
+	reportedToolchainTypes := make(map[string]struct{})
+	reportToolchainChange := func(toolchainType string) {
+		if _, reported := reportedToolchainTypes[toolchainType]; reported {
+			return
+		}
+		reportedToolchainTypes[toolchainType] = struct{}{}
+		differences = append(differences, Difference{
+			Category: "ToolchainChanged",
+			Key:      toolchainType,
+			Before:   strings.Join(toolchainsBefore[toolchainType], ", "),
+			After:    strings.Join(toolchainsAfter[toolchainType], ", "),
+		})
+	}
+	for _, toolchainType := range sortedToolchainTypes(toolchainsBefore, toolchainsAfter) {
+		if strings.Join(toolchainsBefore[toolchainType], ",") != strings.Join(toolchainsAfter[toolchainType], ",") {
+			reportToolchainChange(toolchainType)
+		}
+	}
+	isToolchain := func(l gazelle_label.Label) bool {
+		return len(before.toolchainTypes[l]) > 0 || len(after.toolchainTypes[l]) > 0
+	}
+
 	for _, ruleInputLabelAndConfigurations := range ruleInputLabelsAndConfigurationsAfter {
 		ruleInputLabel := ruleInputLabelAndConfigurations.Label
 		knownConfigurationsBefore, ok := ruleInputLabelsToConfigurationsBefore[ruleInputLabel]
 		if !ok {
+			if isToolchain(ruleInputLabel) {
+				continue
+			}
 			differences = append(differences, Difference{
 				Category: "RuleInputAdded",
 				Key:      ruleInputLabel.String(),
@@ -392,6 +572,30 @@ func WalkDiffs(before *TargetHashCache, after *TargetHashCache, labelAndConfigur
 						return nil, err
 					}
 					if !bytes.Equal(hashBefore, hashAfter) {
+						if toolchainTypes := after.toolchainTypes[ruleInputLabel]; len(toolchainTypes) > 0 {
+							for _, toolchainType := range toolchainTypes {
+								reportToolchainChange(toolchainType)
+							}
+							continue
+						}
+						if ruleInputLabel.Repo != "" && after.externalRepoIdentities != nil {
+							identityBefore := before.externalRepoIdentity(ruleInputLabel.Repo)
+							identityAfter := after.externalRepoIdentity(ruleInputLabel.Repo)
+							// Otherwise, the rule input changed because of its dependencies (e.g. in another
+							// repository), which is reported like a change to a rule input of the main repository.
+							if identityBefore != identityAfter {
+								if _, reported := reportedExternalRepos[ruleInputLabel.Repo]; !reported {
+									reportedExternalRepos[ruleInputLabel.Repo] = struct{}{}
+									differences = append(differences, Difference{
+										Category: "ExternalDependencyChanged",
+										Key:      "@@" + ruleInputLabel.Repo,
+										Before:   identityBefore,
+										After:    identityAfter,
+									})
+								}
+								continue
+							}
+						}
 						differences = append(differences, Difference{
 							Category: "RuleInputChanged",
 							Key:      formatLabelWithConfiguration(ruleInputLabel, knownConfigurationAfter),
@@ -418,7 +622,7 @@ func WalkDiffs(before *TargetHashCache, after *TargetHashCache, labelAndConfigur
 	}
 	for _, ruleInputLabelAndConfigurations := range ruleInputLabelsAndConfigurationsBefore {
 		ruleInputLabel := ruleInputLabelAndConfigurations.Label
-		if _, ok := ruleInputLabelsToConfigurationsAfter[ruleInputLabel]; !ok {
+		if _, ok := ruleInputLabelsToConfigurationsAfter[ruleInputLabel]; !ok && !isToolchain(ruleInputLabel) {
 			differences = append(differences, Difference{
 				Category: "RuleInputRemoved",
 				Key:      ruleInputLabel.String(),
@@ -429,6 +633,16 @@ func WalkDiffs(before *TargetHashCache, after *TargetHashCache, labelAndConfigur
 	return differences, nil
 }
 
+// externalRepoIdentity returns a printable form of the identity of the named external repository,
+// or an empty string if it is hashed by contents.
+func (thc *TargetHashCache) externalRepoIdentity(repo string) string {
+	identity, ok := thc.externalRepoIdentities[repo]
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(identity)
+}
+
 // AttributeForSerialization redacts details about an attribute which don't affect the output of
 // building them, and returns equivalent canonical attribute metadata.
 // In particular it redacts:
@@ -453,6 +667,24 @@ func (thc *TargetHashCache) AttributeForSerialization(rawAttr *build.Attribute)
 	return thc.normalizer.NormalizeAttribute(&normalized)
 }
 
+// hashedAttributes returns the attributes of rule which contribute to its hash, i.e. those which
+// aren't excluded by the HashExclusionPolicy.
+func (thc *TargetHashCache) hashedAttributes(rule *build.Rule) []*build.Attribute {
+	ruleClass := rule.GetRuleClass()
+	ruleImplementationExcluded := thc.exclusionPolicy.ExcludesRuleImplementation(ruleClass)
+	attributes := make([]*build.Attribute, 0, len(rule.GetAttribute()))
+	for _, attr := range rule.GetAttribute() {
+		if thc.exclusionPolicy.ExcludesAttribute(ruleClass, attr.GetName()) {
+			continue
+		}
+		if ruleImplementationExcluded && attr.GetName() == "$rule_implementation_hash" {
+			continue
+		}
+		attributes = append(attributes, attr)
+	}
+	return attributes
+}
+
 func equivalentAttributes(left, right *build.Attribute) bool {
 	return proto.Equal(left, right)
 }
@@ -504,6 +736,12 @@ func hashTarget(thc *TargetHashCache, labelAndConfiguration LabelAndConfiguratio
 	target := configuredTarget.Target
 	switch target.GetType() {
 	case build.Target_SOURCE_FILE:
+		if thc.exclusionPolicy.ExcludesFile(label) {
+			return make([]byte, 0), nil
+		}
+		if identity, ok := thc.externalRepoIdentities[label.Repo]; ok && label.Repo != "" {
+			return identity, nil
+		}
 		absolutePath := AbsolutePath(target)
 		hash, err := thc.fileHashCache.Hash(absolutePath)
 		if err != nil {
@@ -536,7 +774,11 @@ func hashTarget(thc *TargetHashCache, labelAndConfiguration LabelAndConfiguratio
 			return nil, fmt.Errorf("failed to parse generated file generating rule label %s: %w", *target.GeneratedFile.GeneratingRule, err)
 		}
 		writeLabel(hasher, generatingLabel)
-		hash, err := thc.Hash(LabelAndConfiguration{Label: generatingLabel, Configuration: configuration})
+		generatingLabelAndConfiguration := LabelAndConfiguration{Label: generatingLabel, Configuration: configuration}
+		if thc.isBrokenDependency(labelAndConfiguration, generatingLabelAndConfiguration) {
+			return hasher.Sum(nil), nil
+		}
+		hash, err := thc.hashWithHashedDependencies(generatingLabelAndConfiguration)
 		if err != nil {
 			return nil, err
 		}
@@ -558,14 +800,16 @@ func hashRule(thc *TargetHashCache, rule *build.Rule, configuration *analysis.Co
 	hasher.Write([]byte(thc.bazelRelease))
 	// Hash own attributes
 	hasher.Write([]byte(rule.GetRuleClass()))
-	hasher.Write([]byte(rule.GetSkylarkEnvironmentHashCode()))
+	if !thc.exclusionPolicy.ExcludesRuleImplementation(rule.GetRuleClass()) {
+		hasher.Write([]byte(rule.GetSkylarkEnvironmentHashCode()))
+	}
 	hasher.Write([]byte(configuration.GetChecksum()))
 
 	// TODO: Consider using `$internal_attr_hash` from https://github.com/bazelbuild/bazel/blob/6971b016f1e258e3bb567a0f9fe7a88ad565d8f2/src/main/java/com/google/devtools/build/lib/query2/query/output/SyntheticAttributeHashCalculator.java
 	// rather than hashing attributes ourselves.
 	// On the plus side, this builds in some heuristics from Bazel (e.g. ignoring `generator_location`).
 	// On the down side, it would even further decouple our "hashing" and "diffing" procedures.
-	for _, attr := range rule.GetAttribute() {
+	for _, attr := range thc.hashedAttributes(rule) {
 		normalizedAttribute := thc.AttributeForSerialization(attr)
 
 		protoBytes, err := proto.Marshal(normalizedAttribute)
@@ -586,7 +830,7 @@ func hashRule(thc *TargetHashCache, rule *build.Rule, configuration *analysis.Co
 	for _, ruleInputLabelAndConfigurations := range labelsAndConfigurations {
 		for _, ruleInputConfiguration := range ruleInputLabelAndConfigurations.Configurations {
 			ruleInputLabel := ruleInputLabelAndConfigurations.Label
-			ruleInputHash, err := thc.Hash(LabelAndConfiguration{Label: ruleInputLabel, Configuration: ruleInputConfiguration})
+			ruleInputHash, err := thc.hashWithHashedDependencies(LabelAndConfiguration{Label: ruleInputLabel, Configuration: ruleInputConfiguration})
 			if err != nil {
 				return nil, fmt.Errorf("failed to hash configuredRuleInput %s %s which is a dependency of %s %s: %w", ruleInputLabel, ruleInputConfiguration, rule.GetName(), configuration.GetChecksum(), err)
 			}
@@ -597,10 +841,83 @@ func hashRule(thc *TargetHashCache, rule *build.Rule, configuration *analysis.Co
 		}
 	}
 
+	// Hash resolved toolchains
+	resolvedToolchains := thc.resolvedToolchainsOf(labelsAndConfigurations)
+	for _, toolchainType := range sortedToolchainTypes(resolvedToolchains, nil) {
+		hasher.Write([]byte(toolchainType))
+		for _, toolchain := range resolvedToolchains[toolchainType] {
+			hasher.Write([]byte(toolchain))
+		}
+	}
+
 	return hasher.Sum(nil), nil
 }
 
 func getConfiguredRuleInputs(thc *TargetHashCache, rule *build.Rule, ownConfiguration Configuration) ([]LabelAndConfigurations, error) {
+	candidates, err := ruleInputCandidates(thc, rule, ownConfiguration)
+	if err != nil {
+		return nil, err
+	}
+	if thc.bazelVersionSupportsConfiguredRuleInputs {
+		return candidates, nil
+	}
+	labelsAndConfigurations := make([]LabelAndConfigurations, 0, len(candidates))
+	for _, candidate := range candidates {
+		labelAndConfigurations := LabelAndConfigurations{
+			Label: candidate.Label,
+		}
+		for _, configuration := range candidate.Configurations {
+			if _, err := thc.hashWithHashedDependencies(LabelAndConfiguration{Label: candidate.Label, Configuration: configuration}); err != nil {
+				if errors.Is(err, labelNotFound) {
+					// Two issues (so far) have been found which lead to targets being listed in
+					// ruleInputs but not in the output of a deps query:
+					//
+					// cquery doesn't filter ruleInputs according to used configurations, which means
+					// targets may appear in a Target's ruleInputs even though they weren't returned by
+					// a transitive `deps` cquery.
+					// Assume that a missing target should have been pruned, and that we should ignore it.
+					// See https://github.com/bazelbuild/bazel/issues/14610
+					//
+					// Some targets are also just sometimes missing for reasons we don't yet know.
+					// See https://github.com/bazelbuild/bazel/issues/14617
+					continue
+				}
+				return nil, err
+			}
+			labelAndConfigurations.Configurations = append(labelAndConfigurations.Configurations, configuration)
+		}
+		labelsAndConfigurations = append(labelsAndConfigurations, labelAndConfigurations)
+	}
+	return labelsAndConfigurations, nil
+}
+
+// ruleInputCandidates returns the rule inputs of rule, in the configurations they may be configured
+// in, without hashing them. Dependencies ignored to break dependency cycles are omitted.
+// When configured rule inputs aren't supported, some candidates may not be known to the
+// TargetHashCache, and should be ignored.
+func ruleInputCandidates(thc *TargetHashCache, rule *build.Rule, ownConfiguration Configuration) ([]LabelAndConfigurations, error) {
+	candidates, err := unfilteredRuleInputCandidates(thc, rule, ownConfiguration)
+	if err != nil || len(thc.brokenDependencies) == 0 {
+		return candidates, err
+	}
+	ruleLabel, err := thc.ParseCanonicalLabel(rule.GetName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rule label %s: %w", rule.GetName(), err)
+	}
+	from := LabelAndConfiguration{Label: ruleLabel, Configuration: ownConfiguration}
+	for i, candidate := range candidates {
+		var configurations []Configuration
+		for _, configuration := range candidate.Configurations {
+			if !thc.isBrokenDependency(from, LabelAndConfiguration{Label: candidate.Label, Configuration: configuration}) {
+				configurations = append(configurations, configuration)
+			}
+		}
+		candidates[i].Configurations = configurations
+	}
+	return candidates, nil
+}
+
+func unfilteredRuleInputCandidates(thc *TargetHashCache, rule *build.Rule, ownConfiguration Configuration) ([]LabelAndConfigurations, error) {
 	labelsAndConfigurations := make([]LabelAndConfigurations, 0)
 	if thc.bazelVersionSupportsConfiguredRuleInputs {
 		for _, configuredRuleInput := range rule.ConfiguredRuleInput {
@@ -630,9 +947,6 @@ func getConfiguredRuleInputs(thc *TargetHashCache, rule *build.Rule, ownConfigur
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse ruleInput label %s: %w", ruleInputLabelString, err)
 			}
-			labelAndConfigurations := LabelAndConfigurations{
-				Label: ruleInputLabel,
-			}
 			var depConfigurations []Configuration
 			// Aliases don't transition, and we've seen aliases expanding across configurations cause dependency cycles for nogo targets.
 			if rule.GetRuleClass() == "alias" {
@@ -655,27 +969,10 @@ func getConfiguredRuleInputs(thc *TargetHashCache, rule *build.Rule, ownConfigur
 			} else {
 				depConfigurations = thc.KnownConfigurations(ruleInputLabel).SortedSlice()
 			}
-			for _, configuration := range depConfigurations {
-				if _, err := thc.Hash(LabelAndConfiguration{Label: ruleInputLabel, Configuration: configuration}); err != nil {
-					if errors.Is(err, labelNotFound) {
-						// Two issues (so far) have been found which lead to targets being listed in
-						// ruleInputs but not in the output of a deps query:
-						//
-						// cquery doesn't filter ruleInputs according to used configurations, which means
-						// targets may appear in a Target's ruleInputs even though they weren't returned by
-						// a transitive `deps` cquery.
-						// Assume that a missing target should have been pruned, and that we should ignore it.
-						// See https://github.com/bazelbuild/bazel/issues/14610
-						//
-						// Some targets are also just sometimes missing for reasons we don't yet know.
-						// See https://github.com/bazelbuild/bazel/issues/14617
-						continue
-					}
-					return nil, err
-				}
-				labelAndConfigurations.Configurations = append(labelAndConfigurations.Configurations, configuration)
-			}
-			labelsAndConfigurations = append(labelsAndConfigurations, labelAndConfigurations)
+			labelsAndConfigurations = append(labelsAndConfigurations, LabelAndConfigurations{
+				Label:          ruleInputLabel,
+				Configurations: depConfigurations,
+			})
 		}
 	}
 	return labelsAndConfigurations, nil
@@ -684,6 +981,12 @@ func getConfiguredRuleInputs(thc *TargetHashCache, rule *build.Rule, ownConfigur
 type fileHashCache struct {
 	cacheLock sync.Mutex
 	cache     map[string]*cacheEntry
+
+	// store optionally persists digests across invocations. It may be nil.
+	store *FileDigestStore
+
+	// phase records the files read while hashing. It may be nil.
+	phase *ProgressPhase
 }
 
 type cacheEntry struct {
@@ -718,6 +1021,11 @@ func (hc *fileHashCache) Hash(path string) ([]byte, error) {
 			return nil, err
 		}
 
+		if digest, ok := hc.store.Lookup(path, info); ok {
+			entry.hash = digest
+			return entry.hash, nil
+		}
+
 		// Only record the user permissions, and only the execute bit:
 		// - group and others permissions differences don't affect the build and are not tracked by git. This means that
 		//   a file created as 0775 by a script and then added to git might show up as 0755 when performing a
@@ -730,10 +1038,13 @@ func (hc *fileHashCache) Hash(path string) ([]byte, error) {
 		}
 
 		// Hash the content of the file
-		if _, err := io.Copy(hasher, file); err != nil {
+		n, err := io.Copy(hasher, file)
+		if err != nil {
 			return nil, err
 		}
+		hc.phase.AddFile(n)
 		entry.hash = hasher.Sum(nil)
+		hc.store.Record(path, info, entry.hash)
 	}
 	return entry.hash, nil
 }
@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// HashDumpVersion is the version of the HashDump format written by this version of
+// target-determinator. It is bumped whenever the format, or the way hashes are computed, changes
+// incompatibly.
+const HashDumpVersion = 1
+
+// HashDump records the hashes of the targets matching a pattern at a single revision, so that
+// revisions can be compared later without re-running Bazel.
+type HashDump struct {
+	// Version is the HashDumpVersion the dump was written with.
+	Version int `json:"version"`
+	// Revision is the git sha the hashes were computed at.
+	Revision string `json:"revision"`
+	// BazelRelease is the Bazel release which was used to compute the hashes.
+	BazelRelease string `json:"bazel_release"`
+	// TargetPattern is the pattern of targets which were hashed.
+	TargetPattern string `json:"target_pattern"`
+	// Targets holds one entry per matching label and configuration, sorted by label and then configuration.
+	Targets []HashDumpTarget `json:"targets"`
+}
+
+// HashDumpTarget is the hash of a single configured target.
+type HashDumpTarget struct {
+	Label         string `json:"label"`
+	Configuration string `json:"configuration"`
+	// Hash is the hex-encoded hash of the configured target.
+	Hash string `json:"hash"`
+}
+
+// ComputeHashDump computes the hashes of all targets matching targets at rev.
+func ComputeHashDump(context *Context, rev LabelledGitRev, targets TargetsList) (*HashDump, error) {
+	queryResults, err := fullyProcessRevision(context, rev, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &HashDump{
+		Version:       HashDumpVersion,
+		Revision:      rev.GitRevision.Sha,
+		BazelRelease:  queryResults.BazelRelease,
+		TargetPattern: targets.String(),
+	}
+	for _, l := range queryResults.MatchingTargets.Labels() {
+		for _, configuration := range queryResults.MatchingTargets.ConfigurationsFor(l) {
+			hash, err := queryResults.TargetHashCache.Hash(LabelAndConfiguration{Label: l, Configuration: configuration})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get hash of %s in configuration %s: %w", l, configuration, err)
+			}
+			dump.Targets = append(dump.Targets, HashDumpTarget{
+				Label:         l.String(),
+				Configuration: configuration.String(),
+				Hash:          hex.EncodeToString(hash),
+			})
+		}
+	}
+	return dump, nil
+}
+
+// WriteHashDump writes dump to w as JSON.
+func WriteHashDump(w io.Writer, dump *HashDump) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(dump); err != nil {
+		return fmt.Errorf("failed to write hash dump: %w", err)
+	}
+	return nil
+}
+
+// ReadHashDump reads a HashDump written by WriteHashDump, failing if it was written in an
+// incompatible version.
+func ReadHashDump(r io.Reader) (*HashDump, error) {
+	var dump HashDump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return nil, fmt.Errorf("failed to parse hash dump: %w", err)
+	}
+	if dump.Version != HashDumpVersion {
+		return nil, fmt.Errorf("hash dump has version %d but only version %d is supported", dump.Version, HashDumpVersion)
+	}
+	return &dump, nil
+}
+
+// QueryResults reconstructs QueryResults from the dump, whose TargetHashCache serves the recorded hashes.
+// TransitiveConfiguredTargets is not available, so differences can't be explained.
+func (d *HashDump) QueryResults() (*QueryResults, error) {
+	normalizer := Normalizer{}
+	labels := make([]label.Label, 0, len(d.Targets))
+	labelsToConfigurations := make(map[label.Label][]Configuration)
+	hashes := make(map[string][]byte, len(d.Targets))
+	for _, target := range d.Targets {
+		l, err := normalizer.ParseCanonicalLabel(target.Label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", target.Label, err)
+		}
+		hash, err := hex.DecodeString(target.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hash of %s: %w", target.Label, err)
+		}
+		if _, ok := labelsToConfigurations[l]; !ok {
+			labels = append(labels, l)
+		}
+		configuration := NormalizeConfiguration(target.Configuration)
+		labelsToConfigurations[l] = append(labelsToConfigurations[l], configuration)
+		hashes[l.String()+"\x00"+configuration.String()] = hash
+	}
+
+	processedLabelsToConfigurations := make(map[label.Label]*ss.SortedSet[Configuration], len(labelsToConfigurations))
+	for l, configurations := range labelsToConfigurations {
+		processedLabelsToConfigurations[l] = ss.NewSortedSetFn(configurations, ConfigurationLess)
+	}
+
+	queryResults := &QueryResults{
+		MatchingTargets: &MatchingTargets{
+			labels:                 ss.NewSortedSetFn(labels, CompareLabels),
+			labelsToConfigurations: processedLabelsToConfigurations,
+		},
+		TransitiveConfiguredTargets: nil,
+		TargetHashCache:             NewTargetHashCache(nil, &normalizer, d.BazelRelease),
+		BazelRelease:                d.BazelRelease,
+	}
+	if err := queryResults.TargetHashCache.RestoreHashes(hashes); err != nil {
+		return nil, fmt.Errorf("failed to restore hashes from hash dump: %w", err)
+	}
+	return queryResults, nil
+}
+
+// DiffHashDumps calls callback once for each target in after which is affected relative to before.
+// Differences are never computed, as dumps don't contain enough information to explain them.
+func DiffHashDumps(before *HashDump, after *HashDump, callback WalkCallback) error {
+	if before.TargetPattern != after.TargetPattern {
+		log.Printf("WARN: Comparing hash dumps of different target patterns (%s and %s) - targets only matched before won't be reported", before.TargetPattern, after.TargetPattern)
+	}
+	beforeResults, err := before.QueryResults()
+	if err != nil {
+		return fmt.Errorf("failed to load before hash dump: %w", err)
+	}
+	afterResults, err := after.QueryResults()
+	if err != nil {
+		return fmt.Errorf("failed to load after hash dump: %w", err)
+	}
+	for _, l := range afterResults.MatchingTargets.Labels() {
+		if err := DiffSingleLabel(beforeResults, afterResults, false, l, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
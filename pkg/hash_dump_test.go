@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func TestHashDumpRoundTrip(t *testing.T) {
+	dump := &HashDump{
+		Version:       HashDumpVersion,
+		Revision:      "0123456789abcdef",
+		BazelRelease:  "release 7.4.1",
+		TargetPattern: "//...",
+		Targets: []HashDumpTarget{
+			{Label: "//HelloWorld:HelloWorld", Configuration: configurationChecksum, Hash: "deadbeef"},
+		},
+	}
+	var buf bytes.Buffer
+	if err := WriteHashDump(&buf, dump); err != nil {
+		t.Fatalf("WriteHashDump failed: %v", err)
+	}
+	got, err := ReadHashDump(&buf)
+	if err != nil {
+		t.Fatalf("ReadHashDump failed: %v", err)
+	}
+	if !reflect.DeepEqual(dump, got) {
+		t.Errorf("round-tripped dump differs: want %v got %v", dump, got)
+	}
+
+	if _, err := ReadHashDump(strings.NewReader(`{"version": 0}`)); err == nil {
+		t.Error("expected error reading dump with unsupported version")
+	}
+}
+
+func TestDiffHashDumps(t *testing.T) {
+	const otherConfiguration = "1111111111111111111111111111111111111111111111111111111111111111"
+	before := &HashDump{
+		Version:      HashDumpVersion,
+		BazelRelease: "release 7.4.1",
+		Targets: []HashDumpTarget{
+			{Label: "//:changed", Configuration: configurationChecksum, Hash: "01"},
+			{Label: "//:new_configuration", Configuration: configurationChecksum, Hash: "01"},
+			{Label: "//:removed", Configuration: configurationChecksum, Hash: "01"},
+			{Label: "//:unchanged", Configuration: configurationChecksum, Hash: "01"},
+		},
+	}
+	after := &HashDump{
+		Version:      HashDumpVersion,
+		BazelRelease: "release 7.4.1",
+		Targets: []HashDumpTarget{
+			{Label: "//:added", Configuration: configurationChecksum, Hash: "01"},
+			{Label: "//:changed", Configuration: configurationChecksum, Hash: "02"},
+			{Label: "//:new_configuration", Configuration: otherConfiguration, Hash: "01"},
+			{Label: "//:unchanged", Configuration: configurationChecksum, Hash: "01"},
+		},
+	}
+
+	var affected []string
+	err := DiffHashDumps(before, after, func(l label.Label, differences []Difference, _ *analysis.ConfiguredTarget) {
+		if differences != nil {
+			t.Errorf("expected no differences to be computed for %s, got %v", l, differences)
+		}
+		affected = append(affected, l.String())
+	})
+	if err != nil {
+		t.Fatalf("DiffHashDumps failed: %v", err)
+	}
+	want := []string{"//:added", "//:changed", "//:new_configuration"}
+	if !reflect.DeepEqual(want, affected) {
+		t.Errorf("wrong affected targets: want %v got %v", want, affected)
+	}
+}
@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// HashExclusionPolicy describes inputs which should not contribute to the hash of a target, because
+// changes to them are known not to affect the outputs of building or testing it.
+//
+// It is typically loaded from a JSON file, e.g.:
+//
+//	{
+//	  "attributes": [
+//	    {"name": "visibility"},
+//	    {"name": "tags", "rule_classes": ["java_library"]}
+//	  ],
+//	  "rule_implementation_rule_classes": ["my_lint_rule"],
+//	  "files": ["docs/**", "**/*.md"]
+//	}
+//
+// A policy may also be built in Go, in which case its globs are compiled when they are first used.
+// A nil *HashExclusionPolicy excludes nothing.
+type HashExclusionPolicy struct {
+	// Attributes lists attributes whose values are ignored.
+	Attributes []AttributeExclusion `json:"attributes,omitempty"`
+	// RuleImplementationRuleClasses lists rule classes for which changes to the rule implementation
+	// (i.e. the .bzl files defining the rule) are ignored.
+	RuleImplementationRuleClasses []string `json:"rule_implementation_rule_classes,omitempty"`
+	// Files lists globs of source files whose contents are ignored. Globs are matched against the
+	// path of the file relative to the root of the main repository, and support `*`, `?` and `**`.
+	// Source files in external repositories are never excluded.
+	Files []string `json:"files,omitempty"`
+
+	compileFileGlobsOnce sync.Once
+	fileGlobs            []*regexp.Regexp
+}
+
+// AttributeExclusion identifies an attribute whose value should be ignored when hashing.
+type AttributeExclusion struct {
+	// Name is the name of the attribute, e.g. "visibility".
+	Name string `json:"name"`
+	// RuleClasses restricts the exclusion to rules of these classes. If empty, the attribute is
+	// ignored for all rule classes.
+	RuleClasses []string `json:"rule_classes,omitempty"`
+}
+
+// LoadHashExclusionPolicy reads a HashExclusionPolicy from a JSON file.
+func LoadHashExclusionPolicy(path string) (*HashExclusionPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash exclusion policy: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var policy HashExclusionPolicy
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("failed to parse hash exclusion policy %s: %w", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid hash exclusion policy %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+func (p *HashExclusionPolicy) validate() error {
+	for _, glob := range p.Files {
+		if _, err := globToRegexp(glob); err != nil {
+			return fmt.Errorf("invalid file glob %q: %w", glob, err)
+		}
+	}
+	for _, attribute := range p.Attributes {
+		if attribute.Name == "" {
+			return fmt.Errorf("attribute exclusions must have a name")
+		}
+	}
+	return nil
+}
+
+// HashKey returns a digest of the policy, so that results computed under different policies aren't
+// confused in the results cache.
+func (p *HashExclusionPolicy) HashKey() string {
+	if p == nil {
+		return ""
+	}
+	data, _ := json.Marshal(p)
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// ExcludesAttribute returns whether the named attribute of a rule of class ruleClass should be ignored.
+func (p *HashExclusionPolicy) ExcludesAttribute(ruleClass string, attributeName string) bool {
+	if p == nil {
+		return false
+	}
+	for _, attribute := range p.Attributes {
+		if attribute.Name != attributeName {
+			continue
+		}
+		if len(attribute.RuleClasses) == 0 || containsString(attribute.RuleClasses, ruleClass) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludesRuleImplementation returns whether changes to the implementation of rules of class
+// ruleClass should be ignored.
+func (p *HashExclusionPolicy) ExcludesRuleImplementation(ruleClass string) bool {
+	if p == nil {
+		return false
+	}
+	return containsString(p.RuleImplementationRuleClasses, ruleClass)
+}
+
+// ExcludesFile returns whether the contents of the source file with the given label should be ignored.
+func (p *HashExclusionPolicy) ExcludesFile(l label.Label) bool {
+	if p == nil || l.Repo != "" {
+		return false
+	}
+	path := l.Name
+	if l.Pkg != "" {
+		path = l.Pkg + "/" + l.Name
+	}
+	for _, glob := range p.compiledFileGlobs() {
+		if glob.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// compiledFileGlobs returns the regular expressions matching Files. Globs which don't compile are
+// skipped; LoadHashExclusionPolicy rejects them.
+func (p *HashExclusionPolicy) compiledFileGlobs() []*regexp.Regexp {
+	p.compileFileGlobsOnce.Do(func() {
+		p.fileGlobs = make([]*regexp.Regexp, 0, len(p.Files))
+		for _, glob := range p.Files {
+			if re, err := globToRegexp(glob); err == nil {
+				p.fileGlobs = append(p.fileGlobs, re)
+			}
+		}
+	})
+	return p.fileGlobs
+}
+
+// globToRegexp converts a glob into an anchored regular expression.
+// `**` matches any number of path segments, `*` matches within a single segment, and `?` matches a
+// single non-separator character.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			i++
+			if i+1 < len(glob) && glob[i+1] == '/' {
+				// "**/" matches zero or more directories.
+				i++
+				sb.WriteString("(?:.*/)?")
+			} else {
+				sb.WriteString(".*")
+			}
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func containsString(slice []string, s string) bool {
+	for _, candidate := range slice {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"docs/**", "docs/README.md", true},
+		{"docs/**", "docs/a/b/c.md", true},
+		{"docs/**", "src/docs/README.md", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "a/b/README.md", true},
+		{"**/*.md", "a/b/README.mdx", false},
+		{"*.md", "a/README.md", false},
+		{"HelloWorld/?.txt", "HelloWorld/a.txt", true},
+		{"HelloWorld/?.txt", "HelloWorld/ab.txt", false},
+		{"a.b", "axb", false},
+	} {
+		re, err := globToRegexp(tc.glob)
+		if err != nil {
+			t.Fatalf("globToRegexp(%q) failed: %v", tc.glob, err)
+		}
+		if got := re.MatchString(tc.path); got != tc.match {
+			t.Errorf("glob %q matching %q: want %v got %v", tc.glob, tc.path, tc.match, got)
+		}
+	}
+}
+
+func TestLoadHashExclusionPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	content := `{
+  "attributes": [{"name": "visibility"}, {"name": "tags", "rule_classes": ["java_library"]}],
+  "rule_implementation_rule_classes": ["my_rule"],
+  "files": ["docs/**"]
+}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadHashExclusionPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadHashExclusionPolicy failed: %v", err)
+	}
+
+	if !policy.ExcludesAttribute("java_binary", "visibility") {
+		t.Error("expected visibility to be excluded for all rule classes")
+	}
+	if !policy.ExcludesAttribute("java_library", "tags") {
+		t.Error("expected tags to be excluded for java_library")
+	}
+	if policy.ExcludesAttribute("java_binary", "tags") {
+		t.Error("expected tags not to be excluded for java_binary")
+	}
+	if !policy.ExcludesRuleImplementation("my_rule") || policy.ExcludesRuleImplementation("java_binary") {
+		t.Error("unexpected rule implementation exclusions")
+	}
+	if !policy.ExcludesFile(mustParseLabel("//docs/guide:index.md")) {
+		t.Error("expected //docs/guide:index.md to be excluded")
+	}
+	if policy.ExcludesFile(mustParseLabel("@other//docs/guide:index.md")) {
+		t.Error("expected files in external repositories not to be excluded")
+	}
+
+	t.Run("rejects unknown fields", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte(`{"attribute": []}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadHashExclusionPolicy(path); err == nil {
+			t.Error("expected error for unknown field")
+		}
+	})
+
+	t.Run("nil policy excludes nothing", func(t *testing.T) {
+		var nilPolicy *HashExclusionPolicy
+		if nilPolicy.ExcludesAttribute("java_binary", "visibility") || nilPolicy.ExcludesRuleImplementation("my_rule") || nilPolicy.ExcludesFile(mustParseLabel("//docs:a.md")) {
+			t.Error("expected nil policy to exclude nothing")
+		}
+		if nilPolicy.HashKey() != "" {
+			t.Error("expected nil policy to have an empty hash key")
+		}
+	})
+}
+
+func TestHashExclusionPolicyAffectsHashes(t *testing.T) {
+	labelAndConfiguration := LabelAndConfiguration{
+		Label:         mustParseLabel("//HelloWorld:HelloWorld"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+	const bazelVersion = "release 5.1.1"
+	// Built in Go rather than loaded, so its file globs are compiled on first use.
+	policy := &HashExclusionPolicy{
+		Attributes: []AttributeExclusion{{Name: "visibility"}},
+		Files:      []string{"HelloWorld/Greeting.java"},
+	}
+
+	withVisibility := func(cqueryResult *analysis.CqueryResult, visibility string) *analysis.CqueryResult {
+		cqueryResult.Results[0].GetTarget().GetRule().Attribute = []*build.Attribute{
+			{
+				Name:            proto.String("visibility"),
+				Type:            build.Attribute_STRING_LIST.Enum(),
+				StringListValue: []string{visibility},
+			},
+		}
+		return cqueryResult
+	}
+
+	hash := func(t *testing.T, cqueryResult *analysis.CqueryResult, policy *HashExclusionPolicy) []byte {
+		thc := parseResult(t, cqueryResult, bazelVersion)
+		thc.UseHashExclusionPolicy(policy)
+		hash, err := thc.Hash(labelAndConfiguration)
+		if err != nil {
+			t.Fatalf("Failed to hash: %v", err)
+		}
+		return hash
+	}
+
+	t.Run("excluded attribute", func(t *testing.T) {
+		_, cqueryResult := layoutProject(t)
+		public := hash(t, withVisibility(cqueryResult, "//visibility:public"), policy)
+		private := hash(t, withVisibility(cqueryResult, "//visibility:private"), policy)
+		if !areHashesEqual(public, private) {
+			t.Errorf("Wanted hashes to be equal when only an excluded attribute changed: %v vs %v", hex.EncodeToString(public), hex.EncodeToString(private))
+		}
+
+		public = hash(t, withVisibility(cqueryResult, "//visibility:public"), nil)
+		private = hash(t, withVisibility(cqueryResult, "//visibility:private"), nil)
+		if areHashesEqual(public, private) {
+			t.Errorf("Wanted hashes to differ without a policy but were same: %v", hex.EncodeToString(public))
+		}
+	})
+
+	t.Run("excluded file", func(t *testing.T) {
+		projectDir, cqueryResult := layoutProject(t)
+		original := hash(t, cqueryResult, policy)
+		if err := os.WriteFile(filepath.Join(projectDir, "Greeting.java"), []byte("Not valid java!"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		changed := hash(t, cqueryResult, policy)
+		if !areHashesEqual(original, changed) {
+			t.Errorf("Wanted hashes to be equal when only an excluded file changed: %v vs %v", hex.EncodeToString(original), hex.EncodeToString(changed))
+		}
+	})
+}
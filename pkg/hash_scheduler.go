@@ -0,0 +1,317 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+)
+
+// DefaultHashingParallelism is the number of configured targets hashed concurrently if no
+// parallelism is configured.
+// Workers never wait for each other, so more workers than CPUs only help when reading files is slow.
+func DefaultHashingParallelism() int {
+	return runtime.NumCPU()
+}
+
+// hashNode is a configured target to be hashed by hashInDependencyOrder.
+type hashNode struct {
+	labelAndConfiguration LabelAndConfiguration
+	// isRoot is whether the hash of this node was requested, rather than only being a dependency.
+	isRoot bool
+	// pendingDependencies is the number of dependencies of this node which haven't been hashed yet.
+	pendingDependencies atomic.Int32
+	dependencies        []*hashNode
+	dependents          []*hashNode
+}
+
+// dependencyEdge is a dependency of one configured target on another.
+type dependencyEdge struct {
+	from LabelAndConfiguration
+	to   LabelAndConfiguration
+}
+
+func (thc *TargetHashCache) isBrokenDependency(from LabelAndConfiguration, to LabelAndConfiguration) bool {
+	_, ok := thc.brokenDependencies[dependencyEdge{from: from, to: to}]
+	return ok
+}
+
+// hashInDependencyOrder computes the hashes of roots, and of everything they transitively depend on,
+// using parallelism workers, and returns how many configured targets were hashed.
+// Each configured target is only hashed once all of its dependencies have been hashed, so hashing it
+// never needs to wait on (or recurse into) the hashing of its dependencies.
+//
+// If reportProgress is set, hashing is reported as a phase of the TargetHashCache's progress
+// reporter. Only one call at a time may report progress, as the files read are attributed to the
+// phase through the shared fileHashCache.
+func (thc *TargetHashCache) hashInDependencyOrder(roots []LabelAndConfiguration, parallelism int, reportProgress bool) (int, error) {
+	if parallelism <= 0 {
+		parallelism = DefaultHashingParallelism()
+	}
+
+	nodes, err := thc.dependencyGraph(roots)
+	if err != nil {
+		return 0, err
+	}
+	if len(nodes) == 0 {
+		return 0, nil
+	}
+	if err := thc.resolveDependencyCycles(nodes); err != nil {
+		return 0, err
+	}
+
+	var phase *ProgressPhase
+	if reportProgress {
+		phase = thc.progress.StartPhase("Hashing", "targets", int64(len(nodes)))
+		thc.fileHashCache.phase = phase
+		defer func() {
+			thc.fileHashCache.phase = nil
+			phase.Finish()
+		}()
+	}
+
+	// Every node is sent on ready exactly once, so it never blocks.
+	ready := make(chan *hashNode, len(nodes))
+	for _, node := range nodes {
+		if node.pendingDependencies.Load() == 0 {
+			ready <- node
+		}
+	}
+
+	var remaining atomic.Int64
+	remaining.Store(int64(len(nodes)))
+	var failed atomic.Bool
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range ready {
+				// Once hashing has failed, nodes are still drained (without hashing them) so that
+				// every worker terminates.
+				if !failed.Load() {
+					if _, err := thc.hashWithHashedDependencies(node.labelAndConfiguration); err != nil && (node.isRoot || !errors.Is(err, labelNotFound)) {
+						// A dependency which can't be found may be ignored by its dependents, which
+						// will report the error themselves if it matters.
+						once.Do(func() { firstErr = err })
+						failed.Store(true)
+					}
+				}
+				phase.Add(1)
+				for _, dependent := range node.dependents {
+					if dependent.pendingDependencies.Add(-1) == 0 {
+						ready <- dependent
+					}
+				}
+				if remaining.Add(-1) == 0 {
+					close(ready)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return len(nodes), nil
+}
+
+// dependencyGraph returns a node for each of roots and everything they transitively depend on,
+// whose pendingDependencies and dependents are populated.
+func (thc *TargetHashCache) dependencyGraph(roots []LabelAndConfiguration) (map[LabelAndConfiguration]*hashNode, error) {
+	nodes := make(map[LabelAndConfiguration]*hashNode)
+	var toVisit []*hashNode
+	nodeFor := func(labelAndConfiguration LabelAndConfiguration) *hashNode {
+		node, ok := nodes[labelAndConfiguration]
+		if !ok {
+			node = &hashNode{labelAndConfiguration: labelAndConfiguration}
+			nodes[labelAndConfiguration] = node
+			toVisit = append(toVisit, node)
+		}
+		return node
+	}
+	for _, root := range roots {
+		nodeFor(root).isRoot = true
+	}
+
+	for len(toVisit) > 0 {
+		node := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+
+		dependencies, err := thc.dependencies(node.labelAndConfiguration)
+		if err != nil {
+			return nil, err
+		}
+		for _, dependency := range dependencies {
+			dependencyNode := nodeFor(dependency)
+			node.dependencies = append(node.dependencies, dependencyNode)
+			dependencyNode.dependents = append(dependencyNode.dependents, node)
+		}
+		node.pendingDependencies.Store(int32(len(dependencies)))
+	}
+	return nodes, nil
+}
+
+// dependencies returns the distinct configured targets whose hashes are needed to hash
+// labelAndConfiguration, which are known to the TargetHashCache.
+func (thc *TargetHashCache) dependencies(labelAndConfiguration LabelAndConfiguration) ([]LabelAndConfiguration, error) {
+	configuredTarget, ok := thc.context[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+	if !ok {
+		// Hashing will fail (or the target will be ignored) without needing any dependencies.
+		return nil, nil
+	}
+
+	var candidates []LabelAndConfiguration
+	target := configuredTarget.GetTarget()
+	switch target.GetType() {
+	case build.Target_RULE:
+		ruleInputs, err := ruleInputCandidates(thc, target.GetRule(), labelAndConfiguration.Configuration)
+		if err != nil {
+			return nil, err
+		}
+		for _, ruleInput := range ruleInputs {
+			for _, configuration := range ruleInput.Configurations {
+				candidates = append(candidates, LabelAndConfiguration{Label: ruleInput.Label, Configuration: configuration})
+			}
+		}
+	case build.Target_GENERATED_FILE:
+		generatingLabel, err := thc.ParseCanonicalLabel(target.GetGeneratedFile().GetGeneratingRule())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse generated file generating rule label %s: %w", target.GetGeneratedFile().GetGeneratingRule(), err)
+		}
+		candidates = append(candidates, LabelAndConfiguration{Label: generatingLabel, Configuration: labelAndConfiguration.Configuration})
+	}
+
+	seen := make(map[LabelAndConfiguration]struct{}, len(candidates))
+	dependencies := make([]LabelAndConfiguration, 0, len(candidates))
+	for _, candidate := range candidates {
+		if _, ok := seen[candidate]; ok {
+			continue
+		}
+		seen[candidate] = struct{}{}
+		if _, ok := thc.context[candidate.Label][candidate.Configuration]; ok {
+			dependencies = append(dependencies, candidate)
+		}
+	}
+	return dependencies, nil
+}
+
+// resolveDependencyCycles returns an error describing a dependency cycle if nodes contain one, which
+// would otherwise stop hashing from completing.
+// If dependency cycle breaking is in use, each cycle is instead broken by ignoring the dependency
+// which closes it, when starting from the cycle's first configured target in label order.
+func (thc *TargetHashCache) resolveDependencyCycles(nodes map[LabelAndConfiguration]*hashNode) error {
+	for {
+		cycle := findDependencyCycle(nodes)
+		if cycle == nil {
+			return nil
+		}
+		if !thc.breakDependencyCycles {
+			return fmt.Errorf("found a dependency cycle: %s. Pass --break-dependency-cycles to hash anyway by ignoring one dependency of each cycle", formatDependencyCycle(cycle))
+		}
+		from := cycle[len(cycle)-2]
+		to := cycle[len(cycle)-1]
+		log.Printf("WARNING: Ignoring the dependency of %s on %s to break dependency cycle: %s", formatLabelAndConfiguration(from.labelAndConfiguration), formatLabelAndConfiguration(to.labelAndConfiguration), formatDependencyCycle(cycle))
+
+		if thc.brokenDependencies == nil {
+			thc.brokenDependencies = make(map[dependencyEdge]struct{})
+		}
+		thc.brokenDependencies[dependencyEdge{from: from.labelAndConfiguration, to: to.labelAndConfiguration}] = struct{}{}
+		from.dependencies = removeHashNode(from.dependencies, to)
+		to.dependents = removeHashNode(to.dependents, from)
+		from.pendingDependencies.Add(-1)
+	}
+}
+
+// findDependencyCycle returns a dependency cycle in nodes, starting and ending with the same node,
+// or nil if there are none. The same cycle is returned for the same nodes.
+func findDependencyCycle(nodes map[LabelAndConfiguration]*hashNode) []*hashNode {
+	// Find which nodes could never be hashed, by hashing nodes whose dependencies are hashed until
+	// no more can be.
+	pending := make(map[*hashNode]int32, len(nodes))
+	var ready []*hashNode
+	for _, node := range nodes {
+		pending[node] = node.pendingDependencies.Load()
+		if pending[node] == 0 {
+			ready = append(ready, node)
+		}
+	}
+	for len(ready) > 0 {
+		node := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		delete(pending, node)
+		for _, dependent := range node.dependents {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Every remaining node has a remaining dependency, so following remaining dependencies from any
+	// of them must eventually revisit a node.
+	var start *hashNode
+	for node := range pending {
+		if start == nil || lessLabelAndConfiguration(node.labelAndConfiguration, start.labelAndConfiguration) {
+			start = node
+		}
+	}
+	var path []*hashNode
+	indexInPath := make(map[*hashNode]int)
+	for node := start; ; {
+		if i, ok := indexInPath[node]; ok {
+			return append(path[i:], node)
+		}
+		indexInPath[node] = len(path)
+		path = append(path, node)
+		var next *hashNode
+		for _, dependency := range node.dependencies {
+			if _, remaining := pending[dependency]; remaining && (next == nil || lessLabelAndConfiguration(dependency.labelAndConfiguration, next.labelAndConfiguration)) {
+				next = dependency
+			}
+		}
+		node = next
+	}
+}
+
+func lessLabelAndConfiguration(l, r LabelAndConfiguration) bool {
+	if l.Label != r.Label {
+		return CompareLabels(l.Label, r.Label)
+	}
+	return ConfigurationLess(l.Configuration, r.Configuration)
+}
+
+func removeHashNode(nodes []*hashNode, toRemove *hashNode) []*hashNode {
+	for i, node := range nodes {
+		if node == toRemove {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+	return nodes
+}
+
+func formatDependencyCycle(cycle []*hashNode) string {
+	parts := make([]string, 0, len(cycle))
+	for _, node := range cycle {
+		parts = append(parts, formatLabelAndConfiguration(node.labelAndConfiguration))
+	}
+	return strings.Join(parts, " -> ")
+}
+
+func formatLabelAndConfiguration(labelAndConfiguration LabelAndConfiguration) string {
+	if labelAndConfiguration.Configuration.String() == "" {
+		return labelAndConfiguration.Label.String()
+	}
+	return fmt.Sprintf("%s (configuration %s)", labelAndConfiguration.Label, labelAndConfiguration.Configuration.String())
+}
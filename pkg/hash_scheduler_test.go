@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHashInDependencyOrder(t *testing.T) {
+	const bazelRelease = "release 5.1.1"
+	_, cqueryResult := layoutProject(t)
+	helloWorld := LabelAndConfiguration{
+		Label:         mustParseLabel("//HelloWorld:HelloWorld"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+
+	recursive := parseResult(t, cqueryResult, bazelRelease)
+	want, err := recursive.Hash(helloWorld)
+	if err != nil {
+		t.Fatalf("Failed to hash recursively: %v", err)
+	}
+
+	scheduled := parseResult(t, cqueryResult, bazelRelease)
+	hashed, err := scheduled.hashInDependencyOrder([]LabelAndConfiguration{helloWorld}, 2, false)
+	if err != nil {
+		t.Fatalf("hashInDependencyOrder failed: %v", err)
+	}
+	if hashed != 4 {
+		t.Errorf("expected the matching target and its 3 transitive dependencies to be hashed, got %d", hashed)
+	}
+	scheduled.Freeze()
+	got, err := scheduled.Hash(helloWorld)
+	if err != nil {
+		t.Fatalf("Expected hash to have been computed: %v", err)
+	}
+	if !areHashesEqual(want, got) {
+		t.Errorf("hashes differ: recursive %v scheduled %v", want, got)
+	}
+	greetingLib := LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:GreetingLib"), Configuration: helloWorld.Configuration}
+	if _, err := scheduled.Hash(greetingLib); err != nil {
+		t.Errorf("Expected hash of dependency to have been computed: %v", err)
+	}
+}
+
+func TestHashDoesNotReportProgress(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	thc := parseResult(t, cqueryResult, "release 5.1.1")
+	var progress bytes.Buffer
+	thc.UseProgressReporter(newProgressReporter(true, &progress))
+
+	// Hashing single targets on demand may happen concurrently, so mustn't share a progress phase.
+	var wg sync.WaitGroup
+	for _, name := range []string{"//HelloWorld:HelloWorld", "//HelloWorld:GreetingLib", "//HelloWorld:HelloWorld"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lbl := LabelAndConfiguration{Label: mustParseLabel(name), Configuration: NormalizeConfiguration(configurationChecksum)}
+			if _, err := thc.Hash(lbl); err != nil {
+				t.Errorf("Failed to hash %s: %v", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if progress.Len() != 0 {
+		t.Errorf("expected no progress to be reported, got %q", progress.String())
+	}
+}
+
+func TestHashInDependencyOrderDetectsCycles(t *testing.T) {
+	root := LabelAndConfiguration{Label: mustParseLabel("//:a"), Configuration: NormalizeConfiguration(configurationChecksum)}
+
+	_, err := cyclicTargetHashCache(t).hashInDependencyOrder([]LabelAndConfiguration{root}, 2, false)
+	if err == nil {
+		t.Fatalf("expected a dependency cycle error")
+	}
+	wantCycle := fmt.Sprintf("//:b (configuration %[1]s) -> //:c (configuration %[1]s) -> //:b (configuration %[1]s)", configurationChecksum)
+	if !strings.Contains(err.Error(), wantCycle) {
+		t.Errorf("expected error to contain the cycle %q, got %v", wantCycle, err)
+	}
+
+	// Hashing recursively must fail rather than deadlock.
+	if _, err := cyclicTargetHashCache(t).Hash(root); err == nil || !strings.Contains(err.Error(), "dependency cycle") {
+		t.Errorf("expected a dependency cycle error, got %v", err)
+	}
+}
+
+func TestHashInDependencyOrderBreaksCycles(t *testing.T) {
+	root := LabelAndConfiguration{Label: mustParseLabel("//:a"), Configuration: NormalizeConfiguration(configurationChecksum)}
+
+	hash := func() []byte {
+		thc := cyclicTargetHashCache(t)
+		thc.UseDependencyCycleBreaking()
+		if _, err := thc.hashInDependencyOrder([]LabelAndConfiguration{root}, 2, false); err != nil {
+			t.Fatalf("hashInDependencyOrder failed: %v", err)
+		}
+		thc.Freeze()
+		hash, err := thc.Hash(root)
+		if err != nil {
+			t.Fatalf("Expected hash to have been computed: %v", err)
+		}
+		return hash
+	}
+
+	if first, second := hash(), hash(); !areHashesEqual(first, second) {
+		t.Errorf("expected cycles to be broken deterministically, got hashes %v and %v", first, second)
+	}
+}
+
+// cyclicTargetHashCache returns a TargetHashCache in which //:a depends on //:b, which depends on
+// //:c, which depends on //:b.
+func cyclicTargetHashCache(t *testing.T) *TargetHashCache {
+	configuration := &analysis.Configuration{Checksum: configurationChecksum}
+	rule := func(name string, ruleInputs ...string) *analysis.ConfiguredTarget {
+		return &analysis.ConfiguredTarget{
+			Target: &build.Target{
+				Type: build.Target_RULE.Enum(),
+				Rule: &build.Rule{
+					Name:      proto.String(name),
+					RuleClass: proto.String("java_library"),
+					RuleInput: ruleInputs,
+				},
+			},
+			Configuration: configuration,
+		}
+	}
+	return parseResult(t, &analysis.CqueryResult{
+		Results: []*analysis.ConfiguredTarget{
+			rule("//:a", "//:b"),
+			rule("//:b", "//:c"),
+			rule("//:c", "//:b"),
+		},
+	}, "release 5.1.1")
+}
@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// HostFingerprint describes the properties of the machine running Bazel which may change which
+// targets are selected (e.g. through platform constraints or autodetected toolchains).
+// Results cached on machines with the same fingerprint may be shared between them.
+type HostFingerprint struct {
+	OS   string
+	Arch string
+	// Kernel is the kernel name and its major and minor version, e.g. "Linux 6.8", so that patch
+	// releases don't invalidate cached results.
+	Kernel string
+	// Libc is the flavour and version of libc on Linux, e.g. "glibc 2.35" or "musl".
+	Libc string
+	// BazelHostPlatform lists the constraint values of the platform Bazel detected for the host.
+	BazelHostPlatform []string
+}
+
+// hostPlatformConstraintsQueries are queries for the constraint values of Bazel's host platform,
+// which are tried in order, as the host platform's label depends on the Bazel version.
+var hostPlatformConstraintsQueries = []string{
+	"labels(constraint_values, labels(actual, @bazel_tools//tools:host_platform))",
+	"labels(constraint_values, @local_config_platform//:host)",
+}
+
+var kernelVersionRegex = regexp.MustCompile(`^(\S+) (\d+\.\d+)`)
+
+// memoizedHostFingerprint is the result of ComputeHostFingerprint.
+type memoizedHostFingerprint struct {
+	fingerprint HostFingerprint
+	err         error
+}
+
+// hostFingerprintCache memoizes ComputeHostFingerprint by workspace path and BazelCmd.
+var hostFingerprintCache = struct {
+	lock         sync.Mutex
+	fingerprints map[string]memoizedHostFingerprint
+}{fingerprints: make(map[string]memoizedHostFingerprint)}
+
+// ComputeHostFingerprint returns the HostFingerprint of the current machine, using bazelCmd in
+// workspacePath to find the host platform. The kernel and libc versions are logged and left empty if
+// they can't be determined. If the host platform can't be determined, an error is returned, as
+// results cached on machines with different host platforms couldn't be told apart.
+func ComputeHostFingerprint(workspacePath string, bazelCmd BazelCmd) (HostFingerprint, error) {
+	hostFingerprintCache.lock.Lock()
+	defer hostFingerprintCache.lock.Unlock()
+	memoKey := workspacePath + "\x00" + bazelCmd.HashKey()
+	if memoized, ok := hostFingerprintCache.fingerprints[memoKey]; ok {
+		return memoized.fingerprint, memoized.err
+	}
+
+	fingerprint := HostFingerprint{
+		OS:     runtime.GOOS,
+		Arch:   runtime.GOARCH,
+		Kernel: kernelVersion(),
+		Libc:   libcVersion(),
+	}
+	hostPlatform, err := bazelHostPlatformConstraints(workspacePath, bazelCmd)
+	if err != nil {
+		err = fmt.Errorf("failed to determine the Bazel host platform: %w", err)
+	} else {
+		fingerprint.BazelHostPlatform = hostPlatform
+	}
+
+	hostFingerprintCache.fingerprints[memoKey] = memoizedHostFingerprint{fingerprint: fingerprint, err: err}
+	return fingerprint, err
+}
+
+func kernelVersion() string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	output, err := exec.Command("uname", "-sr").Output()
+	if err != nil {
+		log.Printf("WARNING: Failed to determine the kernel version for the cache key: %v", err)
+		return ""
+	}
+	return normalizeKernelVersion(strings.TrimSpace(string(output)))
+}
+
+// normalizeKernelVersion reduces the output of `uname -sr` to the kernel name and its major and
+// minor version.
+func normalizeKernelVersion(unameOutput string) string {
+	if matches := kernelVersionRegex.FindStringSubmatch(unameOutput); matches != nil {
+		return matches[1] + " " + matches[2]
+	}
+	return unameOutput
+}
+
+func libcVersion() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	if output, err := exec.Command("getconf", "GNU_LIBC_VERSION").Output(); err == nil {
+		// e.g. "glibc 2.35"
+		return strings.TrimSpace(string(output))
+	}
+	if musl, _ := filepath.Glob("/lib/ld-musl-*"); len(musl) > 0 {
+		return "musl"
+	}
+	return "unknown"
+}
+
+func bazelHostPlatformConstraints(workspacePath string, bazelCmd BazelCmd) ([]string, error) {
+	var errs []string
+	for _, query := range hostPlatformConstraintsQueries {
+		var stdoutBuf, stderrBuf bytes.Buffer
+		result, err := bazelCmd.Execute(
+			BazelCmdConfig{Dir: workspacePath, Stdout: &stdoutBuf, Stderr: &stderrBuf},
+			nil, "query", "--output=label", query)
+		if result == 0 && err == nil {
+			// Query output is sorted, so is deterministic.
+			return strings.Fields(stdoutBuf.String()), nil
+		}
+		errs = append(errs, fmt.Sprintf("query %q failed: %v", query, err))
+	}
+	return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+}
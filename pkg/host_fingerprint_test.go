@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeKernelVersion(t *testing.T) {
+	for unameOutput, want := range map[string]string{
+		"Linux 6.8.0-45-generic": "Linux 6.8",
+		"Darwin 23.6.0":          "Darwin 23.6",
+		"FreeBSD 14.1-RELEASE":   "FreeBSD 14.1",
+		"Unknown":                "Unknown",
+	} {
+		if got := normalizeKernelVersion(unameOutput); got != want {
+			t.Errorf("normalizeKernelVersion(%q): want %q, got %q", unameOutput, want, got)
+		}
+	}
+}
+
+// hostPlatformBazelCmd is a fakeBazelCmd which answers queries for the host platform's constraints.
+type hostPlatformBazelCmd struct {
+	fakeBazelCmd
+	constraints []string
+}
+
+func (f hostPlatformBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	if command == "query" && strings.Contains(args[len(args)-1], "@bazel_tools//tools:host_platform") {
+		fmt.Fprintln(config.Stdout, strings.Join(f.constraints, "\n"))
+		return 0, nil
+	}
+	return f.fakeBazelCmd.Execute(config, startupArgs, command, args...)
+}
+
+func TestComputeHostFingerprint(t *testing.T) {
+	constraints := []string{"@platforms//cpu:x86_64", "@platforms//os:linux"}
+	fingerprint, err := ComputeHostFingerprint(t.TempDir(), hostPlatformBazelCmd{constraints: constraints})
+	if err != nil {
+		t.Fatalf("ComputeHostFingerprint failed: %v", err)
+	}
+	if fingerprint.OS != runtime.GOOS || fingerprint.Arch != runtime.GOARCH {
+		t.Errorf("unexpected OS and architecture: %+v", fingerprint)
+	}
+	if !reflect.DeepEqual(fingerprint.BazelHostPlatform, constraints) {
+		t.Errorf("want host platform %v, got %v", constraints, fingerprint.BazelHostPlatform)
+	}
+
+	if _, err := ComputeHostFingerprint(t.TempDir(), fakeBazelCmd{}); err == nil {
+		t.Errorf("expected an error when the host platform can't be found")
+	}
+}
+
+func TestComputeCacheKeyFailsWithoutHostPlatform(t *testing.T) {
+	ctx := &Context{
+		WorkspacePath:           t.TempDir(),
+		BazelCmd:                fakeBazelCmd{release: "release 7.0.0"},
+		CacheKeyHostFingerprint: true,
+	}
+	if _, err := ComputeCacheKey(ctx, "deadcafe", "//..."); err == nil {
+		t.Errorf("expected no cache key when the host platform can't be found")
+	}
+	ctx.CacheKeyHostFingerprint = false
+	if _, err := ComputeCacheKey(ctx, "deadcafe", "//..."); err != nil {
+		t.Errorf("expected a cache key when the host fingerprint isn't included, got %v", err)
+	}
+}
+
+func TestComputeCacheKeyIncludesHostFingerprint(t *testing.T) {
+	key := func(includeFingerprint bool, constraints ...string) string {
+		ctx := &Context{
+			WorkspacePath:           t.TempDir(),
+			BazelCmd:                hostPlatformBazelCmd{fakeBazelCmd: fakeBazelCmd{release: "release 7.0.0"}, constraints: constraints},
+			CacheKeyHostFingerprint: includeFingerprint,
+		}
+		cacheKey, err := ComputeCacheKey(ctx, "deadcafe", "//...")
+		if err != nil {
+			t.Fatalf("ComputeCacheKey failed: %v", err)
+		}
+		return cacheKey
+	}
+
+	if key(false, "@platforms//cpu:x86_64") != key(false, "@platforms//cpu:aarch64") {
+		t.Errorf("expected the host platform not to affect the cache key when the host fingerprint isn't included")
+	}
+	if key(true, "@platforms//cpu:x86_64") == key(true, "@platforms//cpu:aarch64") {
+		t.Errorf("expected the host platform to affect the cache key when the host fingerprint is included")
+	}
+	if key(true, "@platforms//cpu:x86_64") != key(true, "@platforms//cpu:x86_64") {
+		t.Errorf("expected the same host to produce the same cache key")
+	}
+}
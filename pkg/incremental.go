@@ -0,0 +1,290 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/common"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+// graphDefiningFilenames are the names of files whose contents may change the target graph, or how
+// it is configured, even if they aren't themselves source files in it.
+var graphDefiningFilenames = map[string]bool{
+	"BUILD":             true,
+	"BUILD.bazel":       true,
+	"WORKSPACE":         true,
+	"WORKSPACE.bazel":   true,
+	"WORKSPACE.bzlmod":  true,
+	"MODULE.bazel":      true,
+	"MODULE.bazel.lock": true,
+	"REPO.bazel":        true,
+	".bazelversion":     true,
+	".bazelignore":      true,
+}
+
+// graphDefiningSuffixes are the suffixes of the names of files which may change the target graph:
+// Starlark files (which may be loaded by BUILD files and other Starlark files), bazelrc files, and
+// segments of MODULE.bazel files added by include().
+var graphDefiningSuffixes = []string{".bzl", ".scl", ".bazelrc", ".MODULE.bazel"}
+
+// mayChangeTargetGraph returns whether changing the contents of the file at changedPath (relative
+// to the workspace root) may change the target graph, rather than only the hashes of source files.
+func mayChangeTargetGraph(changedPath string) bool {
+	base := path.Base(changedPath)
+	for _, suffix := range graphDefiningSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+	return graphDefiningFilenames[base]
+}
+
+// changedPath is a path reported by `git diff --name-status`, with the status of its change (e.g.
+// "M" if its contents were modified).
+type changedPath struct {
+	status string
+	path   string
+}
+
+// loadIncrementally checks out rev and, if it only differs from context.incrementalBaseRev in the
+// contents of source files in its target graph, returns QueryResults which reuse that graph, along
+// with the hashes of every configured target which doesn't depend on the changed source files.
+// Otherwise, it returns an error describing why the target graph may have changed.
+//
+// Like LoadIncompleteMetadata, it may change the git revision of the workspace to rev, and returns a
+// non-nil callback to clean up the worktree if it was created.
+func loadIncrementally(context *Context, rev LabelledGitRev) (*QueryResults, func(), error) {
+	base := context.incrementalBase
+	baseSha := context.incrementalBaseRev.GitRevision.Sha
+	if baseSha == "" {
+		return nil, func() {}, fmt.Errorf("it is the current working copy state")
+	}
+	if base.QueryError != nil {
+		return nil, func() {}, fmt.Errorf("querying it failed")
+	}
+	if base.TransitiveConfiguredTargets == nil || base.TargetHashCache.context == nil {
+		return nil, func() {}, fmt.Errorf("it was loaded from cache without its target graph, which is only cached with --cache-explanations")
+	}
+
+	revisionContext := *context
+	cleanupFunc, err := checkOutRevision(&revisionContext, rev)
+	if err != nil {
+		return nil, cleanupFunc, err
+	}
+
+	changes, err := gitDiffNameStatus(revisionContext.WorkspacePath, baseSha)
+	if err != nil {
+		return nil, cleanupFunc, err
+	}
+	untrackedFiles, err := runToLines(revisionContext.WorkspacePath, "git", "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, cleanupFunc, fmt.Errorf("failed to list untracked files: %w", err)
+	}
+	for _, untrackedFile := range untrackedFiles {
+		if !stringSliceContainsStartingWith(context.IgnoredFiles, common.NewRelPath(untrackedFile)) {
+			return nil, cleanupFunc, fmt.Errorf("%s is untracked", untrackedFile)
+		}
+	}
+
+	if err := checkExternalRepoFilesUnchanged(base.TargetHashCache, changes); err != nil {
+		return nil, cleanupFunc, err
+	}
+	changedSources, err := changedSourceFiles(base.TransitiveConfiguredTargets, changes, context.IgnoredFiles)
+	if err != nil {
+		return nil, cleanupFunc, err
+	}
+	queryInfo, err := rehashIncrementally(&revisionContext, base, changedSources)
+	return queryInfo, cleanupFunc, err
+}
+
+// gitDiffNameStatus returns the paths which differ between baseSha and the working copy at
+// workspacePath.
+func gitDiffNameStatus(workspacePath string, baseSha string) ([]changedPath, error) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	gitCmd := exec.Command("git", "diff", "--name-status", "--no-renames", "-z", baseSha)
+	gitCmd.Dir = workspacePath
+	gitCmd.Stdout = &stdoutBuf
+	gitCmd.Stderr = &stderrBuf
+	if err := gitCmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to diff against %s: %w. Stderr: %v", baseSha, err, stderrBuf.String())
+	}
+	return parseGitDiffNameStatusZ(stdoutBuf.String()), nil
+}
+
+// parseGitDiffNameStatusZ parses the output of `git diff --name-status --no-renames -z`, whose
+// records alternate between statuses and paths.
+func parseGitDiffNameStatusZ(output string) []changedPath {
+	records := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+	var changes []changedPath
+	for i := 0; i+1 < len(records); i += 2 {
+		changes = append(changes, changedPath{status: records[i], path: records[i+1]})
+	}
+	return changes
+}
+
+// checkExternalRepoFilesUnchanged returns an error if changes may change an external repository in
+// thc, because they include a file in the main repository which its definition references (e.g. a
+// patch, or a lockfile read by a module extension). Which files are referenced is only known if
+// external repositories were hashed by definition.
+func checkExternalRepoFilesUnchanged(thc *TargetHashCache, changes []changedPath) error {
+	if thc.externalRepoFiles == nil {
+		if len(thc.externalRepoIdentities) == 0 {
+			return fmt.Errorf("the files external repositories are defined by are only known with --external-repo-hash-strategy=%s", ExternalRepoHashStrategyDefinition)
+		}
+		return fmt.Errorf("it was loaded from a cache entry which doesn't record which files the identities of its external repositories depend on")
+	}
+	for _, change := range changes {
+		if _, ok := thc.externalRepoFiles[change.path]; ok {
+			return fmt.Errorf("%s is referenced by the definition of an external repository", change.path)
+		}
+	}
+	return nil
+}
+
+// changedSourceFiles returns the labels of the source files in graph whose contents were changed by
+// changes (other than those under ignoredFiles), sorted. It returns an error if any change may have
+// changed graph itself: if a file was added, deleted or changed type, or a changed file isn't a
+// source file of the main repository in graph, or may change the target graph by other means.
+func changedSourceFiles(graph map[label.Label]map[Configuration]*analysis.ConfiguredTarget, changes []changedPath, ignoredFiles []common.RelPath) ([]label.Label, error) {
+	changedPaths := make(map[string]struct{}, len(changes))
+	for _, change := range changes {
+		if stringSliceContainsStartingWith(ignoredFiles, common.NewRelPath(change.path)) {
+			continue
+		}
+		if change.status != "M" {
+			return nil, fmt.Errorf("%s wasn't only modified (git status %s)", change.path, change.status)
+		}
+		if mayChangeTargetGraph(change.path) {
+			return nil, fmt.Errorf("%s may change the target graph", change.path)
+		}
+		changedPaths[change.path] = struct{}{}
+	}
+
+	var changedSources []label.Label
+	for l, configuredTargets := range graph {
+		if l.Repo != "" {
+			continue
+		}
+		sourcePath := path.Join(l.Pkg, l.Name)
+		if _, ok := changedPaths[sourcePath]; !ok {
+			continue
+		}
+		for _, configuredTarget := range configuredTargets {
+			if configuredTarget.GetTarget().GetType() == build.Target_SOURCE_FILE {
+				changedSources = append(changedSources, l)
+				delete(changedPaths, sourcePath)
+				break
+			}
+		}
+	}
+	if len(changedPaths) > 0 {
+		unknownPaths := make([]string, 0, len(changedPaths))
+		for unknownPath := range changedPaths {
+			unknownPaths = append(unknownPaths, unknownPath)
+		}
+		sort.Strings(unknownPaths)
+		return nil, fmt.Errorf("%s isn't a source file in the target graph", strings.Join(unknownPaths, ", "))
+	}
+	sort.Slice(changedSources, func(i, j int) bool { return CompareLabels(changedSources[i], changedSources[j]) })
+	return changedSources, nil
+}
+
+// rehashIncrementally returns QueryResults for the workspace at context.WorkspacePath, which only
+// differs from base in the contents of changedSources. They share base's target graph and matching
+// targets, and are seeded with base's hashes of every configured target which doesn't depend on
+// changedSources, so that only the remaining configured targets are hashed by PrefillCache.
+func rehashIncrementally(context *Context, base *QueryResults, changedSources []label.Label) (*QueryResults, error) {
+	graph := make(map[label.Label]map[Configuration]*analysis.ConfiguredTarget, len(base.TransitiveConfiguredTargets))
+	for l, configuredTargets := range base.TransitiveConfiguredTargets {
+		graph[l] = configuredTargets
+	}
+	// The changed source files are read from the workspace, which may not be where base was queried.
+	for _, l := range changedSources {
+		location := filepath.Join(context.WorkspacePath, filepath.FromSlash(path.Join(l.Pkg, l.Name)))
+		configuredTargets := make(map[Configuration]*analysis.ConfiguredTarget, len(graph[l]))
+		for configuration, configuredTarget := range graph[l] {
+			configuredTarget = proto.Clone(configuredTarget).(*analysis.ConfiguredTarget)
+			if sourceFile := configuredTarget.GetTarget().GetSourceFile(); sourceFile != nil {
+				sourceFile.Location = proto.String(location)
+			}
+			configuredTargets[configuration] = configuredTarget
+		}
+		graph[l] = configuredTargets
+	}
+
+	baseHashCache := base.TargetHashCache
+	targetHashCache := NewTargetHashCache(graph, baseHashCache.normalizer, base.BazelRelease)
+	targetHashCache.UseHashExclusionPolicy(context.HashExclusionPolicy)
+	if context.BreakDependencyCycles {
+		targetHashCache.UseDependencyCycleBreaking()
+	}
+	if baseHashCache.externalRepoIdentities != nil {
+		// loadIncrementally checked that none of the files these depend on changed.
+		targetHashCache.UseExternalRepoIdentities(baseHashCache.externalRepoIdentities)
+		targetHashCache.externalRepoFiles = baseHashCache.externalRepoFiles
+	}
+	if baseHashCache.toolchainTypes != nil {
+		targetHashCache.UseResolvedToolchains(baseHashCache.toolchainTypes)
+	}
+
+	var roots []LabelAndConfiguration
+	for _, l := range base.MatchingTargets.Labels() {
+		for _, configuration := range base.MatchingTargets.ConfigurationsFor(l) {
+			roots = append(roots, LabelAndConfiguration{Label: l, Configuration: configuration})
+		}
+	}
+	nodes, err := baseHashCache.dependencyGraph(roots)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything which transitively depends on a changed source file needs to be rehashed.
+	affected := make(map[*hashNode]struct{})
+	var toVisit []*hashNode
+	for _, l := range changedSources {
+		for configuration := range graph[l] {
+			if node, ok := nodes[LabelAndConfiguration{Label: l, Configuration: configuration}]; ok {
+				toVisit = append(toVisit, node)
+			}
+		}
+	}
+	for len(toVisit) > 0 {
+		node := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if _, ok := affected[node]; ok {
+			continue
+		}
+		affected[node] = struct{}{}
+		toVisit = append(toVisit, node.dependents...)
+	}
+
+	hashes := make(map[LabelAndConfiguration][]byte, len(nodes)-len(affected))
+	for labelAndConfiguration, node := range nodes {
+		if _, ok := affected[node]; ok {
+			continue
+		}
+		if hash := baseHashCache.cachedHash(labelAndConfiguration); hash != nil {
+			hashes[labelAndConfiguration] = hash
+		}
+	}
+	targetHashCache.seedHashes(hashes)
+	log.Printf("Reusing the target graph of %s: %d source files changed, so %d of %d configured targets need rehashing", context.incrementalBaseRev, len(changedSources), len(affected), len(nodes))
+
+	return &QueryResults{
+		MatchingTargets:             base.MatchingTargets,
+		TransitiveConfiguredTargets: graph,
+		TargetHashCache:             targetHashCache,
+		BazelRelease:                base.BazelRelease,
+		configurations:              base.configurations,
+	}, nil
+}
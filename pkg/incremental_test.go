@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/common"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func TestParseGitDiffNameStatusZ(t *testing.T) {
+	output := "M\x00a/modified.go\x00A\x00b/added.go\x00D\x00deleted.go\x00"
+	want := []changedPath{{status: "M", path: "a/modified.go"}, {status: "A", path: "b/added.go"}, {status: "D", path: "deleted.go"}}
+	if got := parseGitDiffNameStatusZ(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := parseGitDiffNameStatusZ(""); len(got) != 0 {
+		t.Errorf("expected no changes for an empty diff, got %v", got)
+	}
+}
+
+func TestChangedSourceFiles(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	graph, err := ParseCqueryResult(cqueryResult.Results, &Normalizer{})
+	if err != nil {
+		t.Fatalf("Failed to parse cquery result: %v", err)
+	}
+	ignoredFiles := []common.RelPath{common.NewRelPath("ignored")}
+
+	got, err := changedSourceFiles(graph, []changedPath{
+		{status: "M", path: "HelloWorld/Greeting.java"},
+		{status: "M", path: "HelloWorld/HelloWorld.java"},
+		{status: "A", path: "ignored/new.txt"},
+	}, ignoredFiles)
+	if err != nil {
+		t.Fatalf("expected only source files to have changed, got %v", err)
+	}
+	want := []label.Label{mustParseLabel("//HelloWorld:Greeting.java"), mustParseLabel("//HelloWorld:HelloWorld.java")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	for name, change := range map[string]changedPath{
+		"added file":               {status: "A", path: "HelloWorld/Farewell.java"},
+		"deleted file":             {status: "D", path: "HelloWorld/Greeting.java"},
+		"BUILD file":               {status: "M", path: "HelloWorld/BUILD.bazel"},
+		"bzl file":                 {status: "M", path: "tools/defs.bzl"},
+		"scl file":                 {status: "M", path: "tools/config.scl"},
+		"module file":              {status: "M", path: "MODULE.bazel"},
+		"module file segment":      {status: "M", path: "deps/go.MODULE.bazel"},
+		"bazelrc":                  {status: "M", path: ".bazelrc"},
+		"file outside graph":       {status: "M", path: "README.md"},
+		"rule with name of a file": {status: "M", path: "HelloWorld/GreetingLib"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got, err := changedSourceFiles(graph, []changedPath{{status: "M", path: "HelloWorld/Greeting.java"}, change}, ignoredFiles); err == nil {
+				t.Errorf("expected %v to make the revision ineligible, got %v", change, got)
+			}
+		})
+	}
+}
+
+func TestCheckExternalRepoFilesUnchanged(t *testing.T) {
+	changes := []changedPath{{status: "M", path: "HelloWorld/Greeting.java"}}
+	thc := &TargetHashCache{}
+	if err := checkExternalRepoFilesUnchanged(thc, changes); err == nil {
+		t.Error("expected an error when external repositories are hashed by contents")
+	}
+
+	// A repository rule may read a source file of the main repository, e.g. a lockfile.
+	lockfileChange := []changedPath{{status: "M", path: "requirements_lock.txt"}}
+	thc.externalRepoFiles = map[string]struct{}{"requirements_lock.txt": {}}
+	if err := checkExternalRepoFilesUnchanged(thc, lockfileChange); err == nil {
+		t.Error("expected a change to a file referenced by a repository definition to be refused, even without identities")
+	}
+	if err := checkExternalRepoFilesUnchanged(thc, changes); err != nil {
+		t.Errorf("expected changes to other files to be allowed, got %v", err)
+	}
+
+	thc.externalRepoFiles = nil
+	thc.UseExternalRepoIdentities(map[string][]byte{"rules_foo+": {0x01}})
+	if err := checkExternalRepoFilesUnchanged(thc, changes); err == nil {
+		t.Error("expected an error when the files external repository identities depend on aren't known")
+	}
+
+	thc.externalRepoFiles = map[string]struct{}{"patches/rules_foo.patch": {}}
+	if err := checkExternalRepoFilesUnchanged(thc, changes); err != nil {
+		t.Errorf("expected changes to other files to be allowed, got %v", err)
+	}
+	if err := checkExternalRepoFilesUnchanged(thc, append(changes, changedPath{status: "M", path: "patches/rules_foo.patch"})); err == nil {
+		t.Error("expected a change to a patch of an external repository to be refused")
+	}
+}
+
+func TestRehashIncrementally(t *testing.T) {
+	_, beforeResult := layoutProject(t)
+	base := hashedHelloWorld(t, beforeResult)
+
+	afterDir, afterResult := layoutProject(t)
+	if err := os.WriteFile(filepath.Join(afterDir, "Greeting.java"), []byte("// Changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// layoutProject lays out the HelloWorld package itself, rather than a workspace containing it.
+	workspace := t.TempDir()
+	if err := os.Symlink(afterDir, filepath.Join(workspace, "HelloWorld")); err != nil {
+		t.Fatal(err)
+	}
+	greeting := mustParseLabel("//HelloWorld:Greeting.java")
+	beforeLocations := make(map[Configuration]string)
+	for configuration, configuredTarget := range base.TransitiveConfiguredTargets[greeting] {
+		beforeLocations[configuration] = configuredTarget.GetTarget().GetSourceFile().GetLocation()
+	}
+	incremental, err := rehashIncrementally(&Context{WorkspacePath: workspace}, base, []label.Label{greeting})
+	if err != nil {
+		t.Fatalf("rehashIncrementally failed: %v", err)
+	}
+
+	for _, l := range []string{"//HelloWorld:HelloWorld.java", "//HelloWorld:GreetingLib", "//HelloWorld:HelloWorld"} {
+		for configuration := range incremental.TransitiveConfiguredTargets[mustParseLabel(l)] {
+			labelAndConfiguration := LabelAndConfiguration{Label: mustParseLabel(l), Configuration: configuration}
+			if isSeeded := incremental.TargetHashCache.isHashed(labelAndConfiguration); isSeeded != (l == "//HelloWorld:HelloWorld.java") {
+				t.Errorf("expected only targets which don't depend on %s to have been seeded, but %s seeded: %v", greeting, l, isSeeded)
+			}
+		}
+	}
+	if err := incremental.PrefillCache(); err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+
+	// The hashes must be those of querying and hashing the after revision from scratch.
+	full := hashedHelloWorld(t, afterResult)
+	for l, configuredTargets := range full.TransitiveConfiguredTargets {
+		for configuration := range configuredTargets {
+			labelAndConfiguration := LabelAndConfiguration{Label: l, Configuration: configuration}
+			want, wantErr := full.TargetHashCache.Hash(labelAndConfiguration)
+			got, gotErr := incremental.TargetHashCache.Hash(labelAndConfiguration)
+			if !areHashesEqual(want, got) || (wantErr == nil) != (gotErr == nil) {
+				t.Errorf("%s: want hash %x (error %v), got %x (error %v)", l, want, wantErr, got, gotErr)
+			}
+		}
+	}
+	helloWorld := LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:HelloWorld"), Configuration: NormalizeConfiguration(configurationChecksum)}
+	before, _ := base.TargetHashCache.Hash(helloWorld)
+	after, _ := incremental.TargetHashCache.Hash(helloWorld)
+	if areHashesEqual(before, after) {
+		t.Errorf("expected the hash of %s to change when %s changed", helloWorld.Label, greeting)
+	}
+
+	// The graph of the before revision must be left as it was.
+	for configuration, configuredTarget := range base.TransitiveConfiguredTargets[greeting] {
+		if location := configuredTarget.GetTarget().GetSourceFile().GetLocation(); location != beforeLocations[configuration] {
+			t.Errorf("expected the location of %s in the before graph to be unchanged, got %s", greeting, location)
+		}
+	}
+}
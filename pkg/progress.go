@@ -0,0 +1,242 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ProgressModeAuto reports progress as a progress line if stderr is a terminal, and as log lines otherwise.
+	ProgressModeAuto = "auto"
+	// ProgressModeTTY reports progress as a single, repeatedly overwritten, progress line.
+	ProgressModeTTY = "tty"
+	// ProgressModeLog reports progress as periodic log lines.
+	ProgressModeLog = "log"
+	// ProgressModeNone disables progress reporting.
+	ProgressModeNone = "none"
+)
+
+const (
+	ttyProgressInterval = 200 * time.Millisecond
+	logProgressInterval = 10 * time.Second
+)
+
+// ProgressReporter reports the progress of long-running phases (e.g. running cquery, or hashing
+// targets) to stderr.
+// A nil *ProgressReporter is valid, and reports nothing.
+type ProgressReporter struct {
+	tty      bool
+	out      io.Writer
+	interval time.Duration
+
+	lock   sync.Mutex
+	phases []*ProgressPhase
+	// stop stops the goroutine periodically reporting progress. It is nil when no phase is active.
+	stop chan struct{}
+}
+
+// NewProgressReporter returns a ProgressReporter reporting to stderr in the given mode, which is
+// nil for ProgressModeNone.
+// When reporting a progress line, the output of the standard logger (if it is stderr) is routed
+// through the reporter, so that log lines written while phases are active (e.g. by the other
+// revision, with parallel revisions) aren't appended to the progress line.
+func NewProgressReporter(mode string) (*ProgressReporter, error) {
+	var reporter *ProgressReporter
+	switch mode {
+	case ProgressModeNone:
+		return nil, nil
+	case ProgressModeTTY:
+		reporter = newProgressReporter(true, os.Stderr)
+	case ProgressModeLog:
+		reporter = newProgressReporter(false, os.Stderr)
+	case ProgressModeAuto, "":
+		reporter = newProgressReporter(isTerminal(os.Stderr), os.Stderr)
+	default:
+		return nil, fmt.Errorf("invalid progress mode %q: accepted values are %s, %s, %s and %s", mode, ProgressModeAuto, ProgressModeTTY, ProgressModeLog, ProgressModeNone)
+	}
+	if reporter.tty && log.Writer() == os.Stderr {
+		log.SetOutput(progressLogWriter{reporter: reporter})
+	}
+	return reporter, nil
+}
+
+func newProgressReporter(tty bool, out io.Writer) *ProgressReporter {
+	interval := logProgressInterval
+	if tty {
+		interval = ttyProgressInterval
+	}
+	return &ProgressReporter{tty: tty, out: out, interval: interval}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ProgressPhase tracks the progress of a single phase.
+// A nil *ProgressPhase is valid, and tracks nothing.
+type ProgressPhase struct {
+	reporter *ProgressReporter
+	name     string
+	// unit describes the items being processed, e.g. "targets".
+	unit  string
+	start time.Time
+	// total is the number of items to be processed, or 0 if it isn't known.
+	total int64
+
+	done  atomic.Int64
+	files atomic.Int64
+	bytes atomic.Int64
+}
+
+// StartPhase starts reporting the progress of a phase processing total items (or an unknown number
+// if total is 0) described by unit. Finish must be called when the phase is over.
+func (p *ProgressReporter) StartPhase(name string, unit string, total int64) *ProgressPhase {
+	if p == nil {
+		return nil
+	}
+	phase := &ProgressPhase{reporter: p, name: name, unit: unit, start: time.Now(), total: total}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.phases = append(p.phases, phase)
+	if p.stop == nil {
+		p.stop = make(chan struct{})
+		go p.run(p.stop)
+	}
+	return phase
+}
+
+// Add records that n more items were processed.
+func (ph *ProgressPhase) Add(n int64) {
+	if ph == nil {
+		return
+	}
+	ph.done.Add(n)
+}
+
+// AddFile records that a file of the given size was read.
+func (ph *ProgressPhase) AddFile(bytes int64) {
+	if ph == nil {
+		return
+	}
+	ph.files.Add(1)
+	ph.bytes.Add(bytes)
+}
+
+// Finish stops reporting the progress of the phase, and reports its final state.
+func (ph *ProgressPhase) Finish() {
+	if ph == nil {
+		return
+	}
+	p := ph.reporter
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, phase := range p.phases {
+		if phase == ph {
+			p.phases = append(p.phases[:i], p.phases[i+1:]...)
+			break
+		}
+	}
+	if len(p.phases) == 0 && p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	if p.tty {
+		fmt.Fprintf(p.out, "\r\033[K%s\n", ph.describe("done"))
+		p.renderLocked()
+	} else {
+		log.Println(ph.describe("done"))
+	}
+}
+
+func (p *ProgressReporter) run(stop chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.lock.Lock()
+			if p.tty {
+				p.renderLocked()
+			} else {
+				for _, phase := range p.phases {
+					log.Println(phase.describe("in progress"))
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// renderLocked overwrites the progress line with the progress of all active phases.
+// p.lock must be held.
+func (p *ProgressReporter) renderLocked() {
+	if len(p.phases) == 0 {
+		return
+	}
+	descriptions := make([]string, 0, len(p.phases))
+	for _, phase := range p.phases {
+		descriptions = append(descriptions, phase.describe(""))
+	}
+	fmt.Fprintf(p.out, "\r\033[K%s", strings.Join(descriptions, " | "))
+}
+
+// progressLogWriter writes log output to the output of a ProgressReporter reporting a progress line,
+// clearing the progress line before each write and redrawing it afterwards.
+type progressLogWriter struct {
+	reporter *ProgressReporter
+}
+
+func (w progressLogWriter) Write(b []byte) (int, error) {
+	p := w.reporter
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.phases) > 0 {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+	n, err := p.out.Write(b)
+	p.renderLocked()
+	return n, err
+}
+
+func (ph *ProgressPhase) describe(state string) string {
+	var b strings.Builder
+	b.WriteString(ph.name)
+	if state != "" {
+		b.WriteString(" " + state)
+	}
+	b.WriteString(": ")
+	if ph.total > 0 {
+		fmt.Fprintf(&b, "%d/%d", ph.done.Load(), ph.total)
+	} else {
+		fmt.Fprintf(&b, "%d", ph.done.Load())
+	}
+	b.WriteString(" " + ph.unit)
+	if files := ph.files.Load(); files > 0 {
+		fmt.Fprintf(&b, ", %d files read (%s)", files, FormatBytes(ph.bytes.Load()))
+	}
+	fmt.Fprintf(&b, " [%v]", time.Since(ph.start).Round(100*time.Millisecond))
+	return b.String()
+}
+
+// FormatBytes formats a number of bytes for humans, using binary units, e.g. "1.5 MiB".
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProgressPhase(t *testing.T) {
+	var out bytes.Buffer
+	reporter := newProgressReporter(true, &out)
+
+	phase := reporter.StartPhase("Hashing", "targets", 3)
+	phase.Add(2)
+	phase.AddFile(2048)
+	phase.Finish()
+
+	got := out.String()
+	if !strings.Contains(got, "Hashing done: 2/3 targets, 1 files read (2.0 KiB)") {
+		t.Errorf("unexpected progress output: %q", got)
+	}
+	if !strings.HasSuffix(got, "\n") {
+		t.Errorf("expected the progress line to be finished, got %q", got)
+	}
+	if reporter.stop != nil {
+		t.Errorf("expected reporting to stop once no phases are active")
+	}
+}
+
+func TestProgressLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	reporter := newProgressReporter(true, &out)
+	logWriter := progressLogWriter{reporter: reporter}
+
+	logWriter.Write([]byte("before any phase\n"))
+	phase := reporter.StartPhase("Hashing", "targets", 3)
+	reporter.lock.Lock()
+	reporter.renderLocked()
+	reporter.lock.Unlock()
+	logWriter.Write([]byte("Processing revision 'before'\n"))
+	phase.Finish()
+
+	got := out.String()
+	if !strings.HasPrefix(got, "before any phase\n\r\033[KHashing: 0/3 targets") {
+		t.Errorf("expected log lines to be written as-is without a progress line, got %q", got)
+	}
+	// The progress line is cleared before the log line, and redrawn after it.
+	if !strings.Contains(got, "\r\033[KProcessing revision 'before'\n\r\033[KHashing: 0/3 targets") {
+		t.Errorf("expected the log line to replace the progress line, got %q", got)
+	}
+}
+
+func TestNilProgressReporter(t *testing.T) {
+	reporter, err := NewProgressReporter(ProgressModeNone)
+	if err != nil {
+		t.Fatalf("NewProgressReporter failed: %v", err)
+	}
+	// None of these should panic.
+	phase := reporter.StartPhase("Hashing", "targets", 1)
+	phase.Add(1)
+	phase.AddFile(1)
+	phase.Finish()
+
+	if _, err := NewProgressReporter("sometimes"); err == nil {
+		t.Errorf("expected an error for an invalid progress mode")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for bytes, want := range map[int64]string{
+		12:              "12 B",
+		1536:            "1.5 KiB",
+		3 * 1024 * 1024: "3.0 MiB",
+	} {
+		if got := FormatBytes(bytes); got != want {
+			t.Errorf("FormatBytes(%d): want %q got %q", bytes, want, got)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/pkg/cachepb"
+	"google.golang.org/protobuf/proto"
+)
+
+// errCacheMiss is returned (wrapped) by ResultsCache.Get when there is no entry for a key.
+var errCacheMiss = errors.New("cache miss")
+
+// ResultsCache stores serialized QueryResults by cache key.
+type ResultsCache interface {
+	// Get returns the entry stored for key, or an error wrapping errCacheMiss if there is none.
+	Get(key string) ([]byte, error)
+	// Has returns whether there is an entry for key, without reading it. The entry may still turn
+	// out to be unusable when it is read, e.g. because it is corrupt.
+	Has(key string) (bool, error)
+	// Put stores data as the entry for key.
+	Put(key string, data []byte) error
+	// Quarantine sets aside the entry for key, which was found to be corrupt, so that it isn't read
+	// again. Caches which can't remove entries leave them to be replaced when results are next saved.
+	Quarantine(key string) error
+	// String describes where entries are stored, for logging.
+	String() string
+}
+
+// newResultsCache returns the ResultsCache configured by context, or nil if results caching isn't
+// configured.
+func newResultsCache(context *Context) ResultsCache {
+	var local ResultsCache
+	if context.CacheDirectory != "" {
+		local = NewDirectoryResultsCache(context.CacheDirectory)
+	}
+	if context.RemoteCacheURL == "" {
+		return local
+	}
+	remote := NewHTTPResultsCache(context.RemoteCacheURL, context.RemoteCacheTimeout)
+	if local == nil {
+		return remote
+	}
+	return &tieredResultsCache{local: local, remote: remote}
+}
+
+// DirectoryResultsCache stores entries as files in a local directory.
+// The modification time of each file is the last time it was accessed (see GarbageCollect).
+type DirectoryResultsCache struct {
+	directory string
+}
+
+// NewDirectoryResultsCache returns a DirectoryResultsCache storing entries under cacheDirectory.
+func NewDirectoryResultsCache(cacheDirectory string) *DirectoryResultsCache {
+	return &DirectoryResultsCache{directory: filepath.Join(cacheDirectory, configuredTargetCacheDirname)}
+}
+
+func (c *DirectoryResultsCache) Get(key string) ([]byte, error) {
+	path := filepath.Join(c.directory, key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errCacheMiss
+		}
+		return nil, fmt.Errorf("failed to read cache file: %w", err)
+	}
+	touch(path)
+	return data, nil
+}
+
+// Has counts as using the entry, if there is one.
+func (c *DirectoryResultsCache) Has(key string) (bool, error) {
+	path := filepath.Join(c.directory, key)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat cache file: %w", err)
+	}
+	touch(path)
+	return true, nil
+}
+
+func (c *DirectoryResultsCache) Put(key string, data []byte) error {
+	if err := os.MkdirAll(c.directory, 0755); err != nil {
+		return fmt.Errorf("failed to create cache dir (%s): %w", c.directory, err)
+	}
+
+	tmpFile, err := os.CreateTemp(c.directory, key+".tmp.*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp cache file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write temp cache file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp cache file: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(c.directory, key)); err != nil {
+		return fmt.Errorf("failed to move temp cache file to final location: %w", err)
+	}
+	tmpPath = ""
+	return nil
+}
+
+func (c *DirectoryResultsCache) String() string {
+	return c.directory
+}
+
+// HTTPResultsCache stores entries on an HTTP server, using the protocol of Bazel's HTTP remote cache
+// (as served by e.g. bazel-remote). Each entry is stored as a blob in the content addressable store
+// at <url>/cas/<sha256 of entry>, and the action cache entry at <url>/ac/<key> is an ActionResult
+// whose only output file is that blob, so that servers which validate action cache entries accept
+// it. Credentials for basic authentication may be included in the URL.
+type HTTPResultsCache struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPResultsCache returns an HTTPResultsCache storing entries under baseURL, whose requests time
+// out after timeout (if positive).
+func NewHTTPResultsCache(baseURL string, timeout time.Duration) *HTTPResultsCache {
+	return &HTTPResultsCache{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *HTTPResultsCache) Get(key string) ([]byte, error) {
+	actionResult, err := c.get("ac", key)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := resultsDigest(actionResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode action cache entry %s from remote cache: %w", key, err)
+	}
+	data, err := c.get("cas", digest.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); int64(len(data)) != digest.SizeBytes || hex.EncodeToString(sum[:]) != digest.Hash {
+		return nil, fmt.Errorf("blob %s from remote cache doesn't match its digest", digest.Hash)
+	}
+	return data, nil
+}
+
+// Has only checks for the action cache entry, with HEAD <url>/ac/<key>, so the blob it refers to may
+// have been evicted.
+func (c *HTTPResultsCache) Has(key string) (bool, error) {
+	response, err := c.client.Head(c.url + "/ac/" + key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for ac/%s in remote cache: %w", key, err)
+	}
+	response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check for ac/%s in remote cache: unexpected status %s", key, response.Status)
+	}
+}
+
+func (c *HTTPResultsCache) Put(key string, data []byte) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	// The blob is uploaded first, as servers may check that the blobs an ActionResult refers to exist.
+	if err := c.put("cas", hash, data); err != nil {
+		return err
+	}
+	actionResult, err := proto.Marshal(&cachepb.ActionResult{
+		OutputFiles: []*cachepb.OutputFile{{
+			Path:   resultsOutputPath,
+			Digest: &cachepb.Digest{Hash: hash, SizeBytes: int64(len(data))},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal action cache entry: %w", err)
+	}
+	return c.put("ac", key, actionResult)
+}
+
+// get returns the body of GET <url>/<store>/<hash>, or an error wrapping errCacheMiss if it isn't
+// found.
+func (c *HTTPResultsCache) get(store string, hash string) ([]byte, error) {
+	response, err := c.client.Get(c.url + "/" + store + "/" + hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s/%s from remote cache: %w", store, hash, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, errCacheMiss
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s/%s from remote cache: unexpected status %s", store, hash, response.Status)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s/%s from remote cache: %w", store, hash, err)
+	}
+	return data, nil
+}
+
+// put uploads data with PUT <url>/<store>/<hash>.
+func (c *HTTPResultsCache) put(store string, hash string, data []byte) error {
+	request, err := http.NewRequest(http.MethodPut, c.url+"/"+store+"/"+hash, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request to put %s/%s in remote cache: %w", store, hash, err)
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to put %s/%s in remote cache: %w", store, hash, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("failed to put %s/%s in remote cache: unexpected status %s: %s", store, hash, response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Quarantine does nothing, as entries can't be removed from the remote cache. The entry is replaced
+// when results are next saved.
+func (c *HTTPResultsCache) Quarantine(key string) error {
+	return nil
+}
+
+func (c *HTTPResultsCache) String() string {
+	// Avoid logging credentials.
+	if parsed, err := url.Parse(c.url); err == nil {
+		return parsed.Redacted()
+	}
+	return "remote cache"
+}
+
+// resultsOutputPath is the path of the output file of the ActionResults stored by HTTPResultsCache.
+const resultsOutputPath = "target-determinator-results"
+
+// resultsDigest returns the digest of the entry referenced by a serialized ActionResult stored by
+// HTTPResultsCache.
+func resultsDigest(serialized []byte) (*cachepb.Digest, error) {
+	var actionResult cachepb.ActionResult
+	if err := proto.Unmarshal(serialized, &actionResult); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal action result: %w", err)
+	}
+	for _, outputFile := range actionResult.OutputFiles {
+		if outputFile.Path == resultsOutputPath && outputFile.Digest != nil {
+			return outputFile.Digest, nil
+		}
+	}
+	return nil, fmt.Errorf("action result has no %s output file", resultsOutputPath)
+}
+
+// tieredResultsCache reads from a local cache before falling back to a remote one, and writes to
+// both. Errors from the remote cache are logged, and otherwise treated as cache misses.
+type tieredResultsCache struct {
+	local  ResultsCache
+	remote ResultsCache
+}
+
+func (c *tieredResultsCache) Get(key string) ([]byte, error) {
+	data, err := c.local.Get(key)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, errCacheMiss) {
+		log.Printf("Failed to read from local cache, trying remote cache: %v", err)
+	}
+
+	data, err = c.remote.Get(key)
+	if err != nil {
+		if !errors.Is(err, errCacheMiss) {
+			log.Printf("Ignoring remote cache error: %v", err)
+		}
+		return nil, errCacheMiss
+	}
+	if err := c.local.Put(key, data); err != nil {
+		log.Printf("Failed to save remote cache entry to local cache: %v", err)
+	}
+	return data, nil
+}
+
+func (c *tieredResultsCache) Has(key string) (bool, error) {
+	has, err := c.local.Has(key)
+	if err == nil && has {
+		return true, nil
+	}
+	if err != nil {
+		log.Printf("Failed to check local cache, trying remote cache: %v", err)
+	}
+
+	has, err = c.remote.Has(key)
+	if err != nil {
+		log.Printf("Ignoring remote cache error: %v", err)
+		return false, nil
+	}
+	return has, nil
+}
+
+func (c *tieredResultsCache) Put(key string, data []byte) error {
+	if err := c.remote.Put(key, data); err != nil {
+		log.Printf("Ignoring remote cache error: %v", err)
+	}
+	return c.local.Put(key, data)
+}
+
+func (c *tieredResultsCache) Quarantine(key string) error {
+	if err := c.remote.Quarantine(key); err != nil {
+		log.Printf("Ignoring remote cache error: %v", err)
+	}
+	return c.local.Quarantine(key)
+}
+
+func (c *tieredResultsCache) String() string {
+	return fmt.Sprintf("%s, then %s", c.local, c.remote)
+}
@@ -13,11 +13,11 @@ import (
 	"os/exec"
 	path2 "path"
 	"reflect"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aristanetworks/goarista/path"
 	"github.com/bazel-contrib/target-determinator/common"
@@ -138,43 +138,169 @@ type Context struct {
 	CompareQueriesAroundAnalysisCacheClear bool `results_cache_key_ignore:"true"`
 	// FilterIncompatibleTargets controls whether we filter out incompatible targets from the candidate set of affected targets.
 	FilterIncompatibleTargets bool
+	// HashExclusionPolicy describes inputs which should be ignored when hashing targets. If nil, nothing is ignored.
+	HashExclusionPolicy *HashExclusionPolicy
+	// ExternalRepoHashStrategy controls how source files in external repositories are hashed.
+	// Accepted values are:
+	// - "contents" (or empty) - hash the files extracted into the output base.
+	// - "definition" - hash the definition of the repository the file comes from.
+	ExternalRepoHashStrategy string
+	// DetectToolchainChanges controls whether the toolchains resolved for each target are identified
+	// (using an additional cquery), so that they're mixed into hashes and changes to them are reported
+	// as ToolchainChanged differences.
+	DetectToolchainChanges bool
+	// BreakDependencyCycles controls whether dependency cycles between configured targets are broken
+	// by ignoring one dependency of each cycle, rather than causing an error.
+	BreakDependencyCycles bool
+	// ParallelRevisions controls whether FullyProcess processes the before revision in a dedicated git
+	// worktree, with its own Bazel output base, concurrently with processing the after revision.
+	ParallelRevisions bool `results_cache_key_ignore:"true"`
+	// dedicatedWorktree, if non-empty, forces revisions to be checked out in a git worktree with this
+	// suffix, which is never shared with the workspace or with revisions processed concurrently.
+	dedicatedWorktree string `results_cache_key_ignore:"true"`
+	// IncrementalSourceRehash controls whether, when the only changes between the before and after
+	// revisions are to the contents of source files in the target graph, the after revision reuses the
+	// before revision's target graph and only rehashes the changed source files and the targets which
+	// depend on them, rather than querying it again.
+	IncrementalSourceRehash bool `results_cache_key_ignore:"true"`
+	// retainGraph stops the full target graph of the revision being processed from being released,
+	// so that the next revision may reuse it.
+	retainGraph bool `results_cache_key_ignore:"true"`
+	// incrementalBase, if non-nil, holds the results (with their full target graph) of
+	// incrementalBaseRev, which the revision being processed may be incrementally rehashed from.
+	incrementalBase    *QueryResults  `results_cache_key_ignore:"true"`
+	incrementalBaseRev LabelledGitRev `results_cache_key_ignore:"true"`
+	// HashingParallelism is the number of configured targets hashed concurrently. If not positive,
+	// a default based on the number of CPUs is used.
+	HashingParallelism int `results_cache_key_ignore:"true"`
+	// Progress reports the progress of long-running phases. If nil, progress isn't reported.
+	Progress *ProgressReporter `results_cache_key_ignore:"true"`
 	// EnforceCleanRepo controls whether we should fail if the repository is unclean.
 	EnforceCleanRepo bool `results_cache_key_ignore:"true"`
 	// CacheDirectory is the directory to store cached query results. If empty, caching is disabled.
 	CacheDirectory string `results_cache_key_ignore:"true"`
+	// RemoteCacheURL is the URL of an HTTP server to share cached query results through (see
+	// HTTPResultsCache). If empty, cached query results are only stored in CacheDirectory.
+	RemoteCacheURL string `results_cache_key_ignore:"true"`
+	// RemoteCacheTimeout is the timeout of each request to RemoteCacheURL. If not positive, requests don't time out.
+	RemoteCacheTimeout time.Duration `results_cache_key_ignore:"true"`
+	// CacheMaxSize is the total size, in bytes, which cached query results in CacheDirectory are
+	// garbage collected down to after saving results. If not positive, it is unlimited.
+	CacheMaxSize int64 `results_cache_key_ignore:"true"`
+	// CacheMaxAge is how long cached query results in CacheDirectory are kept after they were last
+	// accessed. If not positive, it is unlimited.
+	CacheMaxAge time.Duration `results_cache_key_ignore:"true"`
+	// CacheKeyIncludeBazelrc controls whether the options Bazel reads from bazelrc files (see
+	// EffectiveBazelrcOptions) are included in the results cache key, so that changing user or system
+	// bazelrc files invalidates cached results. This costs an additional Bazel invocation.
+	CacheKeyIncludeBazelrc bool
+	// CacheKeyEnv lists environment variables whose values are included in the results cache key,
+	// e.g. because they affect Bazel's analysis.
+	CacheKeyEnv []string
+	// CacheKeyHostFingerprint controls whether a HostFingerprint of the current machine is included in
+	// the results cache key, so that results may be shared between different machines.
+	CacheKeyHostFingerprint bool
+	// CacheExplanations controls whether results are also cached with everything needed to explain
+	// why targets are affected, so that results may be loaded from cache when IncludeDifferences is set.
+	CacheExplanations bool `results_cache_key_ignore:"true"`
 	// IncludeDifferences controls whether difference explanations are computed for affected targets.
-	// When true, TransitiveConfiguredTargets is required and results must not be loaded from cache.
+	// When true, TransitiveConfiguredTargets is required, so results are only loaded from cache if
+	// CacheExplanations is set.
 	IncludeDifferences bool `results_cache_key_ignore:"true"`
 	// NoCacheResults disables both loading results from and saving results to the cache.
 	NoCacheResults bool `results_cache_key_ignore:"true"`
+	// NoCacheFileDigests disables persisting file digests in the cache directory across invocations.
+	NoCacheFileDigests bool `results_cache_key_ignore:"true"`
 }
 
 // FullyProcess returns the before and after metadata maps, with fully filled caches.
 func FullyProcess(context *Context, revBefore LabelledGitRev, revAfter LabelledGitRev, targets TargetsList) (*QueryResults, *QueryResults, error) {
-	log.Printf("Processing %s", revBefore)
-	queryInfoBefore, err := fullyProcessRevision(context, revBefore, targets)
-	if err != nil {
-		if queryInfoBefore == nil {
-			return nil, nil, err
+	if context.ParallelRevisions {
+		if revBefore.GitRevision == CurrentWorkingCopyState {
+			log.Printf("Processing revisions sequentially: %s is the current working copy state, so can't be processed in a separate worktree", revBefore)
+		} else if context.IncrementalSourceRehash {
+			log.Printf("Processing revisions sequentially: %s may reuse the target graph of %s", revAfter, revBefore)
 		} else {
-			if context.BeforeQueryErrorBehavior == "ignore-and-build-all" {
-				log.Printf("A query error occurred querying %s - ignoring the error and treating all matching targets from the '%s' revision as affected. Error querying: %v", revBefore, revAfter.Label, err)
-			} else {
-				return nil, nil, fmt.Errorf("error occurred querying %s: %w", revBefore, err)
-			}
+			return fullyProcessInParallel(context, revBefore, revAfter, targets)
 		}
 	}
 
+	beforeContext := *context
+	beforeContext.retainGraph = context.IncrementalSourceRehash
+	log.Printf("Processing %s", revBefore)
+	queryInfoBefore, err := fullyProcessRevision(&beforeContext, revBefore, targets)
+	queryInfoBefore, err = handleBeforeQueryError(context, revBefore, revAfter, queryInfoBefore, err)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	afterContext := *context
+	if context.IncrementalSourceRehash {
+		afterContext.incrementalBase = queryInfoBefore
+		afterContext.incrementalBaseRev = revBefore
+	}
 	// At this point, we assume that the working copy is back to its pristine state.
 	log.Printf("Processing %s", revAfter)
-	queryInfoAfter, err := fullyProcessRevision(context, revAfter, targets)
+	queryInfoAfter, err := fullyProcessRevision(&afterContext, revAfter, targets)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	if beforeContext.retainGraph && !context.IncludeDifferences {
+		queryInfoBefore.Compact()
+	}
+	return queryInfoBefore, queryInfoAfter, nil
+}
+
+// fullyProcessInParallel processes revBefore in a dedicated git worktree and output base, while
+// revAfter is processed as usual.
+func fullyProcessInParallel(context *Context, revBefore LabelledGitRev, revAfter LabelledGitRev, targets TargetsList) (*QueryResults, *QueryResults, error) {
+	beforeContext := *context
+	beforeContext.dedicatedWorktree = "before"
+	// Each output base can only be used by one Bazel server at a time, so the before revision needs
+	// its own. Its path is stable so that its analysis cache and repositories are reused across runs.
+	beforeContext.BazelOutputBase = context.BazelOutputBase + "_td_before"
+
+	var wg sync.WaitGroup
+	var queryInfoBefore *QueryResults
+	var errBefore error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		log.Printf("Processing %s", revBefore)
+		queryInfoBefore, errBefore = fullyProcessRevision(&beforeContext, revBefore, targets)
+	}()
+
+	log.Printf("Processing %s", revAfter)
+	queryInfoAfter, errAfter := fullyProcessRevision(context, revAfter, targets)
+	wg.Wait()
+
+	queryInfoBefore, errBefore = handleBeforeQueryError(context, revBefore, revAfter, queryInfoBefore, errBefore)
+	if errBefore != nil {
+		return nil, nil, errBefore
+	}
+	if errAfter != nil {
+		return nil, nil, errAfter
+	}
 	return queryInfoBefore, queryInfoAfter, nil
 }
 
+// handleBeforeQueryError applies context.BeforeQueryErrorBehavior to the result of processing
+// revBefore, returning the QueryResults to use and whether processing should fail.
+func handleBeforeQueryError(context *Context, revBefore LabelledGitRev, revAfter LabelledGitRev, queryInfoBefore *QueryResults, err error) (*QueryResults, error) {
+	if err == nil {
+		return queryInfoBefore, nil
+	}
+	if queryInfoBefore == nil {
+		return nil, err
+	}
+	if context.BeforeQueryErrorBehavior == "ignore-and-build-all" {
+		log.Printf("A query error occurred querying %s - ignoring the error and treating all matching targets from the '%s' revision as affected. Error querying: %v", revBefore, revAfter.Label, err)
+		return queryInfoBefore, nil
+	}
+	return nil, fmt.Errorf("error occurred querying %s: %w", revBefore, err)
+}
+
 // fullyProcessRevision may return a nil error and a non-nil queryInfo.
 // This indicates that evaluating the initial query at this revision failed,
 // but that the user may want to use the results anyway, despite their query results being empty.
@@ -182,6 +308,10 @@ func FullyProcess(context *Context, revBefore LabelledGitRev, revAfter LabelledG
 // matching targets from the "after" query, despite the "before" being broken.
 func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsList) (queryInfo *QueryResults, err error) {
 	defer func() {
+		if context.dedicatedWorktree != "" {
+			// The workspace was never checked out, and may be in use by another revision.
+			return
+		}
 		innerErr := gitCheckout(context.WorkspacePath, context.OriginalRevision)
 		if innerErr != nil && err == nil {
 			err = fmt.Errorf("failed to check out original commit during cleanup: %v", innerErr)
@@ -189,21 +319,32 @@ func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsL
 	}()
 
 	var treeSha string
-	cacheEnabled := context.CacheDirectory != "" && !context.NoCacheResults
+	// workingCopyDigest identifies the uncommitted state of an unclean working copy.
+	var workingCopyDigest string
+	cacheEnabled := (context.CacheDirectory != "" || context.RemoteCacheURL != "") && !context.NoCacheResults
+	if cacheEnabled && context.CacheKeyHostFingerprint {
+		if _, err := ComputeHostFingerprint(context.WorkspacePath, context.BazelCmd); err != nil {
+			log.Printf("Skipping cache: failed to fingerprint the host for the cache key: %v", err)
+			cacheEnabled = false
+		}
+	}
 	if cacheEnabled && rev.GitRevision == CurrentWorkingCopyState {
 		uncleanStatuses, err := GitStatusFiltered(context.WorkspacePath, context.IgnoredFiles)
 		if err != nil {
 			return nil, fmt.Errorf("failed to check git status for caching: %w", err)
 		}
 		if len(uncleanStatuses) > 0 {
-			log.Println("Skipping cache: working copy is unclean")
-			cacheEnabled = false
+			workingCopyDigest, err = WorkingCopyDigest(context.WorkspacePath, context.IgnoredFiles)
+			if err != nil {
+				log.Printf("Skipping cache: failed to digest unclean working copy: %v", err)
+				cacheEnabled = false
+			}
 		}
 	}
 	if cacheEnabled {
 		gitRev := rev.GitRevision.Sha
 		if gitRev == "" {
-			// We checked the working copy and index are clean above.
+			// Uncommitted changes in the working copy are identified by workingCopyDigest.
 			gitRev = "HEAD"
 		}
 		var treeErr error
@@ -211,12 +352,20 @@ func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsL
 		if treeErr != nil {
 			return nil, fmt.Errorf("failed to compute tree SHA for %s: %w", rev, treeErr)
 		}
+		if workingCopyDigest != "" {
+			treeSha = dirtyStateCacheKey(treeSha, workingCopyDigest)
+		}
 
-		if context.IncludeDifferences {
-			log.Println("Skipping cache load: -verbose requires full target metadata not stored in cache")
+		if context.IncludeDifferences && !context.CacheExplanations {
+			log.Println("Skipping cache load: -verbose requires full target metadata, which is only cached with --cache-explanations")
 		} else {
-			// Try to load from cache.
-			cachedResults, cacheErr := LoadFromCache(context, treeSha, targets.String())
+			// Try to load from cache, preferring the target graph if it may be reused by the next revision.
+			loadWithExplanations := context.IncludeDifferences || (context.retainGraph && context.CacheExplanations)
+			cachedResults, cacheErr := loadFromCache(context, treeSha, targets.String(), loadWithExplanations)
+			if cacheErr != nil && loadWithExplanations && !context.IncludeDifferences {
+				log.Printf("Cache load of target graph failed: %v", cacheErr)
+				cachedResults, cacheErr = loadFromCache(context, treeSha, targets.String(), false)
+			}
 			if cacheErr == nil {
 				log.Println("Cache hit: returning cached results")
 				return cachedResults, nil
@@ -225,17 +374,57 @@ func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsL
 		}
 	}
 
-	queryInfo, loadMetadataCleanup, err := LoadIncompleteMetadata(context, rev, targets)
-	defer loadMetadataCleanup()
-	if err != nil {
-		return queryInfo, fmt.Errorf("failed to load metadata at %s: %w", rev, err)
+	if context.incrementalBase != nil {
+		var incrementalCleanup func()
+		queryInfo, incrementalCleanup, err = loadIncrementally(context, rev)
+		defer incrementalCleanup()
+		if err != nil {
+			log.Printf("Not reusing the target graph of %s: %v", context.incrementalBaseRev, err)
+			queryInfo = nil
+		} else if cacheEnabled {
+			// Repository rules may read source files of the main repository, so reusing the target
+			// graph may give different results than querying would, which mustn't be served to others.
+			log.Println("Skipping cache save: the target graph was reused rather than queried")
+			cacheEnabled = false
+		}
+	}
+	if queryInfo == nil {
+		var loadMetadataCleanup func()
+		queryInfo, loadMetadataCleanup, err = LoadIncompleteMetadata(context, rev, targets)
+		defer loadMetadataCleanup()
+		if err != nil {
+			return queryInfo, fmt.Errorf("failed to load metadata at %s: %w", rev, err)
+		}
 	}
 
+	var fileDigestStore *FileDigestStore
+	if context.CacheDirectory != "" && !context.NoCacheFileDigests {
+		fileDigestStore, err = LoadFileDigestStore(context.CacheDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load file digest cache: %w", err)
+		}
+		queryInfo.TargetHashCache.UseFileDigestStore(fileDigestStore)
+	}
+	queryInfo.TargetHashCache.UseProgressReporter(context.Progress)
+
 	log.Println("Hashing targets")
-	if err := queryInfo.PrefillCache(); err != nil {
+	if err := queryInfo.PrefillCacheWithParallelism(context.HashingParallelism); err != nil {
 		return nil, fmt.Errorf("failed to calculate hashes at %s: %w", rev, err)
 	}
 
+	if err := fileDigestStore.Save(); err != nil {
+		log.Printf("Warning: failed to save file digest cache: %v", err)
+	}
+
+	// Results computed while the working copy was being edited may not match either state.
+	if cacheEnabled && workingCopyDigest != "" {
+		currentDigest, err := WorkingCopyDigest(context.WorkspacePath, context.IgnoredFiles)
+		if err != nil || currentDigest != workingCopyDigest {
+			log.Println("Skipping cache save: working copy changed while it was processed")
+			cacheEnabled = false
+		}
+	}
+
 	// Save to cache if caching is enabled
 	if cacheEnabled {
 		if saveErr := SaveToCache(context, treeSha, targets.String(), queryInfo); saveErr != nil {
@@ -243,6 +432,12 @@ func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsL
 		}
 	}
 
+	if !context.IncludeDifferences && !context.retainGraph {
+		// Differences won't be explained, so release the full target graph before the next revision
+		// is processed.
+		queryInfo.Compact()
+	}
+
 	return queryInfo, nil
 }
 
@@ -270,37 +465,36 @@ func LoadIncompleteMetadata(context *Context, rev LabelledGitRev, targets Target
 		AnalysisCacheClearStrategy:             context.AnalysisCacheClearStrategy,
 		CompareQueriesAroundAnalysisCacheClear: context.CompareQueriesAroundAnalysisCacheClear,
 		FilterIncompatibleTargets:              context.FilterIncompatibleTargets,
+		HashExclusionPolicy:                    context.HashExclusionPolicy,
+		ExternalRepoHashStrategy:               context.ExternalRepoHashStrategy,
+		DetectToolchainChanges:                 context.DetectToolchainChanges,
+		BreakDependencyCycles:                  context.BreakDependencyCycles,
+		ParallelRevisions:                      context.ParallelRevisions,
+		dedicatedWorktree:                      context.dedicatedWorktree,
+		IncrementalSourceRehash:                context.IncrementalSourceRehash,
+		HashingParallelism:                     context.HashingParallelism,
+		Progress:                               context.Progress,
 		EnforceCleanRepo:                       context.EnforceCleanRepo,
 		CacheDirectory:                         context.CacheDirectory,
+		RemoteCacheURL:                         context.RemoteCacheURL,
+		RemoteCacheTimeout:                     context.RemoteCacheTimeout,
+		CacheMaxSize:                           context.CacheMaxSize,
+		CacheMaxAge:                            context.CacheMaxAge,
+		CacheKeyIncludeBazelrc:                 context.CacheKeyIncludeBazelrc,
+		CacheKeyEnv:                            context.CacheKeyEnv,
+		CacheKeyHostFingerprint:                context.CacheKeyHostFingerprint,
+		CacheExplanations:                      context.CacheExplanations,
 		IncludeDifferences:                     context.IncludeDifferences,
 		NoCacheResults:                         context.NoCacheResults,
+		NoCacheFileDigests:                     context.NoCacheFileDigests,
 	}
-	cleanupFunc := func() {}
-
-	if rev.GitRevision != CurrentWorkingCopyState {
-		// This may return a new workspace path to ensure we don't destroy any local data.
-		newWorkspacePath, err2 := gitSafeCheckout(context, rev, context.IgnoredFiles)
-
-		// A worktree was created by gitSafeCheckout(). Use it and set the cleanup callback even
-		// if gitSafeCheckout returns an error.
-		if newWorkspacePath != "" && context.DeleteCachedWorktree {
-			cleanupFunc = func() {
-				err := os.RemoveAll(newWorkspacePath)
-				if err != nil {
-					err = fmt.Errorf("failed to clean up temporary git worktree at %s: %v", newWorkspacePath, err)
-				}
-			}
-			context.WorkspacePath = newWorkspacePath
-		}
-
-		if err2 != nil {
-			return nil, cleanupFunc, fmt.Errorf("failed to checkout %s in %v: %w", rev, context.WorkspacePath, err2)
-		}
+	cleanupFunc, err := checkOutRevision(context, rev)
+	if err != nil {
+		return nil, cleanupFunc, err
 	}
 
 	var queryInfoBeforeClear *QueryResults
 	if context.CompareQueriesAroundAnalysisCacheClear {
-		var err error
 		queryInfoBeforeClear, err = doQueryDeps(context, targets)
 		if err != nil {
 			return queryInfoBeforeClear, cleanupFunc, fmt.Errorf("failed to query[before] at %s in %v: %w", rev, context.WorkspacePath, err)
@@ -330,6 +524,37 @@ func LoadIncompleteMetadata(context *Context, rev LabelledGitRev, targets Target
 	return queryInfo, cleanupFunc, nil
 }
 
+// checkOutRevision checks out rev, unless it is the current working copy state. It may instead
+// check rev out in a git worktree, in which case context.WorkspacePath is changed to point to it.
+//
+// It returns a non-nil callback to clean up the worktree if it was created.
+func checkOutRevision(context *Context, rev LabelledGitRev) (func(), error) {
+	cleanupFunc := func() {}
+	if rev.GitRevision == CurrentWorkingCopyState {
+		return cleanupFunc, nil
+	}
+
+	// This may return a new workspace path to ensure we don't destroy any local data.
+	newWorkspacePath, err := gitSafeCheckout(context, rev, context.IgnoredFiles)
+
+	// A worktree was created by gitSafeCheckout(). Use it and set the cleanup callback even
+	// if gitSafeCheckout returns an error.
+	if newWorkspacePath != "" && context.DeleteCachedWorktree {
+		cleanupFunc = func() {
+			err := os.RemoveAll(newWorkspacePath)
+			if err != nil {
+				err = fmt.Errorf("failed to clean up temporary git worktree at %s: %v", newWorkspacePath, err)
+			}
+		}
+		context.WorkspacePath = newWorkspacePath
+	}
+
+	if err != nil {
+		return cleanupFunc, fmt.Errorf("failed to checkout %s in %v: %w", rev, context.WorkspacePath, err)
+	}
+	return cleanupFunc, nil
+}
+
 // stringSliceContainsStartingWith returns whether slice contains items that are a path prefix of element.
 func stringSliceContainsStartingWith(pathPrefixes []common.RelPath, element common.RelPath) bool {
 	for _, s := range pathPrefixes {
@@ -444,40 +669,44 @@ func gitStatus(workingDirectory string) ([]GitFileStatus, error) {
 //
 // When applicable, the caller is responsible for cleaning up the newly created worktree.
 func gitSafeCheckout(context *Context, rev LabelledGitRev, ignoredFiles []common.RelPath) (string, error) {
-	useGitWorktree := false
-	isPreCheckoutClean, err := EnsureGitRepositoryClean(context.WorkspacePath, ignoredFiles)
-	if err != nil {
-		return "", fmt.Errorf("failed to check whether the repository is clean: %w", err)
-	}
-	if !isPreCheckoutClean {
-		if context.EnforceCleanRepo {
-			return "", fmt.Errorf("repository was not clean before checking out %v", rev)
-		}
-
-		log.Printf("Workspace is unclean, using git worktree. This will be slower the first time. " +
-			"You can avoid this by committing local changes and ignoring untracked files.")
-		useGitWorktree = true
-	} else {
-		if err := gitCheckout(context.WorkspacePath, rev); err != nil {
-			return "", err
-		}
-
-		isPostCheckoutClean, err := EnsureGitRepositoryClean(context.WorkspacePath, ignoredFiles)
+	// A dedicated worktree is used even if the workspace is clean, as the workspace may be in use.
+	useGitWorktree := context.dedicatedWorktree != ""
+	if !useGitWorktree {
+		isPreCheckoutClean, err := EnsureGitRepositoryClean(context.WorkspacePath, ignoredFiles)
 		if err != nil {
 			return "", fmt.Errorf("failed to check whether the repository is clean: %w", err)
 		}
-		if !isPostCheckoutClean {
+		if !isPreCheckoutClean {
 			if context.EnforceCleanRepo {
-				return "", fmt.Errorf("repository was not clean after checking out %v", rev)
+				return "", fmt.Errorf("repository was not clean before checking out %v", rev)
 			}
 
-			log.Printf("Detected unclean repository after checkout (likely due to submodule or " +
-				".gitignore changes). Using git worktree to leave original repository pristine.")
+			log.Printf("Workspace is unclean, using git worktree. This will be slower the first time. " +
+				"You can avoid this by committing local changes and ignoring untracked files.")
 			useGitWorktree = true
+		} else {
+			if err := gitCheckout(context.WorkspacePath, rev); err != nil {
+				return "", err
+			}
+
+			isPostCheckoutClean, err := EnsureGitRepositoryClean(context.WorkspacePath, ignoredFiles)
+			if err != nil {
+				return "", fmt.Errorf("failed to check whether the repository is clean: %w", err)
+			}
+			if !isPostCheckoutClean {
+				if context.EnforceCleanRepo {
+					return "", fmt.Errorf("repository was not clean after checking out %v", rev)
+				}
+
+				log.Printf("Detected unclean repository after checkout (likely due to submodule or " +
+					".gitignore changes). Using git worktree to leave original repository pristine.")
+				useGitWorktree = true
+			}
 		}
 	}
 	newRepositoryPath := ""
 	if useGitWorktree {
+		var err error
 		newRepositoryPath, err = gitReuseOrCreateWorktree(context, rev)
 		if err != nil {
 			return "", fmt.Errorf("failed to create or reuse worktree: %w", err)
@@ -515,6 +744,9 @@ func gitReuseOrCreateWorktree(context *Context, rev LabelledGitRev) (string, err
 	hashBuilder.Write([]byte(context.WorkspacePath))
 	currentDirHash := hex.EncodeToString(hashBuilder.Sum(nil))
 	worktreeDirPath := path2.Join(cacheDir, fmt.Sprintf("td-worktree-%v-%v", path2.Base(context.WorkspacePath), currentDirHash))
+	if context.dedicatedWorktree != "" {
+		worktreeDirPath += "-" + context.dedicatedWorktree
+	}
 
 	if err := os.MkdirAll(cacheDir, 0750); err != nil {
 		return "", fmt.Errorf("failed to create cache directory %v for git worktree: %w", worktreeDirPath, err)
@@ -589,58 +821,43 @@ type QueryResults struct {
 	configurations map[Configuration]singleConfigurationOutput
 }
 
+// PrefillCache computes the hashes of all matching targets (and everything they depend on), and then
+// freezes the TargetHashCache.
+// The TD_WORKER_COUNT environment variable is used as the number of workers if set, and otherwise
+// DefaultHashingParallelism.
 func (queryInfo *QueryResults) PrefillCache() error {
-	var err error
-	var numWorkers int
-	workerCountEnv := os.Getenv("TD_WORKER_COUNT")
-	if workerCountEnv == "" {
-		numWorkers = runtime.NumCPU() * 8
-	} else {
-		numWorkers, err = strconv.Atoi(workerCountEnv)
-		if err != nil {
-			return fmt.Errorf("could not parse the TD_WORKER_COUNT env var into an int: %v", workerCountEnv)
-		}
-	}
-
-	// Create a thread pool to hash the targets faster.
-	labelAndConfigurationsChan := make(chan LabelAndConfiguration, numWorkers)
-	errorsChan := make(chan error, 1)
+	return queryInfo.PrefillCacheWithParallelism(0)
+}
 
-	var once sync.Once
-	var wg sync.WaitGroup
-	for w := 1; w <= numWorkers; w++ {
-		go func() {
-			for labelAndConfiguration := range labelAndConfigurationsChan {
-				_, err := queryInfo.TargetHashCache.Hash(labelAndConfiguration)
-				if err != nil {
-					once.Do(func() { errorsChan <- err }) // We only return one error.
-				}
-				wg.Done()
+// PrefillCacheWithParallelism is like PrefillCache, but uses parallelism workers if it is positive.
+func (queryInfo *QueryResults) PrefillCacheWithParallelism(parallelism int) error {
+	if parallelism <= 0 {
+		if workerCountEnv := os.Getenv("TD_WORKER_COUNT"); workerCountEnv != "" {
+			var err error
+			parallelism, err = strconv.Atoi(workerCountEnv)
+			if err != nil {
+				return fmt.Errorf("could not parse the TD_WORKER_COUNT env var into an int: %v", workerCountEnv)
 			}
-		}()
+			log.Println("The TD_WORKER_COUNT env var is deprecated - use --hashing-parallelism instead")
+		}
 	}
 
-OUTER:
+	var labelAndConfigurations []LabelAndConfiguration
 	for _, l := range queryInfo.MatchingTargets.Labels() {
 		for _, configuration := range queryInfo.MatchingTargets.ConfigurationsFor(l) {
-			if len(errorsChan) > 0 {
-				break OUTER
-			}
-			wg.Add(1)
-			labelAndConfigurationsChan <- LabelAndConfiguration{
+			labelAndConfigurations = append(labelAndConfigurations, LabelAndConfiguration{
 				Label:         l,
 				Configuration: configuration,
-			}
+			})
 		}
 	}
-
-	// Signal to workers that work is done.
-	close(labelAndConfigurationsChan)
-	wg.Wait()
-
-	if len(errorsChan) > 0 {
-		return <-errorsChan
+	start := time.Now()
+	hashed, err := queryInfo.TargetHashCache.hashInDependencyOrder(labelAndConfigurations, parallelism, true)
+	if err != nil {
+		return err
 	}
+	elapsed := time.Since(start)
+	log.Printf("Hashed %d configured targets in %v (%.0f targets/s)", hashed, elapsed.Round(time.Millisecond), float64(hashed)/elapsed.Seconds())
 
 	// We may be about to change the filesystem state, which will mean any file reads done after
 	// this point may be invalid.
@@ -649,6 +866,63 @@ OUTER:
 	return nil
 }
 
+// Compact releases everything which is only needed to explain differences, keeping only what's
+// needed to find affected targets: the hashes of the matching targets, and their names, rule classes
+// and tags in TransitiveConfiguredTargets.
+// It must only be called after PrefillCache. Afterwards, differences can't be explained.
+func (queryInfo *QueryResults) Compact() {
+	var matching []LabelAndConfiguration
+	compacted := make(map[label.Label]map[Configuration]*analysis.ConfiguredTarget)
+	for _, l := range queryInfo.MatchingTargets.Labels() {
+		for _, configuration := range queryInfo.MatchingTargets.ConfigurationsFor(l) {
+			matching = append(matching, LabelAndConfiguration{Label: l, Configuration: configuration})
+			configuredTarget, ok := queryInfo.TransitiveConfiguredTargets[l][configuration]
+			if !ok {
+				continue
+			}
+			if compacted[l] == nil {
+				compacted[l] = make(map[Configuration]*analysis.ConfiguredTarget)
+			}
+			compacted[l][configuration] = compactConfiguredTarget(configuredTarget)
+		}
+	}
+	if queryInfo.TransitiveConfiguredTargets != nil {
+		queryInfo.TransitiveConfiguredTargets = compacted
+	}
+	queryInfo.TargetHashCache.retainOnly(matching)
+	queryInfo.configurations = nil
+}
+
+// compactConfiguredTarget returns a copy of configuredTarget with only its name, rule class, tags
+// and configuration checksum.
+func compactConfiguredTarget(configuredTarget *analysis.ConfiguredTarget) *analysis.ConfiguredTarget {
+	target := configuredTarget.GetTarget()
+	compact := &build.Target{Type: target.Type}
+	switch target.GetType() {
+	case build.Target_RULE:
+		rule := target.GetRule()
+		compact.Rule = &build.Rule{Name: rule.Name, RuleClass: rule.RuleClass}
+		for _, attr := range rule.GetAttribute() {
+			if attr.GetName() == "tags" {
+				compact.Rule.Attribute = []*build.Attribute{attr}
+			}
+		}
+	case build.Target_SOURCE_FILE:
+		compact.SourceFile = &build.SourceFile{Name: target.GetSourceFile().Name}
+	case build.Target_GENERATED_FILE:
+		generatedFile := target.GetGeneratedFile()
+		compact.GeneratedFile = &build.GeneratedFile{Name: generatedFile.Name, GeneratingRule: generatedFile.GeneratingRule}
+	case build.Target_PACKAGE_GROUP:
+		compact.PackageGroup = &build.PackageGroup{Name: target.GetPackageGroup().Name}
+	case build.Target_ENVIRONMENT_GROUP:
+		compact.EnvironmentGroup = &build.EnvironmentGroup{Name: target.GetEnvironmentGroup().Name}
+	}
+	return &analysis.ConfiguredTarget{
+		Target:        compact,
+		Configuration: &analysis.Configuration{Checksum: configuredTarget.GetConfiguration().GetChecksum()},
+	}
+}
+
 type LabelAndConfigurations struct {
 	Label          label.Label
 	Configurations []Configuration
@@ -790,7 +1064,11 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 	if len(incompatibleTargetsToFilter) > 0 {
 		depsPattern += " - " + strings.Join(sortedStringKeys(incompatibleTargetsToFilter), " - ")
 	}
-	transitiveResult, err := runToCqueryResult(context, depsPattern, true, bazelRelease)
+	transitiveConfiguredTargets := make(map[label.Label]map[Configuration]*analysis.ConfiguredTarget)
+	err = streamCqueryResult(context, depsPattern, true, bazelRelease, func(target *analysis.ConfiguredTarget) error {
+		stripUnhashedFields(target)
+		return addConfiguredTarget(transitiveConfiguredTargets, target, &normalizer)
+	})
 	if err != nil {
 		retErr := fmt.Errorf("failed to cquery %v: %w", depsPattern, err)
 		return &QueryResults{
@@ -805,12 +1083,24 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 		}, retErr
 	}
 
-	transitiveConfiguredTargets, err := ParseCqueryResult(transitiveResult, &normalizer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse cquery result: %w", err)
+	// Only the labels and configurations of the matching targets are needed, so we don't retain the
+	// targets themselves.
+	type matchingTarget struct {
+		label         label.Label
+		configuration Configuration
 	}
-
-	matchingTargetResults, err := runToCqueryResult(context, targets.String(), false, bazelRelease)
+	var matchingTargetResults []matchingTarget
+	err = streamCqueryResult(context, targets.String(), false, bazelRelease, func(target *analysis.ConfiguredTarget) error {
+		l, err := labelOf(target.Target, &normalizer)
+		if err != nil {
+			return fmt.Errorf("failed to parse label returned from query %s: %w", target.Target, err)
+		}
+		matchingTargetResults = append(matchingTargetResults, matchingTarget{
+			label:         l,
+			configuration: NormalizeConfiguration(target.GetConfiguration().GetChecksum()),
+		})
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to run top-level cquery: %w", err)
 	}
@@ -832,17 +1122,12 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 	labels := make([]label.Label, 0)
 	labelsToConfigurations := make(map[label.Label][]Configuration)
 	for _, mt := range matchingTargetResults {
-		l, err := labelOf(mt.Target, &normalizer)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse label returned from query %s: %w", mt.Target, err)
-		}
+		l := mt.label
 		if context.FilterIncompatibleTargets && !compatibleTargetsStrKey[l.String()] {
 			continue // Ignore incompatible targets
 		}
 		labels = append(labels, l)
-
-		configuration := NormalizeConfiguration(mt.Configuration.Checksum)
-		labelsToConfigurations[l] = append(labelsToConfigurations[l], configuration)
+		labelsToConfigurations[l] = append(labelsToConfigurations[l], mt.configuration)
 	}
 
 	processedLabelsToConfigurations := make(map[label.Label]*ss.SortedSet[Configuration], len(labels))
@@ -860,10 +1145,31 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 		return nil, fmt.Errorf("failed to interpret configurations output: %w", err)
 	}
 
+	targetHashCache := NewTargetHashCache(transitiveConfiguredTargets, &normalizer, bazelRelease)
+	targetHashCache.UseHashExclusionPolicy(context.HashExclusionPolicy)
+	if context.BreakDependencyCycles {
+		targetHashCache.UseDependencyCycleBreaking()
+	}
+	if context.ExternalRepoHashStrategy == ExternalRepoHashStrategyDefinition {
+		externalRepoIdentities, externalRepoFiles, err := computeExternalRepoIdentities(context, transitiveConfiguredTargets, hasBzlmod, bazelRelease)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute external repository identities: %w", err)
+		}
+		targetHashCache.UseExternalRepoIdentities(externalRepoIdentities)
+		targetHashCache.externalRepoFiles = externalRepoFiles
+	}
+	if context.DetectToolchainChanges {
+		toolchainTypes, err := findResolvedToolchains(context, depsPattern, &normalizer, bazelRelease)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find resolved toolchains: %w", err)
+		}
+		targetHashCache.UseResolvedToolchains(toolchainTypes)
+	}
+
 	queryResults := &QueryResults{
 		MatchingTargets:             matchingTargets,
 		TransitiveConfiguredTargets: transitiveConfiguredTargets,
-		TargetHashCache:             NewTargetHashCache(transitiveConfiguredTargets, &normalizer, bazelRelease),
+		TargetHashCache:             targetHashCache,
 		BazelRelease:                bazelRelease,
 		QueryError:                  nil,
 		configurations:              configurations,
@@ -880,11 +1186,20 @@ func sortedStringKeys[V any](m map[label.Label]V) []string {
 	return keys
 }
 
-func runToCqueryResult(context *Context, pattern string, includeTransitions bool, bazelRelease string) ([]*analysis.ConfiguredTarget, error) {
+// streamCqueryResult runs cquery on pattern, calling handle with each ConfiguredTarget in its output.
+// When Bazel supports streamed proto output, targets are parsed as the output is read, so that the
+// whole output is never held in memory at once.
+func streamCqueryResult(context *Context, pattern string, includeTransitions bool, bazelRelease string, handle func(*analysis.ConfiguredTarget) error) error {
 	log.Printf("Running cquery on %s", pattern)
-	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
+	phase := context.Progress.StartPhase("Running cquery", "configured targets parsed", 0)
+	defer phase.Finish()
+	handleAndCount := func(configuredTarget *analysis.ConfiguredTarget) error {
+		phase.Add(1)
+		return handle(configuredTarget)
+	}
+
 	useStreamedProtoPtr, _ := versions.ReleaseIsInRange(bazelRelease, version.Must(version.NewVersion("8.2.0")), nil)
 	useStreamedProto := useStreamedProtoPtr != nil && *useStreamedProtoPtr
 	var args []string
@@ -898,35 +1213,74 @@ func runToCqueryResult(context *Context, pattern string, includeTransitions bool
 	}
 	args = append(args, pattern)
 
-	returnVal, err := context.BazelCmd.Cquery(
-		bazelRelease,
-		BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
-		[]string{"--output_base", context.BazelOutputBase},
-		args...)
+	if !useStreamedProto {
+		var stdout bytes.Buffer
+		returnVal, err := context.BazelCmd.Cquery(
+			bazelRelease,
+			BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
+			[]string{"--output_base", context.BazelOutputBase},
+			args...)
+		if returnVal != 0 || err != nil {
+			return fmt.Errorf("failed to run cquery on %s: %w. Stderr:\n%v", pattern, err, stderr.String())
+		}
+
+		var result analysis.CqueryResult
+		if err = proto.Unmarshal(stdout.Bytes(), &result); err != nil {
+			return fmt.Errorf("failed to unmarshal cquery stdout: %w", err)
+		}
+		for _, target := range result.GetResults() {
+			if err := handleAndCount(target); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-	if returnVal != 0 || err != nil {
-		return nil, fmt.Errorf("failed to run cquery on %s: %w. Stderr:\n%v", pattern, err, stderr.String())
+	stdoutReader, stdoutWriter := io.Pipe()
+	type cqueryOutcome struct {
+		returnVal int
+		err       error
 	}
+	done := make(chan cqueryOutcome, 1)
+	go func() {
+		returnVal, err := context.BazelCmd.Cquery(
+			bazelRelease,
+			BazelCmdConfig{Dir: context.WorkspacePath, Stdout: stdoutWriter, Stderr: &stderr},
+			[]string{"--output_base", context.BazelOutputBase},
+			args...)
+		stdoutWriter.Close()
+		done <- cqueryOutcome{returnVal: returnVal, err: err}
+	}()
 
-	if useStreamedProto {
-		var targets []*analysis.ConfiguredTarget
-		unmarshalOpts := protodelim.UnmarshalOptions{MaxSize: -1}
-		for {
-			var singleTargetResult analysis.CqueryResult
-			if err = unmarshalOpts.UnmarshalFrom(&stdout, &singleTargetResult); err == io.EOF {
-				break
-			} else if err != nil {
-				return nil, fmt.Errorf("failed to unmarshal streamed cquery stdout: %w", err)
-			}
-			targets = append(targets, singleTargetResult.Results...)
+	parseErr := parseStreamedCqueryResult(bufio.NewReader(stdoutReader), handleAndCount)
+	if parseErr != nil {
+		// Stop Bazel from blocking on writing output we won't read.
+		stdoutReader.CloseWithError(parseErr)
+	}
+	outcome := <-done
+	if parseErr != nil {
+		return parseErr
+	}
+	if outcome.returnVal != 0 || outcome.err != nil {
+		return fmt.Errorf("failed to run cquery on %s: %w. Stderr:\n%v", pattern, outcome.err, stderr.String())
+	}
+	return nil
+}
+
+func parseStreamedCqueryResult(r *bufio.Reader, handle func(*analysis.ConfiguredTarget) error) error {
+	unmarshalOpts := protodelim.UnmarshalOptions{MaxSize: -1}
+	for {
+		var singleTargetResult analysis.CqueryResult
+		if err := unmarshalOpts.UnmarshalFrom(r, &singleTargetResult); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to unmarshal streamed cquery stdout: %w", err)
 		}
-		return targets, nil
-	} else {
-		var result analysis.CqueryResult
-		if err = proto.Unmarshal(stdout.Bytes(), &result); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal cquery stdout: %w", err)
+		for _, target := range singleTargetResult.Results {
+			if err := handle(target); err != nil {
+				return err
+			}
 		}
-		return result.GetResults(), nil
 	}
 }
 
@@ -1040,22 +1394,62 @@ func ParseCqueryResult(targets []*analysis.ConfiguredTarget, n *Normalizer) (map
 	configuredTargets := make(map[label.Label]map[Configuration]*analysis.ConfiguredTarget, len(targets))
 
 	for _, target := range targets {
-		l, err := labelOf(target.GetTarget(), n)
-		if err != nil {
+		if err := addConfiguredTarget(configuredTargets, target, n); err != nil {
 			return nil, err
 		}
+	}
 
-		_, ok := configuredTargets[l]
-		if !ok {
-			configuredTargets[l] = make(map[Configuration]*analysis.ConfiguredTarget)
-		}
+	return configuredTargets, nil
+}
 
-		NormalizeConfiguredTarget(target, n)
+// addConfiguredTarget normalizes target and adds it to configuredTargets.
+func addConfiguredTarget(configuredTargets map[label.Label]map[Configuration]*analysis.ConfiguredTarget, target *analysis.ConfiguredTarget, n *Normalizer) error {
+	l, err := labelOf(target.GetTarget(), n)
+	if err != nil {
+		return err
+	}
 
-		configuredTargets[l][NormalizeConfiguration(target.GetConfiguration().GetChecksum())] = target
+	_, ok := configuredTargets[l]
+	if !ok {
+		configuredTargets[l] = make(map[Configuration]*analysis.ConfiguredTarget)
 	}
 
-	return configuredTargets, nil
+	NormalizeConfiguredTarget(target, n)
+
+	configuredTargets[l][NormalizeConfiguration(target.GetConfiguration().GetChecksum())] = target
+	return nil
+}
+
+// stripUnhashedFields clears the fields of target which don't contribute to its hash, so that
+// they don't need to be retained in memory. Attributes are retained even if excluded from hashing,
+// as callers may inspect them (e.g. to find tags).
+func stripUnhashedFields(target *analysis.ConfiguredTarget) {
+	if configuration := target.GetConfiguration(); configuration != nil {
+		target.Configuration = &analysis.Configuration{Checksum: configuration.GetChecksum()}
+	}
+	target.ConfigurationId = 0
+	switch t := target.GetTarget(); t.GetType() {
+	case build.Target_RULE:
+		rule := t.GetRule()
+		rule.Location = nil
+		rule.RuleOutput = nil
+		rule.DefaultSetting = nil
+		rule.DEPRECATEDPublicByDefault = nil
+		rule.DEPRECATEDIsSkylark = nil
+		rule.InstantiationStack = nil
+		rule.DefinitionStack = nil
+	case build.Target_SOURCE_FILE:
+		// The location is needed to find the file to hash.
+		sourceFile := t.GetSourceFile()
+		sourceFile.Subinclude = nil
+		sourceFile.PackageGroup = nil
+		sourceFile.VisibilityLabel = nil
+		sourceFile.Feature = nil
+		sourceFile.License = nil
+		sourceFile.PackageContainsErrors = nil
+	case build.Target_GENERATED_FILE:
+		t.GetGeneratedFile().Location = nil
+	}
 }
 
 func labelOf(target *build.Target, n *Normalizer) (label.Label, error) {
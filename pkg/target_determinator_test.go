@@ -1,9 +1,20 @@
 package pkg
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/bazel-contrib/target-determinator/common"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
 )
 
 func Test_stringSliceContainsStartingWith(t *testing.T) {
@@ -98,3 +109,305 @@ func Test_ParseCanonicalLabel(t *testing.T) {
 		}
 	}
 }
+
+// cqueryOutputBazelCmd implements BazelCmd, writing a fixed output for every cquery.
+type cqueryOutputBazelCmd struct {
+	output []byte
+}
+
+func (c cqueryOutputBazelCmd) Execute(_ BazelCmdConfig, _ []string, command string, args ...string) (int, error) {
+	return 1, fmt.Errorf("unexpected bazel command: %s %v", command, args)
+}
+
+func (c cqueryOutputBazelCmd) Cquery(_ string, config BazelCmdConfig, _ []string, _ ...string) (int, error) {
+	if _, err := config.Stdout.Write(c.output); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+func (c cqueryOutputBazelCmd) HashKey() string { return "" }
+
+func TestStreamCqueryResult(t *testing.T) {
+	var output bytes.Buffer
+	for _, name := range []string{"//:a", "//:b"} {
+		result := &analysis.CqueryResult{
+			Results: []*analysis.ConfiguredTarget{
+				{
+					Target: &build.Target{
+						Type: build.Target_RULE.Enum(),
+						Rule: &build.Rule{
+							Name:       proto.String(name),
+							RuleClass:  proto.String("genrule"),
+							Location:   proto.String("/workspace/BUILD.bazel:1:1"),
+							RuleOutput: []string{name + ".out"},
+						},
+					},
+					Configuration: &analysis.Configuration{Checksum: configurationChecksum, Mnemonic: "k8-fastbuild"},
+				},
+			},
+		}
+		if _, err := protodelim.MarshalTo(&output, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("streamed proto", func(t *testing.T) {
+		context := &Context{BazelCmd: cqueryOutputBazelCmd{output: output.Bytes()}}
+		var names []string
+		err := streamCqueryResult(context, "//...", true, "release 8.2.0", func(target *analysis.ConfiguredTarget) error {
+			stripUnhashedFields(target)
+			if target.GetTarget().GetRule().GetLocation() != "" || len(target.GetTarget().GetRule().GetRuleOutput()) != 0 {
+				t.Errorf("expected unhashed fields to be stripped from %v", target)
+			}
+			if target.GetConfiguration().GetChecksum() != configurationChecksum || target.GetConfiguration().GetMnemonic() != "" {
+				t.Errorf("expected only the configuration checksum to be retained, got %v", target.GetConfiguration())
+			}
+			names = append(names, target.GetTarget().GetRule().GetName())
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("streamCqueryResult failed: %v", err)
+		}
+		if len(names) != 2 || names[0] != "//:a" || names[1] != "//:b" {
+			t.Errorf("expected to see //:a and //:b, got %v", names)
+		}
+	})
+
+	t.Run("handler error stops streaming", func(t *testing.T) {
+		context := &Context{BazelCmd: cqueryOutputBazelCmd{output: output.Bytes()}}
+		wantErr := fmt.Errorf("stop")
+		calls := 0
+		err := streamCqueryResult(context, "//...", true, "release 8.2.0", func(target *analysis.ConfiguredTarget) error {
+			calls++
+			return wantErr
+		})
+		if err != wantErr {
+			t.Errorf("expected handler error, got %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("expected handler to be called once, got %d", calls)
+		}
+	})
+}
+
+func TestCompact(t *testing.T) {
+	_, cqueryResult := layoutProject(t)
+	results := hashedHelloWorld(t, cqueryResult)
+	helloWorld := LabelAndConfiguration{
+		Label:         mustParseLabel("//HelloWorld:HelloWorld"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+	want, err := results.TargetHashCache.Hash(helloWorld)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+
+	results.Compact()
+
+	got, err := results.TargetHashCache.Hash(helloWorld)
+	if err != nil {
+		t.Fatalf("Failed to hash after compacting: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("hash changed by compacting: want %v got %v", want, got)
+	}
+	if len(results.TransitiveConfiguredTargets) != 1 {
+		t.Errorf("expected only the matching target to be retained, got %v", results.TransitiveConfiguredTargets)
+	}
+	configuredTarget := results.TransitiveConfiguredTargets[helloWorld.Label][helloWorld.Configuration]
+	if got := configuredTarget.GetTarget().GetRule().GetRuleClass(); got != "java_binary" {
+		t.Errorf("expected rule class to be retained, got %q", got)
+	}
+	if got := configuredTarget.GetConfiguration().GetChecksum(); got != configurationChecksum {
+		t.Errorf("expected configuration checksum to be retained, got %q", got)
+	}
+	if _, err := results.TargetHashCache.Hash(LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:GreetingLib"), Configuration: helloWorld.Configuration}); err == nil {
+		t.Errorf("expected hashes of non-matching targets to be released")
+	}
+}
+
+// shutdownRecordingBazelCmd implements BazelCmd, recording the directory each output base was shut
+// down in. Everything after the shutdown fails, so only revisions loaded from cache succeed.
+type shutdownRecordingBazelCmd struct {
+	fakeBazelCmd
+	mu        sync.Mutex
+	shutdowns map[string]string
+}
+
+func (c *shutdownRecordingBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	if command == "shutdown" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.shutdowns[startupArgs[1]] = config.Dir
+		return 0, nil
+	}
+	return c.fakeBazelCmd.Execute(config, startupArgs, command, args...)
+}
+
+// parallelRevisionsTest sets up a workspace with two commits, and a context to process them in
+// parallel, with the after commit checked out.
+func parallelRevisionsTest(t *testing.T) (*Context, *shutdownRecordingBazelCmd, LabelledGitRev, LabelledGitRev) {
+	t.Helper()
+	workspace := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		if _, err := runToLines(workspace, "git", args...); err != nil {
+			t.Fatalf("git %v failed: %v", args, err)
+		}
+	}
+	git("init", "-q")
+	for _, content := range []string{"before", "after"} {
+		if err := os.WriteFile(filepath.Join(workspace, "BUILD.bazel"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "BUILD.bazel")
+		git("commit", "-q", "-m", content)
+		git("tag", content)
+	}
+
+	revBefore, err := NewLabelledGitRev(workspace, "before", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revAfter, err := NewLabelledGitRev(workspace, "after", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bazelCmd := &shutdownRecordingBazelCmd{fakeBazelCmd: fakeBazelCmd{release: "release 7.0.0"}, shutdowns: map[string]string{}}
+	context := &Context{
+		WorkspacePath:              workspace,
+		OriginalRevision:           revAfter,
+		BazelCmd:                   bazelCmd,
+		BazelOutputBase:            filepath.Join(t.TempDir(), "output_base"),
+		AnalysisCacheClearStrategy: "shutdown",
+		ParallelRevisions:          true,
+		CacheDirectory:             t.TempDir(),
+		NoCacheFileDigests:         true,
+	}
+	return context, bazelCmd, revBefore, revAfter
+}
+
+// cacheResultsOf saves results for rev to the cache, so that processing rev doesn't run Bazel.
+func cacheResultsOf(t *testing.T, context *Context, rev LabelledGitRev, targets TargetsList) {
+	t.Helper()
+	treeSha, err := GitTreeSHA(context, rev.GitRevision.Sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cqueryResult := layoutProject(t)
+	if err := SaveToCache(context, treeSha, targets.String(), hashedHelloWorld(t, cqueryResult)); err != nil {
+		t.Fatalf("SaveToCache failed: %v", err)
+	}
+}
+
+func TestFullyProcessInParallelIsolatesBeforeRevision(t *testing.T) {
+	context, bazelCmd, revBefore, revAfter := parallelRevisionsTest(t)
+	targets, _ := ParseTargetsList("//...")
+
+	if _, _, err := FullyProcess(context, revBefore, revAfter, targets); err == nil {
+		t.Fatalf("expected an error, as neither revision was cached")
+	}
+
+	if got := bazelCmd.shutdowns[context.BazelOutputBase]; got != context.WorkspacePath {
+		t.Errorf("expected %s to be processed in the workspace, got %q", revAfter, got)
+	}
+	beforeWorktree, ok := bazelCmd.shutdowns[context.BazelOutputBase+"_td_before"]
+	if !ok {
+		t.Fatalf("expected %s to be processed with a dedicated output base, got %v", revBefore, bazelCmd.shutdowns)
+	}
+	if beforeWorktree == context.WorkspacePath || !strings.HasSuffix(beforeWorktree, "-before") {
+		t.Errorf("expected %s to be processed in a dedicated worktree, got %q", revBefore, beforeWorktree)
+	}
+	for dir, want := range map[string]LabelledGitRev{context.WorkspacePath: revAfter, beforeWorktree: revBefore} {
+		head, err := GitRevParse(dir, "HEAD", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != want.GitRevision.Sha {
+			t.Errorf("expected %s to have %s checked out, got %s", dir, want, head)
+		}
+	}
+}
+
+func TestFullyProcessInParallelPropagatesErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cached     []string
+		wantFailed string
+	}{
+		"before fails":  {cached: []string{"after"}, wantFailed: "before"},
+		"after fails":   {cached: []string{"before"}, wantFailed: "after"},
+		"both fail":     {wantFailed: "before"},
+		"neither fails": {cached: []string{"before", "after"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			context, _, revBefore, revAfter := parallelRevisionsTest(t)
+			targets, _ := ParseTargetsList("//...")
+			revs := map[string]LabelledGitRev{"before": revBefore, "after": revAfter}
+			for _, rev := range tc.cached {
+				cacheResultsOf(t, context, revs[rev], targets)
+			}
+
+			queryInfoBefore, queryInfoAfter, err := fullyProcessInParallel(context, revBefore, revAfter, targets)
+			if tc.wantFailed == "" {
+				if err != nil {
+					t.Fatalf("fullyProcessInParallel failed: %v", err)
+				}
+				if queryInfoBefore == nil || queryInfoAfter == nil {
+					t.Errorf("expected results for both revisions, got %v and %v", queryInfoBefore, queryInfoAfter)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if want := revs[tc.wantFailed].String(); !strings.Contains(err.Error(), want) {
+				t.Errorf("expected the error of %s, got %v", want, err)
+			}
+			if queryInfoBefore != nil || queryInfoAfter != nil {
+				t.Errorf("expected no results on error, got %v and %v", queryInfoBefore, queryInfoAfter)
+			}
+		})
+	}
+}
+
+func TestHandleBeforeQueryError(t *testing.T) {
+	revBefore := LabelledGitRev{Label: "before", GitRevision: GitRev{Revision: "before", Sha: "b"}}
+	revAfter := LabelledGitRev{Label: "after", GitRevision: GitRev{Revision: "after", Sha: "a"}}
+	queryErr := errors.New("query failed")
+	partialResults := &QueryResults{BazelRelease: "release 7.0.0"}
+
+	for name, tc := range map[string]struct {
+		behavior    string
+		queryInfo   *QueryResults
+		err         error
+		wantResults *QueryResults
+		wantErr     bool
+	}{
+		"no error":                        {queryInfo: partialResults, wantResults: partialResults},
+		"error without results":           {behavior: "ignore-and-build-all", err: queryErr, wantErr: true},
+		"error with results, ignored":     {behavior: "ignore-and-build-all", queryInfo: partialResults, err: queryErr, wantResults: partialResults},
+		"error with results, not ignored": {behavior: "fatal", queryInfo: partialResults, err: queryErr, wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			context := &Context{BeforeQueryErrorBehavior: tc.behavior}
+			got, err := handleBeforeQueryError(context, revBefore, revAfter, tc.queryInfo, tc.err)
+			if tc.wantErr {
+				if !errors.Is(err, queryErr) {
+					t.Errorf("expected the query error, got %v", err)
+				}
+				if got != nil {
+					t.Errorf("expected no results on error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handleBeforeQueryError failed: %v", err)
+			}
+			if got != tc.wantResults {
+				t.Errorf("want results %v, got %v", tc.wantResults, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// Bazel 7 and later log resolved toolchains as:
+//
+//	ToolchainResolution: Target platform @@platforms//host:host: Selected execution platform @@platforms//host:host, type @@bazel_tools//tools/jdk:runtime_toolchain_type -> toolchain @@rules_java+//toolchains:jdk
+var toolchainResolutionSelectedRegex = regexp.MustCompile(`type (\S+) -> toolchain (\S+)`)
+
+// Earlier versions of Bazel log resolved toolchains as:
+//
+//	ToolchainResolution:   Type @bazel_tools//tools/cpp:toolchain_type: target platform @local_config_platform//:host: execution @local_config_platform//:host: Selected toolchain @local_config_cc//:cc-compiler-k8
+var legacyToolchainResolutionSelectedRegex = regexp.MustCompile(`Type (\S+): .*Selected toolchain (\S+)`)
+
+// findResolvedToolchains returns the toolchain implementations which Bazel resolved when analyzing
+// the targets matching pattern, mapped to the toolchain types they were resolved for.
+//
+// Bazel doesn't expose resolved toolchains in cquery output, so we run a separate cquery with
+// --toolchain_resolution_debug and parse its log. This option is part of the configuration, so this
+// cquery doesn't share an analysis cache with the other queries we run.
+func findResolvedToolchains(context *Context, pattern string, n *Normalizer, bazelRelease string) (map[label.Label][]string, error) {
+	log.Printf("Finding resolved toolchains under %s", pattern)
+	var stderr bytes.Buffer
+	returnVal, err := context.BazelCmd.Cquery(
+		bazelRelease,
+		BazelCmdConfig{Dir: context.WorkspacePath, Stdout: io.Discard, Stderr: &stderr},
+		[]string{"--output_base", context.BazelOutputBase},
+		pattern,
+		"--output=label",
+		"--toolchain_resolution_debug=.*",
+	)
+	if returnVal != 0 || err != nil {
+		return nil, fmt.Errorf("failed to run toolchain resolution cquery on %s: %w. Stderr:\n%v", pattern, err, stderr.String())
+	}
+	return parseResolvedToolchains(&stderr, n)
+}
+
+func parseResolvedToolchains(r io.Reader, n *Normalizer) (map[label.Label][]string, error) {
+	toolchainTypeSets := make(map[label.Label]map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		matches := toolchainResolutionSelectedRegex.FindStringSubmatch(line)
+		if matches == nil {
+			matches = legacyToolchainResolutionSelectedRegex.FindStringSubmatch(line)
+		}
+		if matches == nil {
+			continue
+		}
+		toolchainType, err := n.ParseCanonicalLabel(matches[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse toolchain type label %s: %w", matches[1], err)
+		}
+		toolchain, err := n.ParseCanonicalLabel(matches[2])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse toolchain label %s: %w", matches[2], err)
+		}
+		if _, ok := toolchainTypeSets[toolchain]; !ok {
+			toolchainTypeSets[toolchain] = make(map[string]struct{})
+		}
+		toolchainTypeSets[toolchain][toolchainType.String()] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read toolchain resolution output: %w", err)
+	}
+
+	toolchainTypes := make(map[label.Label][]string, len(toolchainTypeSets))
+	for toolchain, typeSet := range toolchainTypeSets {
+		types := make([]string, 0, len(typeSet))
+		for toolchainType := range typeSet {
+			types = append(types, toolchainType)
+		}
+		sort.Strings(types)
+		toolchainTypes[toolchain] = types
+	}
+	return toolchainTypes, nil
+}
+
+// resolvedToolchainsOf returns, for each toolchain type, the sorted labels of the toolchain
+// implementations among labelsAndConfigurations which were resolved for that type.
+func (thc *TargetHashCache) resolvedToolchainsOf(labelsAndConfigurations []LabelAndConfigurations) map[string][]string {
+	resolved := make(map[string][]string)
+	for _, labelAndConfigurations := range labelsAndConfigurations {
+		for _, toolchainType := range thc.toolchainTypes[labelAndConfigurations.Label] {
+			resolved[toolchainType] = append(resolved[toolchainType], labelAndConfigurations.Label.String())
+		}
+	}
+	for _, toolchains := range resolved {
+		sort.Strings(toolchains)
+	}
+	return resolved
+}
+
+// sortedToolchainTypes returns the sorted union of the toolchain types in left and right.
+func sortedToolchainTypes(left, right map[string][]string) []string {
+	typeSet := make(map[string]struct{}, len(left)+len(right))
+	for toolchainType := range left {
+		typeSet[toolchainType] = struct{}{}
+	}
+	for toolchainType := range right {
+		typeSet[toolchainType] = struct{}{}
+	}
+	types := make([]string, 0, len(typeSet))
+	for toolchainType := range typeSet {
+		types = append(types, toolchainType)
+	}
+	sort.Strings(types)
+	return types
+}
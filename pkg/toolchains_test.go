@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseResolvedToolchains(t *testing.T) {
+	output := `INFO: ToolchainResolution: Target platform @@platforms//host:host: Selected execution platform @@platforms//host:host, type @@bazel_tools//tools/jdk:runtime_toolchain_type -> toolchain @@rules_java+//toolchains:jdk_21
+INFO: ToolchainResolution: Target platform @@platforms//host:host: Selected execution platform @@platforms//host:host, type @@bazel_tools//tools/jdk:bootstrap_runtime_toolchain_type -> toolchain @@rules_java+//toolchains:jdk_21
+INFO: ToolchainResolution:   Type @bazel_tools//tools/cpp:toolchain_type: target platform @local_config_platform//:host: execution @local_config_platform//:host: Selected toolchain @local_config_cc//:cc-compiler-k8
+INFO: ToolchainResolution: Removed execution platform @@platforms//host:host from available execution platforms, it is missing constraint @@platforms//os:windows
+`
+	n := Normalizer{}
+	got, err := parseResolvedToolchains(strings.NewReader(output), &n)
+	if err != nil {
+		t.Fatalf("parseResolvedToolchains failed: %v", err)
+	}
+	want := map[label.Label][]string{
+		mustParseLabel("@@rules_java+//toolchains:jdk_21"): {
+			"@@bazel_tools//tools/jdk:bootstrap_runtime_toolchain_type",
+			"@@bazel_tools//tools/jdk:runtime_toolchain_type",
+		},
+		mustParseLabel("@local_config_cc//:cc-compiler-k8"): {
+			"@bazel_tools//tools/cpp:toolchain_type",
+		},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("wrong resolved toolchains: want %v got %v", want, got)
+	}
+}
+
+func TestWalkDiffsReportsToolchainChanges(t *testing.T) {
+	configuration := &analysis.Configuration{Checksum: configurationChecksum}
+	const toolchainType = "@@bazel_tools//tools/jdk:runtime_toolchain_type"
+	const bazelVersion = "release 5.1.1"
+	labelAndConfiguration := LabelAndConfiguration{
+		Label:         mustParseLabel("//:lib"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+
+	withToolchain := func(toolchain string) *TargetHashCache {
+		cqueryResult := &analysis.CqueryResult{
+			Results: []*analysis.ConfiguredTarget{
+				{
+					Target: &build.Target{
+						Type: build.Target_RULE.Enum(),
+						Rule: &build.Rule{
+							Name:      proto.String("//:lib"),
+							RuleClass: proto.String("java_library"),
+							RuleInput: []string{toolchain},
+						},
+					},
+					Configuration: configuration,
+				},
+				{
+					Target: &build.Target{
+						Type: build.Target_RULE.Enum(),
+						Rule: &build.Rule{
+							Name:      proto.String(toolchain),
+							RuleClass: proto.String("java_runtime"),
+						},
+					},
+					Configuration: configuration,
+				},
+			},
+		}
+		thc := parseResult(t, cqueryResult, bazelVersion)
+		thc.UseResolvedToolchains(map[label.Label][]string{mustParseLabel(toolchain): {toolchainType}})
+		return thc
+	}
+
+	before := withToolchain("@@rules_java+//toolchains:jdk_17")
+	after := withToolchain("@@rules_java+//toolchains:jdk_21")
+	differences, err := WalkDiffs(before, after, labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("WalkDiffs failed: %v", err)
+	}
+	want := []Difference{{
+		Category: "ToolchainChanged",
+		Key:      toolchainType,
+		Before:   "@@rules_java+//toolchains:jdk_17",
+		After:    "@@rules_java+//toolchains:jdk_21",
+	}}
+	if !reflect.DeepEqual(want, differences) {
+		t.Errorf("wrong differences: want %v got %v", want, differences)
+	}
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/common"
+)
+
+// WorkingCopyDigest returns a digest of the uncommitted state of the working copy in
+// workspacePath: the paths which git reports as modified, added, deleted, renamed or untracked
+// (other than those under ignoredFiles), and their contents. Together with the tree SHA of HEAD, it
+// identifies what Bazel sees in an unclean working copy.
+//
+// Dirty submodules are digested by their HEAD commit and, recursively, their own uncommitted state.
+func WorkingCopyDigest(workspacePath string, ignoredFiles []common.RelPath) (string, error) {
+	paths, err := dirtyPaths(workspacePath, ignoredFiles)
+	if err != nil {
+		return "", err
+	}
+	return digestPaths(workspacePath, paths)
+}
+
+// dirtyStateCacheKey returns the key under which results are cached for a working copy whose HEAD
+// has treeSHA, with uncommitted state digested by WorkingCopyDigest.
+func dirtyStateCacheKey(treeSHA string, workingCopyDigest string) string {
+	return treeSHA + "-dirty-" + workingCopyDigest
+}
+
+func dirtyPaths(workspacePath string, ignoredFiles []common.RelPath) ([]string, error) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	gitCmd := exec.Command("git", "status", "--porcelain", "-z", "--untracked-files=all", "--ignore-submodules=none")
+	gitCmd.Dir = workspacePath
+	gitCmd.Stdout = &stdoutBuf
+	gitCmd.Stderr = &stderrBuf
+	if err := gitCmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to get git status: %w. Stderr: %v", err, stderrBuf.String())
+	}
+
+	var paths []string
+	for _, path := range parseGitStatusZ(stdoutBuf.String()) {
+		if !stringSliceContainsStartingWith(ignoredFiles, common.NewRelPath(path)) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// parseGitStatusZ returns the sorted, unique paths in the output of `git status --porcelain -z`,
+// including both the source and destination of renames and copies.
+func parseGitStatusZ(output string) []string {
+	pathSet := make(map[string]struct{})
+	records := strings.Split(output, "\x00")
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		if len(record) < 4 {
+			continue
+		}
+		pathSet[record[3:]] = struct{}{}
+		// Renames and copies are followed by a record holding the original path.
+		if (record[0] == 'R' || record[0] == 'C') && i+1 < len(records) {
+			i++
+			pathSet[records[i]] = struct{}{}
+		}
+	}
+	paths := make([]string, 0, len(pathSet))
+	for path := range pathSet {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// digestPaths digests each of the sorted paths (relative to root): whether it exists, its type,
+// whether it is executable, and its contents (or target, for symlinks).
+func digestPaths(root string, paths []string) (string, error) {
+	hasher := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(hasher, "%s\x00", path)
+		absolutePath := filepath.Join(root, filepath.FromSlash(path))
+		info, err := os.Lstat(absolutePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprint(hasher, "deleted\x00")
+				continue
+			}
+			return "", fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(absolutePath)
+			if err != nil {
+				return "", fmt.Errorf("failed to read symlink %s: %w", path, err)
+			}
+			fmt.Fprintf(hasher, "symlink\x00%s\x00", target)
+		case info.IsDir():
+			// A submodule or nested repository.
+			submoduleHead, err := runToLines(absolutePath, "git", "rev-parse", "HEAD")
+			if err != nil {
+				return "", fmt.Errorf("failed to get HEAD of submodule %s: %w", path, err)
+			}
+			if len(submoduleHead) != 1 {
+				return "", fmt.Errorf("failed to get HEAD of submodule %s: unexpected output %v", path, submoduleHead)
+			}
+			submoduleDigest, err := WorkingCopyDigest(absolutePath, nil)
+			if err != nil {
+				return "", fmt.Errorf("failed to digest submodule %s: %w", path, err)
+			}
+			fmt.Fprintf(hasher, "submodule\x00%s\x00%s\x00", submoduleHead[0], submoduleDigest)
+		default:
+			fmt.Fprintf(hasher, "file\x00%t\x00%d\x00", info.Mode()&0111 != 0, info.Size())
+			file, err := os.Open(absolutePath)
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			_, err = io.Copy(hasher, file)
+			file.Close()
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %w", path, err)
+			}
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseGitStatusZ(t *testing.T) {
+	output := " M b/modified.go\x00?? a/untracked.txt\x00R  new/name.go\x00old/name.go\x00 D deleted.go\x00 M b/modified.go\x00"
+	want := []string{"a/untracked.txt", "b/modified.go", "deleted.go", "new/name.go", "old/name.go"}
+	if got := parseGitStatusZ(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := parseGitStatusZ(""); len(got) != 0 {
+		t.Errorf("expected no paths for a clean working copy, got %v", got)
+	}
+}
+
+func TestDigestPaths(t *testing.T) {
+	root := t.TempDir()
+	write := func(path string, contents string, mode os.FileMode) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, path), []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(root, path), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest := func(paths ...string) string {
+		d, err := digestPaths(root, paths)
+		if err != nil {
+			t.Fatalf("digestPaths failed: %v", err)
+		}
+		return d
+	}
+
+	write("a/file.txt", "contents", 0644)
+	write("b.sh", "#!/bin/sh", 0644)
+	original := digest("a/file.txt", "b.sh", "deleted.txt")
+	if again := digest("a/file.txt", "b.sh", "deleted.txt"); again != original {
+		t.Errorf("expected the digest to be stable, got %s and %s", original, again)
+	}
+
+	write("a/file.txt", "changed", 0644)
+	changedContents := digest("a/file.txt", "b.sh", "deleted.txt")
+	write("a/file.txt", "contents", 0644)
+	write("b.sh", "#!/bin/sh", 0755)
+	changedMode := digest("a/file.txt", "b.sh", "deleted.txt")
+	write("b.sh", "#!/bin/sh", 0644)
+	write("deleted.txt", "", 0644)
+	recreated := digest("a/file.txt", "b.sh", "deleted.txt")
+
+	seen := map[string]string{original: "original"}
+	for name, d := range map[string]string{"changed contents": changedContents, "changed mode": changedMode, "recreated file": recreated} {
+		if previous, ok := seen[d]; ok {
+			t.Errorf("expected %s to change the digest, but it matched %s", name, previous)
+		}
+		seen[d] = name
+	}
+	if restored := digest("a/file.txt", "b.sh", "deleted.txt"); restored != recreated {
+		t.Errorf("expected the same state to produce the same digest")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/cli"
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// cacheSubcommands are the subcommands of the `cache` subcommand, which manage the results cache.
+var cacheSubcommands = map[string]func(){
+	"gc":     cacheGCMain,
+	"list":   cacheListMain,
+	"show":   cacheShowMain,
+	"verify": cacheVerifyMain,
+}
+
+// cacheMain implements the `cache` subcommand, dispatching to one of cacheSubcommands.
+func cacheMain() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := cacheSubcommands[os.Args[1]]; ok {
+			os.Args = append([]string{os.Args[0] + " " + os.Args[1]}, os.Args[2:]...)
+			subcommand()
+			return
+		}
+	}
+
+	names := make([]string, 0, len(cacheSubcommands))
+	for name := range cacheSubcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "  %s <%s> [flags]\n", filepath.Base(os.Args[0]), strings.Join(names, "|"))
+	os.Exit(1)
+}
+
+// cacheGCMain implements the `cache gc` subcommand, which removes cached results exceeding the
+// configured limits, temporary files left behind by interrupted invocations, and the persisted
+// digests of files which no longer exist.
+func cacheGCMain() {
+	var maxSize cli.ByteSizeFlag
+	var maxAge time.Duration
+	cacheDir := flag.String("cache-dir", cli.DefaultCacheDir(), "Cache directory to garbage collect.")
+	cli.RegisterCacheLimitFlags(&maxSize, &maxAge)
+	flag.Parse()
+
+	if len(flag.Args()) != 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: expected no positional arguments, but got %d\n", len(flag.Args()))
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	stats, err := pkg.NewDirectoryResultsCache(*cacheDir).GarbageCollect(int64(maxSize), maxAge)
+	if err != nil {
+		log.Fatalf("Failed to garbage collect cache: %v", err)
+	}
+	log.Printf("Garbage collected %s: %s", *cacheDir, stats)
+
+	pruned, err := pkg.PruneFileDigestStore(*cacheDir)
+	if err != nil {
+		log.Fatalf("Failed to prune file digest cache: %v", err)
+	}
+	log.Printf("Pruned the digests of %d files which no longer exist", pruned)
+}
+
+// cacheVerifyMain implements the `cache verify` subcommand, which checks every entry of the local
+// results cache, quarantining (or deleting) those which are corrupt. It exits with a non-zero status
+// if any were.
+func cacheVerifyMain() {
+	cacheDir := flag.String("cache-dir", cli.DefaultCacheDir(), "Cache directory to verify.")
+	remove := flag.Bool("delete", false, "Delete corrupt entries, rather than moving them to the quarantine directory inside --cache-dir.")
+	flag.Parse()
+	if len(flag.Args()) != 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: expected no positional arguments, but got %d\n", len(flag.Args()))
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	stats, err := pkg.NewDirectoryResultsCache(*cacheDir).Verify(*remove)
+	if err != nil {
+		log.Fatalf("Failed to verify cache: %v", err)
+	}
+	action := "Quarantined"
+	if *remove {
+		action = "Deleted"
+	}
+	for _, key := range stats.SortedKeys() {
+		log.Printf("%s corrupt entry %s: %v", action, key, stats.CorruptEntries[key])
+	}
+	for _, key := range stats.SortedIncompatibleKeys() {
+		log.Printf("Skipped incompatible entry %s: %v", key, stats.IncompatibleEntries[key])
+	}
+	log.Printf("Verified %s: %s", *cacheDir, stats)
+	if len(stats.CorruptEntries) > 0 {
+		os.Exit(1)
+	}
+}
+
+// cacheListMain implements the `cache list` subcommand, which summarizes the entries of the local
+// results cache, most recently used first.
+func cacheListMain() {
+	cacheDir := flag.String("cache-dir", cli.DefaultCacheDir(), "Cache directory to list the entries of.")
+	flag.Parse()
+	if len(flag.Args()) != 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: expected no positional arguments, but got %d\n", len(flag.Args()))
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	summaries, err := pkg.NewDirectoryResultsCache(*cacheDir).List()
+	if err != nil {
+		log.Fatalf("Failed to list cache: %v", err)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSIZE\tLAST USED\tCREATED\tTARGETS\tEXPLANATIONS\tTREE\tPATTERN")
+	for _, summary := range summaries {
+		if summary.Err != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\t-\tunreadable: %v\n",
+				abbreviate(summary.Key, 16), pkg.FormatBytes(summary.Size), formatAge(now, summary.LastUsed), summary.Err)
+			continue
+		}
+		tree, pattern := "-", "-"
+		if summary.CacheKey != nil {
+			tree, pattern = abbreviate(summary.CacheKey.GitTreeSHA, 12), summary.CacheKey.TargetPattern
+		}
+		explanations := "no"
+		if summary.HasExplanations {
+			explanations = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			abbreviate(summary.Key, 16), pkg.FormatBytes(summary.Size), formatAge(now, summary.LastUsed),
+			formatAge(now, summary.Created), summary.MatchingTargets, explanations, tree, pattern)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to write cache entries: %v", err)
+	}
+}
+
+// cacheShowMain implements the `cache show <key>` subcommand, which describes an entry of the local
+// results cache, including the components its key was derived from.
+func cacheShowMain() {
+	cacheDir := flag.String("cache-dir", cli.DefaultCacheDir(), "Cache directory containing the entry.")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: expected a single cache key (or a prefix of one), but got %d positional arguments\n", len(flag.Args()))
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [flags] <key>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	summary, err := pkg.NewDirectoryResultsCache(*cacheDir).Describe(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read cache entry: %v", err)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Key:\t%s\n", summary.Key)
+	fmt.Fprintf(w, "Size:\t%s\n", pkg.FormatBytes(summary.Size))
+	fmt.Fprintf(w, "Last used:\t%s\n", formatTime(now, summary.LastUsed))
+	if summary.Err != nil {
+		fmt.Fprintf(w, "Error:\t%v\n", summary.Err)
+	} else {
+		fmt.Fprintf(w, "Created:\t%s\n", formatTime(now, summary.Created))
+		fmt.Fprintf(w, "Bazel release:\t%s\n", summary.BazelRelease)
+		fmt.Fprintf(w, "Matching targets:\t%d (%d configured)\n", summary.MatchingTargets, summary.ConfiguredMatchingTargets)
+		if summary.HasExplanations {
+			fmt.Fprintf(w, "Explanations:\tyes (%d configured targets)\n", summary.ConfiguredTargets)
+		} else {
+			fmt.Fprintf(w, "Explanations:\tno\n")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to write cache entry: %v", err)
+	}
+	if summary.Err != nil {
+		os.Exit(1)
+	}
+
+	if summary.CacheKey == nil {
+		fmt.Println("Cache key components: not recorded (written by an older version)")
+		return
+	}
+	fmt.Println("Cache key components:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "  TD binary hash:\t%s\n", summary.CacheKey.TDBinaryHash)
+	fmt.Fprintf(w, "  Bazel version:\t%s\n", summary.CacheKey.BazelVersion)
+	fmt.Fprintf(w, "  Git tree SHA:\t%s\n", summary.CacheKey.GitTreeSHA)
+	fmt.Fprintf(w, "  Target pattern:\t%s\n", summary.CacheKey.TargetPattern)
+	if summary.CacheKey.HostFingerprint != nil {
+		fmt.Fprintf(w, "  Host fingerprint:\t%s\n", mustMarshalJSON(summary.CacheKey.HostFingerprint))
+	}
+	names := make([]string, 0, len(summary.CacheKey.Context))
+	for name := range summary.CacheKey.Context {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s:\t%s\n", name, mustMarshalJSON(summary.CacheKey.Context[name]))
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to write cache entry: %v", err)
+	}
+}
+
+// abbreviate returns the first n characters of s.
+func abbreviate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// formatAge describes how long before now t was, e.g. "3h ago", or "-" if t is zero.
+func formatAge(now time.Time, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	age := now.Sub(t)
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%ds ago", int(age.Seconds()))
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+	}
+}
+
+// formatTime formats t along with its age, or "unknown" if t is zero.
+func formatTime(now time.Time, t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s (%s)", t.Format(time.RFC3339), formatAge(now, t))
+}
+
+func mustMarshalJSON(v interface{}) string {
+	serialized, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("Failed to marshal %v: %v", v, err)
+	}
+	return string(serialized)
+}
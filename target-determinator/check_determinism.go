@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/cli"
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// checkDeterminismMain implements the `check-determinism` subcommand, which computes the hashes of
+// all matching targets at a single revision twice, and reports any targets whose hashes differ.
+// It exits with a non-zero status if any were found.
+func checkDeterminismMain() {
+	start := time.Now()
+	defer func() { log.Printf("Finished after %v", time.Since(start)) }()
+
+	commonFlags := cli.RegisterCommonFlags()
+	var options pkg.DeterminismCheckOptions
+	flag.BoolVar(&options.RestartBazel, "restart-bazel", false, "Whether to shut down the Bazel server before computing hashes the second time.")
+	flag.StringVar(&options.SecondWorkspacePath, "second-workspace", "", "Path to another checkout of the repository (e.g. a git worktree) in which to compute hashes the second time. If empty, the --working-directory is used both times.")
+	flag.Parse()
+
+	revision, err := cli.ValidateCommonFlagsWithRevision("target-determinator", commonFlags, "revision")
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: %v\n", err)
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s <revision>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Where <revision> may be any commit revision - full commit hashes, short commit hashes, tags, branches, etc.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Optional flags:\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if options.SecondWorkspacePath != "" {
+		options.SecondWorkspacePath, err = filepath.Abs(options.SecondWorkspacePath)
+		if err != nil {
+			log.Fatalf("Failed to resolve --second-workspace: %v", err)
+		}
+	}
+
+	commonConfig, err := cli.ResolveCommonConfig(commonFlags, revision)
+	if err != nil {
+		log.Fatalf("Error during preprocessing: %v", err)
+	}
+	rev := commonConfig.RevisionBefore
+	rev.Label = "checked"
+
+	report, err := pkg.CheckDeterminism(commonConfig.Context, rev, commonConfig.Targets, options)
+	if err != nil {
+		log.Fatalf("Failed to check determinism: %v", err)
+	}
+
+	if len(report.UnstableTargets) == 0 {
+		log.Println("All target hashes were stable")
+		return
+	}
+	fmt.Println("Targets with unstable hashes:")
+	printUnstableTargets(report.UnstableTargets)
+	fmt.Println("Root causes:")
+	printUnstableTargets(report.RootCauses)
+	os.Exit(1)
+}
+
+func printUnstableTargets(unstableTargets []pkg.UnstableTarget) {
+	for _, unstableTarget := range unstableTargets {
+		fmt.Printf("%v %v", unstableTarget.Label, unstableTarget.Configuration.String())
+		if len(unstableTarget.Differences) > 0 {
+			fmt.Printf(" Changes:")
+			for i, difference := range unstableTarget.Differences {
+				if i > 0 {
+					fmt.Print(",")
+				}
+				fmt.Printf(" %v", difference.String())
+			}
+		}
+		fmt.Println("")
+	}
+}
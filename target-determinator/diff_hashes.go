@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// diffHashesMain implements the `diff-hashes` subcommand, which lists the targets affected between
+// two files written by the `hash` subcommand, without running Bazel.
+func diffHashesMain() {
+	flag.Parse()
+
+	positional := flag.Args()
+	if len(positional) != 2 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: expected two positional arguments, <before-hashes> <after-hashes>, but got %d\n", len(positional))
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s <before-hashes> <after-hashes>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Where <before-hashes> and <after-hashes> are files written by the hash subcommand.\n")
+		os.Exit(1)
+	}
+
+	before, err := readHashDumpFile(positional[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	after, err := readHashDumpFile(positional[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	seenLabels := make(map[gazelle_label.Label]struct{})
+	callback := func(label gazelle_label.Label, _ []pkg.Difference, _ *analysis.ConfiguredTarget) {
+		if _, seen := seenLabels[label]; seen {
+			return
+		}
+		fmt.Println(label)
+		seenLabels[label] = struct{}{}
+	}
+	if err := pkg.DiffHashDumps(before, after, callback); err != nil {
+		// Print something on stdout that will make bazel fail when passed as a target.
+		fmt.Println("Target Determinator invocation Error")
+		log.Fatal(err)
+	}
+}
+
+func readHashDumpFile(path string) (*pkg.HashDump, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hash dump: %w", err)
+	}
+	defer file.Close()
+	dump, err := pkg.ReadHashDump(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return dump, nil
+}
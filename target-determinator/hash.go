@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/cli"
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// hashMain implements the `hash` subcommand, which writes the hashes of all matching targets at a
+// single revision to a file, so that they can later be compared using the `diff-hashes` subcommand.
+func hashMain() {
+	start := time.Now()
+	defer func() { log.Printf("Finished after %v", time.Since(start)) }()
+
+	commonFlags := cli.RegisterCommonFlags()
+	output := flag.String("output", "", "File to write the hashes to. If empty, hashes are written to stdout.")
+	flag.Parse()
+
+	revision, err := cli.ValidateCommonFlagsWithRevision("target-determinator", commonFlags, "revision")
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: %v\n", err)
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s <revision>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Where <revision> may be any commit revision - full commit hashes, short commit hashes, tags, branches, etc.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Optional flags:\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	commonConfig, err := cli.ResolveCommonConfig(commonFlags, revision)
+	if err != nil {
+		log.Fatalf("Error during preprocessing: %v", err)
+	}
+	rev := commonConfig.RevisionBefore
+	rev.Label = "hashed"
+
+	dump, err := pkg.ComputeHashDump(commonConfig.Context, rev, commonConfig.Targets)
+	if err != nil {
+		log.Fatalf("Failed to compute hashes: %v", err)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+	}
+	if err := pkg.WriteHashDump(out, dump); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("Failed to close output file: %v", err)
+	}
+}
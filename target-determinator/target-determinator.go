@@ -4,6 +4,12 @@
 // over-building rather than under-building.
 // In verbose mode, the first token per line will be the target to run, and after a space character,
 // additional information may be printed explaining why a target was detected to be affected.
+//
+// The `hash` and `diff-hashes` subcommands allow recording the hashes of targets at a revision, and
+// comparing recorded hashes later without re-running Bazel. The `check-determinism` subcommand
+// reports targets whose hashes aren't stable across repeated computations at the same revision.
+// The `cache gc` subcommand removes cached results exceeding --cache-max-size or --cache-max-age.
+// The `warm` subcommand saves the results of revisions to the results cache ahead of time.
 
 package main
 
@@ -34,7 +40,26 @@ type config struct {
 	Verbose        bool
 }
 
+// subcommands are run instead of the default command when named by the first argument, e.g.
+// `target-determinator hash HEAD`.
+var subcommands = map[string]func(){
+	"hash":              hashMain,
+	"diff-hashes":       diffHashesMain,
+	"check-determinism": checkDeterminismMain,
+	"cache":             cacheMain,
+	"warm":              warmMain,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			// Drop the subcommand so that flags are parsed as usual, but keep it in usage messages.
+			os.Args = append([]string{os.Args[0] + " " + os.Args[1]}, os.Args[2:]...)
+			subcommand()
+			return
+		}
+	}
+
 	start := time.Now()
 	defer func() { log.Printf("Finished after %v", time.Since(start)) }()
 
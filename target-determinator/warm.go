@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/cli"
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// warmMain implements the `warm` subcommand, which saves the results of all matching targets at
+// each of the given revisions to the results cache, unless they are already cached. It exits with a
+// non-zero status if any revision couldn't be processed.
+func warmMain() {
+	start := time.Now()
+	defer func() { log.Printf("Finished after %v", time.Since(start)) }()
+
+	commonFlags := cli.RegisterCommonFlags()
+	flag.Parse()
+
+	revisions, err := cli.ValidateCommonFlagsWithRevisions("target-determinator", commonFlags, "revision")
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: %v\n", err)
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s <revision>...\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Where each <revision> may be any commit revision - full commit hashes, short commit hashes, tags, branches, etc.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Optional flags:\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	commonConfig, err := cli.ResolveCommonConfig(commonFlags, revisions[0])
+	if err != nil {
+		log.Fatalf("Error during preprocessing: %v", err)
+	}
+	revs := make([]pkg.LabelledGitRev, 0, len(revisions))
+	for _, revision := range revisions {
+		rev, err := pkg.NewLabelledGitRev(commonConfig.Context.WorkspacePath, revision, "warmed")
+		if err != nil {
+			log.Fatalf("Failed to resolve git revision %s: %v", revision, err)
+		}
+		revs = append(revs, rev)
+	}
+
+	stats, err := pkg.WarmCache(commonConfig.Context, revs, commonConfig.Targets)
+	if errors.Is(err, pkg.ErrCacheWarmingInProgress) {
+		log.Printf("Not warming the cache: %v", err)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to warm the cache: %v", err)
+	}
+	log.Printf("Warmed the cache: %s", stats)
+	for _, revision := range stats.SortedFailedRevisions() {
+		log.Printf("Failed to warm the cache for %s: %v", revision, stats.FailedRevisions[revision])
+	}
+	if len(stats.FailedRevisions) > 0 {
+		os.Exit(1)
+	}
+}